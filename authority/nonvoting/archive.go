@@ -0,0 +1,110 @@
+// archive.go - Katzenpost nonvoting-authority document archive.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/daemons/internal/archive"
+)
+
+const archiveFile = "archive.db"
+
+type documentArchive struct {
+	logBackend *log.Backend
+	archive    *archive.Archive
+	archiver   *archive.Archiver
+	listener   *archive.Listener
+}
+
+func (a *documentArchive) halt() {
+	if a.listener != nil {
+		a.listener.Halt()
+	}
+	a.archiver.Halt()
+	a.archive.Close()
+}
+
+func (a *documentArchive) rotateLog() {
+	a.logBackend.Rotate()
+}
+
+// newDocumentArchive archives the documents published by svr for up to
+// maxEpochs epochs, and serves them on addr if it is set.
+func newDocumentArchive(cfg *config.Config, svr *authority, maxEpochs uint64, addr string) (*documentArchive, error) {
+	var err error
+	a := new(documentArchive)
+	if a.logBackend, err = newLogBackend(cfg); err != nil {
+		return nil, err
+	}
+	if a.archive, err = archive.New(filepath.Join(cfg.Authority.DataDir, archiveFile), maxEpochs); err != nil {
+		return nil, err
+	}
+
+	// The archive fetches documents from the authority itself, so that only
+	// documents that have actually been published are archived.
+	c, err := newSelfClient(cfg, svr, a.logBackend)
+	if err != nil {
+		a.archive.Close()
+		return nil, err
+	}
+	a.archiver = archive.NewArchiver(a.archive, c, a.logBackend.GetLogger("archive"))
+
+	if addr != "" {
+		identityKey := cfg.Debug.IdentityKey
+		if identityKey == nil {
+			identityKey, err = eddsa.Load(filepath.Join(cfg.Authority.DataDir, "identity.private.pem"), filepath.Join(cfg.Authority.DataDir, "identity.public.pem"), rand.Reader)
+			if err != nil {
+				a.halt()
+				return nil, err
+			}
+		}
+		a.listener, err = archive.NewListener(a.archive, addr, identityKey.PublicKey(), identityKey.ToECDH(), a.logBackend.GetLogger("archive/listener"))
+		if err != nil {
+			a.halt()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// newSelfClient returns a client that fetches the documents from the
+// authority svr itself.
+func newSelfClient(cfg *config.Config, svr *authority, logBackend *log.Backend) (pki.Client, error) {
+	return client.New(&client.Config{
+		LogBackend: logBackend,
+		Address:    cfg.Authority.Addresses[0],
+		PublicKey:  svr.IdentityKey(),
+	})
+}
+
+// exportArchive writes the document archive to dir.  The authority must
+// not be running.
+func exportArchive(cfg *config.Config, dir string) error {
+	a, err := archive.New(filepath.Join(cfg.Authority.DataDir, archiveFile), 0)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	return a.Export(dir)
+}
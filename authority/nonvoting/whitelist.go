@@ -0,0 +1,489 @@
+// whitelist.go - Katzenpost non-voting authority whitelist database.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/authority/nonvoting/server"
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/internal/measure"
+	"github.com/katzenpost/daemons/internal/rejection"
+	"github.com/katzenpost/daemons/internal/topology"
+	"github.com/katzenpost/daemons/internal/tuning"
+	"github.com/katzenpost/daemons/internal/whitelist"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const whitelistFile = "whitelist.db"
+
+// authority is the running authority server.  With the whitelist database
+// enabled, the authorized nodes are the config file's [[Mixes]] and
+// [[Providers]] plus the database entries, and the server is restarted
+// in-process with the config file reloaded whenever the database changes,
+// as the server only reads the authorized nodes at startup.  With node
+// measurement enabled, the nodes that fail the measurement thresholds are
+// dropped from the authorized nodes at startup, and the thresholds are
+// checked again at the start of every epoch, restarting the server if the
+// dropped nodes changed.  With a tuning policy, the Mu and LambdaM
+// [Parameters] are derived from the authorized mixes on every (re)start,
+// and with a layer assignment policy, the layer count and minimum nodes per
+// layer are the policy's.
+type authority struct {
+	sync.Mutex
+
+	cfgFile     string
+	cfg         *config.Config
+	svr         *server.Server
+	whitelist   *whitelist.Store
+	measurement *nodeMeasurement
+	tuning      *tuning.Policy
+	layers      *topology.Policy
+	rejections  *rejection.Log
+	tee         *rejection.Tee
+	management  *thwack.Server
+	logBackend  *log.Backend
+	log         *logging.Logger
+	expiry      time.Time
+	dropped     map[[eddsa.PublicKeySize]byte]string
+
+	reloadCh chan interface{}
+	haltCh   chan interface{}
+	haltOnce sync.Once
+}
+
+// IdentityKey returns the authority's identity public key.
+func (a *authority) IdentityKey() *eddsa.PublicKey {
+	a.Lock()
+	defer a.Unlock()
+	return a.svr.IdentityKey()
+}
+
+// droppedNodes returns the identity keys of the nodes that are dropped for
+// failing the measurement thresholds.
+func (a *authority) droppedNodes() map[[eddsa.PublicKeySize]byte]bool {
+	a.Lock()
+	defer a.Unlock()
+	ret := make(map[[eddsa.PublicKeySize]byte]bool)
+	for id := range a.dropped {
+		ret[id] = true
+	}
+	return ret
+}
+
+// RotateLog rotates the authority's logs.
+func (a *authority) RotateLog() {
+	a.Lock()
+	defer a.Unlock()
+	a.svr.RotateLog()
+	if a.tee != nil {
+		a.tee.Rotate()
+	}
+	if a.logBackend != nil {
+		a.logBackend.Rotate()
+	}
+}
+
+// Shutdown cleanly shuts down the authority.
+func (a *authority) Shutdown() {
+	a.haltOnce.Do(func() {
+		close(a.haltCh)
+		if a.management != nil {
+			a.management.Halt()
+		}
+		a.Lock()
+		a.svr.Shutdown()
+		a.Unlock()
+		if a.tee != nil {
+			a.tee.Close()
+		}
+		if a.whitelist != nil {
+			a.whitelist.Close()
+		}
+	})
+}
+
+// Wait waits till the authority is terminated for any reason.
+func (a *authority) Wait() {
+	for {
+		a.Lock()
+		svr, expiry := a.svr, a.expiry
+		a.Unlock()
+
+		doneCh := make(chan interface{})
+		go func() {
+			svr.Wait()
+			close(doneCh)
+		}()
+		var expiryCh, epochCh <-chan time.Time
+		var t, et *time.Timer
+		if !expiry.IsZero() {
+			t = time.NewTimer(time.Until(expiry))
+			expiryCh = t.C
+		}
+		if a.measurement != nil {
+			_, _, till := epochtime.Now()
+			et = time.NewTimer(till)
+			epochCh = et.C
+		}
+		force := true
+		select {
+		case <-doneCh:
+		case <-a.reloadCh:
+		case <-expiryCh:
+			a.log.Noticef("Whitelist entries expired.")
+		case <-epochCh:
+			force = false
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if et != nil {
+			et.Stop()
+		}
+		select {
+		case <-doneCh:
+			return
+		default:
+		}
+		if err := a.reconfigure(force); err != nil {
+			a.log.Errorf("Failed to restart with the updated whitelist: %v", err)
+			a.Shutdown()
+			return
+		}
+	}
+}
+
+func (a *authority) reload() {
+	select {
+	case a.reloadCh <- true:
+	default:
+	}
+}
+
+// restart restarts the server with the config file reloaded.  The new
+// server can't be started alongside the running one, as they share the
+// listeners and the persistence store, so the config is checked before the
+// running server is shut down, and the server is restarted with the previous
+// config if the new one still fails to start.  An invalid config is logged
+// and the running server is kept.
+func (a *authority) restart() error {
+	return a.reconfigure(true)
+}
+
+// reconfigure is restart, except that unless force is set, the server is
+// only restarted if the nodes dropped for failing the measurement thresholds
+// changed.
+func (a *authority) reconfigure(force bool) error {
+	a.Lock()
+	defer a.Unlock()
+	select {
+	case <-a.haltCh:
+		return nil
+	default:
+	}
+
+	cfg, err := config.LoadFile(a.cfgFile, false)
+	if err == nil {
+		err = applyLayerPolicy(cfg, a.layers)
+	}
+	if err == nil {
+		err = a.mergeWhitelist(cfg)
+	}
+	if err == nil {
+		err = checkConfig(cfg)
+	}
+	if err != nil {
+		a.log.Errorf("Not restarting the authority, the updated whitelist is invalid: %v", err)
+		return nil
+	}
+	dropped := a.dropExcluded(cfg)
+	if !force && sameNodes(dropped, a.dropped) {
+		return nil
+	}
+	if err = a.tune(cfg); err != nil {
+		a.log.Errorf("Not restarting the authority, the tuned parameters are invalid: %v", err)
+		return nil
+	}
+
+	a.log.Noticef("Restarting the authority with %v mixes and %v providers.", len(cfg.Mixes), len(cfg.Providers))
+	a.svr.Shutdown()
+	svr, err := server.New(a.serverConfig(cfg))
+	if err != nil {
+		a.log.Errorf("Failed to restart the authority, restarting with the previous config: %v", err)
+		if svr, err = server.New(a.serverConfig(a.cfg)); err != nil {
+			return err
+		}
+		cfg, dropped = a.cfg, a.dropped
+	}
+	a.svr, a.cfg, a.dropped = svr, cfg, dropped
+	a.logDropped()
+	return nil
+}
+
+// serverConfig returns cfg, with the server logging through the rejection
+// tee if it is enabled.
+func (a *authority) serverConfig(cfg *config.Config) *config.Config {
+	if a.tee == nil {
+		return cfg
+	}
+	svrCfg := *cfg
+	logging := *cfg.Logging
+	logging.File = a.tee.Path()
+	svrCfg.Logging = &logging
+	return &svrCfg
+}
+
+// tune applies the tuning policy to the [Parameters] of cfg, if it is set.
+func (a *authority) tune(cfg *config.Config) error {
+	if a.tuning == nil {
+		return nil
+	}
+	return tuneParameters(cfg, a.tuning, a.log)
+}
+
+// dropExcluded drops the nodes that fail the measurement thresholds from
+// cfg, if node measurement is enabled, and returns the dropped nodes.
+func (a *authority) dropExcluded(cfg *config.Config) map[[eddsa.PublicKeySize]byte]string {
+	if a.measurement == nil {
+		return nil
+	}
+	return a.measurement.dropExcluded(cfg, a.log)
+}
+
+func (a *authority) logDropped() {
+	for id, reason := range a.dropped {
+		k := new(eddsa.PublicKey)
+		k.FromBytes(id[:])
+		a.log.Noticef("Dropping node %v, it fails the measurement thresholds: %v", k, reason)
+	}
+}
+
+// sameNodes returns true iff a and b have the same identity keys.
+func sameNodes(a, b map[[eddsa.PublicKeySize]byte]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if _, ok := b[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkConfig checks that there are enough nodes in cfg for server.New to
+// start the server.
+func checkConfig(cfg *config.Config) error {
+	if len(cfg.Providers) < 1 {
+		return fmt.Errorf("no Providers whitelisted")
+	}
+	if n := cfg.Debug.Layers * cfg.Debug.MinNodesPerLayer; len(cfg.Mixes) < n {
+		return fmt.Errorf("insufficient nodes whitelisted, got %v, need %v", len(cfg.Mixes), n)
+	}
+	return nil
+}
+
+// mergeWhitelist adds the unexpired whitelist database entries that are
+// not in the config file to cfg, skipping the ones that the config rejects, and notes when the next entry expires.
+func (a *authority) mergeWhitelist(cfg *config.Config) error {
+	if a.whitelist == nil {
+		return nil
+	}
+	entries, err := a.whitelist.Entries()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	a.expiry = time.Time{}
+	listed := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, v := range append(append([]*config.Node{}, cfg.Mixes...), cfg.Providers...) {
+		listed[v.IdentityKey.ByteArray()] = true
+	}
+	if err = cfg.FixupAndValidate(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if listed[e.IdentityKey.ByteArray()] || e.Expired(now) {
+			continue
+		}
+		n := &config.Node{IdentityKey: e.IdentityKey}
+		if e.IsProvider {
+			n.Identifier = e.Identifier
+			cfg.Providers = append(cfg.Providers, n)
+		} else {
+			cfg.Mixes = append(cfg.Mixes, n)
+		}
+
+		// An entry that the config rejects, such as a provider with an
+		// Identifier that is already listed, is skipped, so that it can't
+		// block every restart till it is removed.
+		if err = cfg.FixupAndValidate(); err != nil {
+			a.log.Warningf("Skipping whitelist entry %v: %v", e.IdentityKey, err)
+			if e.IsProvider {
+				cfg.Providers = cfg.Providers[:len(cfg.Providers)-1]
+			} else {
+				cfg.Mixes = cfg.Mixes[:len(cfg.Mixes)-1]
+			}
+			continue
+		}
+		listed[e.IdentityKey.ByteArray()] = true
+		if !e.Expires.IsZero() && (a.expiry.IsZero() || e.Expires.Before(a.expiry)) {
+			a.expiry = e.Expires
+		}
+	}
+	return nil
+}
+
+// newAuthority starts the authority, with the whitelist database in the
+// DataDir if enableWhitelist is set, the nodes checked against the node
+// measurement m if it is set, the [Parameters] tuned by the policy p and the
+// layers configured by the layer assignment policy lp if they are set, and
+// the management socket in the DataDir, along with the record of the
+// descriptor rejections, if any of enableWhitelist, enableManagement, m, p
+// or lp is set.
+func newAuthority(cfgFile string, cfg *config.Config, enableWhitelist, enableManagement bool, m *nodeMeasurement, p *tuning.Policy, lp *topology.Policy) (*authority, error) {
+	a := &authority{
+		cfgFile:     cfgFile,
+		cfg:         cfg,
+		measurement: m,
+		tuning:      p,
+		layers:      lp,
+		reloadCh:    make(chan interface{}, 1),
+		haltCh:      make(chan interface{}),
+	}
+	enableManagement = (enableManagement || enableWhitelist || m != nil || p != nil || lp != nil) && !cfg.Debug.GenerateOnly
+	if enableManagement {
+		var err error
+		if a.logBackend, err = newLogBackend(cfg); err != nil {
+			return nil, err
+		}
+		a.log = a.logBackend.GetLogger("whitelist")
+		if err = applyLayerPolicy(cfg, lp); err != nil {
+			return nil, err
+		}
+		if enableWhitelist {
+			if a.whitelist, err = whitelist.New(filepath.Join(cfg.Authority.DataDir, whitelistFile)); err != nil {
+				return nil, err
+			}
+			if err = a.mergeWhitelist(cfg); err != nil {
+				a.whitelist.Close()
+				return nil, err
+			}
+		}
+		if err = checkConfig(cfg); err == nil {
+			a.dropped = a.dropExcluded(cfg)
+			a.logDropped()
+			if err = a.tune(cfg); err != nil {
+				if a.whitelist != nil {
+					a.whitelist.Close()
+				}
+				return nil, err
+			}
+		}
+	}
+
+	// Pass the server's log through the rejection tee, to record the
+	// descriptor rejections that it logs.
+	var err error
+	if enableManagement && !cfg.Logging.Disable {
+		a.rejections = new(rejection.Log)
+		if a.tee, err = rejection.NewTee(logFile(cfg), a.rejections, a.logBackend.GetLogger("rejection")); err != nil {
+			if a.whitelist != nil {
+				a.whitelist.Close()
+			}
+			return nil, err
+		}
+	}
+	if a.svr, err = server.New(a.serverConfig(cfg)); err != nil {
+		if a.tee != nil {
+			a.tee.Close()
+		}
+		if a.whitelist != nil {
+			a.whitelist.Close()
+		}
+		return nil, err
+	}
+
+	if enableManagement {
+		if a.management, err = management.New(filepath.Join(cfg.Authority.DataDir, management.SocketFile), "Authority", a.logBackend); err == nil {
+			if a.whitelist != nil {
+				whitelist.RegisterCommands(a.management, a.whitelist, a.reload)
+			}
+			if a.rejections != nil {
+				rejection.RegisterCommands(a.management, a.rejections)
+			}
+			if m != nil {
+				measure.RegisterCommands(a.management, measure.NewStatus(m.store, m.thresholds, a.droppedNodes))
+			}
+			err = a.management.Start()
+		}
+		if err != nil {
+			a.management = nil
+			a.Shutdown()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// importWhitelist adds the [[Mixes]] and [[Providers]] of the TOML file f
+// to the whitelist database, while the authority is not running.
+func importWhitelist(cfg *config.Config, f string) error {
+	s, err := whitelist.New(filepath.Join(cfg.Authority.DataDir, whitelistFile))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	n, err := s.Import(f, "import:"+filepath.Base(f))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Imported %v nodes from '%v'.\n", n, f)
+	return nil
+}
+
+// exportWhitelist writes the whitelist database to the TOML file f, or to
+// stdout if f is "-", while the authority is not running.
+func exportWhitelist(cfg *config.Config, f string) error {
+	s, err := whitelist.New(filepath.Join(cfg.Authority.DataDir, whitelistFile))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if f == "-" {
+		return s.Export(os.Stdout)
+	}
+	w, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = s.Export(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,190 @@
+// whitelist_test.go - Katzenpost non-voting authority whitelist tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/daemons/internal/measure"
+	"github.com/katzenpost/daemons/internal/topology"
+	"github.com/katzenpost/daemons/internal/tuning"
+	"github.com/katzenpost/daemons/internal/whitelist"
+	"github.com/stretchr/testify/assert"
+)
+
+func newIdentityKey(t *testing.T) *eddsa.PrivateKey {
+	k, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// approve submits and approves a join request signed with k.
+func approve(t *testing.T, s *whitelist.Store, r *whitelist.JoinRequest, k *eddsa.PrivateKey) {
+	signed, err := r.Sign(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = whitelist.ParseJoinRequest(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Submit(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Approve(k.PublicKey(), &whitelist.Entry{AddedBy: "test"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "authority_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Authority]\n  Addresses = [ %q ]\n  DataDir = %q\n", addr, dir)
+	fmt.Fprintf(&b, "[Logging]\n  File = %q\n  Level = \"ERROR\"\n", filepath.Join(dir, "authority.log"))
+	mixKeys := make([]*eddsa.PrivateKey, 7)
+	for i := range mixKeys {
+		mixKeys[i] = newIdentityKey(t)
+		fmt.Fprintf(&b, "[[Mixes]]\n  IdentityKey = %q\n", mixKeys[i].PublicKey())
+	}
+	fmt.Fprintf(&b, "[[Providers]]\n  Identifier = \"provider\"\n  IdentityKey = %q\n", newIdentityKey(t).PublicKey())
+	cfgFile := filepath.Join(dir, "authority.toml")
+	if err = ioutil.WriteFile(cfgFile, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFile(cfgFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAuthority(cfgFile, cfg, true, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(a.tee, "newAuthority: server log not passed through the rejection tee")
+
+	// A valid join restarts the server with the new node.
+	approve(t, a.whitelist, new(whitelist.JoinRequest), newIdentityKey(t))
+	svr := a.svr
+	assert.NoError(a.restart(), "restart")
+	assert.True(svr != a.svr, "restart: server not replaced")
+	assert.Len(a.cfg.Mixes, 8)
+
+	// A mix that fails the measurement thresholds is dropped.
+	m := &nodeMeasurement{thresholds: &measure.Thresholds{MinProbes: measureMinProbes, MinUptime: 0.5}}
+	if m.store, err = measure.New(filepath.Join(dir, measureFile)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.store.Close()
+	record := func(k *eddsa.PrivateKey, n int, probeErr error) {
+		desc := &pki.MixDescriptor{Name: "mix", IdentityKey: k.PublicKey()}
+		for i := 0; i < n; i++ {
+			if err = m.store.Record(desc, true, 0, probeErr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	record(mixKeys[0], measureMinProbes, errors.New("probe failed"))
+	a.measurement = m
+	assert.NoError(a.reconfigure(false), "reconfigure: measurement")
+	assert.Len(a.cfg.Mixes, 7)
+	for _, v := range a.cfg.Mixes {
+		assert.False(v.IdentityKey.Equal(mixKeys[0].PublicKey()), "reconfigure: excluded mix kept")
+	}
+	assert.Len(a.droppedNodes(), 1)
+
+	// The server is only restarted at the start of an epoch if the dropped
+	// nodes changed, and a node that recovers is authorized again.
+	svr = a.svr
+	assert.NoError(a.reconfigure(false), "reconfigure: unchanged")
+	assert.True(svr == a.svr, "reconfigure: server replaced with unchanged dropped nodes")
+	record(mixKeys[0], 7, nil)
+	assert.NoError(a.reconfigure(false), "reconfigure: recovered")
+	assert.True(svr != a.svr, "reconfigure: server not replaced")
+	assert.Len(a.cfg.Mixes, 8)
+	assert.Empty(a.droppedNodes())
+
+	// The nodes that fail the thresholds are dropped at startup.
+	record(mixKeys[1], measureMinProbes, errors.New("probe failed"))
+	a.Shutdown()
+	a.Wait()
+	if cfg, err = config.LoadFile(cfgFile, false); err != nil {
+		t.Fatal(err)
+	}
+	if a, err = newAuthority(cfgFile, cfg, true, false, m, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(a.cfg.Mixes, 7, "newAuthority: excluded mix kept")
+	assert.True(a.droppedNodes()[mixKeys[1].PublicKey().ByteArray()])
+
+	// The tuning policy overrides the Mu and LambdaM [Parameters].
+	a.tuning = &tuning.Policy{TargetLatency: 3000, MinAnonymitySet: 8}
+	assert.NoError(a.restart(), "restart: tuning")
+	assert.Equal(0.001, a.cfg.Parameters.Mu, "restart: Mu not tuned")
+	assert.Equal(uint64(5000), a.cfg.Parameters.MuMaxDelay)
+
+	// The layer policy sets the layer count, and a policy with pins is
+	// refused.
+	a.layers = &topology.Policy{Layers: 2, MinNodesPerLayer: 3, Stable: true}
+	assert.NoError(a.restart(), "restart: layer policy")
+	assert.Equal(2, a.cfg.Debug.Layers, "restart: layer policy not applied")
+	assert.Equal(3, a.cfg.Debug.MinNodesPerLayer)
+	assert.Error(checkLayerPolicy(&topology.Policy{Stable: true, Pinned: []*topology.Pin{{IdentityKey: mixKeys[2].PublicKey()}}}))
+
+	// A join that the config rejects, a provider with an Identifier that is
+	// already listed, is skipped without blocking the restart.
+	approve(t, a.whitelist, &whitelist.JoinRequest{IsProvider: true, Identifier: "provider"}, newIdentityKey(t))
+	approve(t, a.whitelist, new(whitelist.JoinRequest), newIdentityKey(t))
+	svr = a.svr
+	assert.NoError(a.restart(), "restart: invalid entry")
+	assert.True(svr != a.svr, "restart: invalid entry blocked the restart")
+	assert.Len(a.cfg.Providers, 1)
+	assert.Len(a.cfg.Mixes, 8)
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(err, "Dial: server halted with an invalid config")
+	if err == nil {
+		conn.Close()
+	}
+
+	a.Shutdown()
+	a.Wait()
+}
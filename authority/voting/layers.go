@@ -0,0 +1,51 @@
+// layers.go - Katzenpost voting-authority layer assignment policy.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/daemons/internal/topology"
+)
+
+// errLayerPolicyUnsupported is the error returned for a layer assignment
+// policy that the server's topology generation can't follow.
+var errLayerPolicyUnsupported = errors.New("the authority only supports the Layers, MinNodesPerLayer and Stable layer policy options")
+
+// checkLayerPolicy checks that the server can follow the layer assignment
+// policy p.  The server assigns the layers itself, preserving the layers of
+// the nodes in the previous document, so only the number of layers and the
+// minimum number of nodes per layer can be configured, and Stable must be
+// set.  Pins and families are only simulated by `pki topology`.
+func checkLayerPolicy(p *topology.Policy) error {
+	if !p.Stable || len(p.Pinned) != 0 || len(p.Families) != 0 || p.SubnetPrefixIPv4 != 0 || p.SubnetPrefixIPv6 != 0 {
+		return errLayerPolicyUnsupported
+	}
+	return nil
+}
+
+// applyLayerPolicy sets the layer count and the minimum number of nodes per
+// layer of cfg from the layer assignment policy p, if it is set.
+func applyLayerPolicy(cfg *config.Config, p *topology.Policy) error {
+	if p == nil {
+		return nil
+	}
+	cfg.Debug.Layers = p.Layers
+	cfg.Debug.MinNodesPerLayer = p.MinNodesPerLayer
+	return cfg.FixupAndValidate()
+}
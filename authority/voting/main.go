@@ -21,15 +21,50 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/katzenpost/authority/voting/server"
 	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/internal/measure"
+	"github.com/katzenpost/daemons/internal/topology"
+	"github.com/katzenpost/daemons/internal/tuning"
 )
 
+// measureMinProbes is the number of probes of a node required before it
+// can be dropped from the whitelist.
+const measureMinProbes = 10
+
 func main() {
 	cfgFile := flag.String("f", "katzenpost-authority.toml", "Path to the authority config file.")
 	genOnly := flag.Bool("g", false, "Generate the keys and exit immediately.")
+	archiveEpochs := flag.Uint64("archive-epochs", 0, "Number of epochs of published documents, with the descriptors that they carry, to archive, 0 disables the archive.  Uploaded descriptors that are not published are not archived.")
+	archiveAddr := flag.String("archive-address", "", "Address to serve archived documents on.")
+	exportDir := flag.String("archive-export", "", "Export the document archive to this directory and exit.")
+	translogAddr := flag.String("translog-address", "", "Address to serve the document transparency log on over HTTP, empty disables the log.")
+	measureInterval := flag.Duration("measure-interval", 0, "Interval between node probes, 0 disables node measurement.")
+	measureAddr := flag.String("measure-address", "", "Address to serve node measurements on over HTTP.")
+	minUptime := flag.Float64("measure-min-uptime", 0.5, "Uptime below which a node is dropped from the authorized nodes, checked at startup and every epoch.")
+	maxLatency := flag.Duration("measure-max-latency", 0, "Latency above which a node is dropped from the authorized nodes, checked at startup and every epoch, 0 for no limit.")
+	tuningPolicy := flag.String("tuning-policy", "", "Path to a tuning policy file, deriving the Mu and LambdaM [Parameters] from the authorized mixes on every (re)start.")
+	layerPolicy := flag.String("layer-policy", "", "Path to a layer assignment policy file, setting the layer count and minimum nodes per layer; pins and families are not supported.")
+	probeOnly := flag.Bool("probe-only", false, "Only run the node prober, without the authority.")
+	enableWhitelist := flag.Bool("whitelist-db", false, "Authorize the nodes in the whitelist database as well, and enable the management socket.")
+	importFile := flag.String("whitelist-import", "", "Import the [[Mixes]] and [[Providers]] of this TOML file into the whitelist database and exit.")
+	exportFile := flag.String("whitelist-export", "", "Export the whitelist database to this TOML file (\"-\" for stdout) and exit.")
+	syncAddr := flag.String("whitelist-sync-address", "", "Address to serve the whitelist entries approved at this authority on over HTTP, for the peer authorities.")
+	syncPeers := flag.String("whitelist-sync-peers", "", "Comma separated URLs of the peer authorities' whitelists, whose entries are added to the whitelist database.")
+	syncInterval := flag.Duration("whitelist-sync-interval", 5*time.Minute, "Interval between whitelist synchronizations with the peer authorities.")
+	enableManagement := flag.Bool("management", false, "Enable the management socket, which -whitelist-db also enables.")
+	proposeFile := flag.String("peerset-propose", "", "Write a peer set proposal for the [[Authorities]] of this TOML file, signed by this authority, to stdout and exit.")
+	proposeEpoch := flag.Uint64("peerset-epoch", 0, "Epoch that the -peerset-propose proposal takes effect, 0 for three epochs from now.")
+	endorseFile := flag.String("peerset-endorse", "", "Write this peer set proposal endorsed by this authority to stdout and exit.")
+	ctlCmd := flag.String("ctl", "", "Send a command to the running authority's management socket and exit.")
 	flag.Parse()
 
 	// Set the umask to something "paranoid".
@@ -40,6 +75,67 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
 		os.Exit(-1)
 	}
+	if *ctlCmd != "" {
+		if err = management.Run(filepath.Join(cfg.Authority.DataDir, management.SocketFile), *ctlCmd, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *proposeFile != "" {
+		if err = proposePeerSet(cfg, *proposeFile, *proposeEpoch); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to propose peer set: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *endorseFile != "" {
+		if err = endorsePeerSet(cfg, *endorseFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to endorse peer set: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *importFile != "" {
+		if err = importWhitelist(cfg, *importFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to import whitelist: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *exportFile != "" {
+		if err = exportWhitelist(cfg, *exportFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export whitelist: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *exportDir != "" {
+		if err = exportArchive(cfg, *exportDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export archive: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+
+	var policy *tuning.Policy
+	if *tuningPolicy != "" {
+		if policy, err = tuning.LoadPolicy(*tuningPolicy); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load tuning policy '%v': %v\n", *tuningPolicy, err)
+			os.Exit(-1)
+		}
+	}
+
+	var layers *topology.Policy
+	if *layerPolicy != "" {
+		if layers, err = topology.LoadPolicy(*layerPolicy); err == nil {
+			err = checkLayerPolicy(layers)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load layer policy '%v': %v\n", *layerPolicy, err)
+			os.Exit(-1)
+		}
+	}
 
 	// Setup the signal handling.
 	ch := make(chan os.Signal)
@@ -48,9 +144,54 @@ func main() {
 	rotateCh := make(chan os.Signal)
 	signal.Notify(rotateCh, syscall.SIGHUP)
 
+	thresholds := &measure.Thresholds{
+		MinProbes:  measureMinProbes,
+		MinUptime:  *minUptime,
+		MaxLatency: *maxLatency,
+	}
+	if *probeOnly {
+		if *measureInterval == 0 {
+			fmt.Fprintf(os.Stderr, "-probe-only requires -measure-interval\n")
+			os.Exit(-1)
+		}
+		m, err := newNodeMeasurement(cfg, thresholds)
+		if err == nil {
+			if err = m.start(cfg, *measureInterval, *measureAddr, nil); err != nil {
+				m.halt()
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start node measurement: %v\n", err)
+			os.Exit(-1)
+		}
+		defer m.halt()
+		for {
+			select {
+			case <-ch:
+				return
+			case <-rotateCh:
+				m.rotateLog()
+			}
+		}
+	}
+
+	// Open the node measurement, if enabled, so that the nodes that fail
+	// the thresholds are dropped at startup.
+	var measurement *nodeMeasurement
+	if *measureInterval > 0 && !*genOnly {
+		if measurement, err = newNodeMeasurement(cfg, thresholds); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open node measurement: %v\n", err)
+			os.Exit(-1)
+		}
+		defer measurement.halt()
+	}
+
 	// Start up the authority.
-	svr, err := server.New(cfg)
+	svr, err := newAuthority(*cfgFile, cfg, *enableWhitelist, *enableManagement, measurement, policy, layers)
 	if err != nil {
+		if measurement != nil {
+			measurement.halt()
+		}
 		if err == server.ErrGenerateOnly {
 			os.Exit(0)
 		}
@@ -59,6 +200,53 @@ func main() {
 	}
 	defer svr.Shutdown()
 
+	// Start the document archive, if enabled.
+	var archive *documentArchive
+	if *archiveEpochs > 0 {
+		if archive, err = newDocumentArchive(cfg, svr, *archiveEpochs, *archiveAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start document archive: %v\n", err)
+			svr.Shutdown()
+			os.Exit(-1)
+		}
+		defer archive.halt()
+	}
+
+	// Start the transparency log, if enabled.
+	var tlog *transparencyLog
+	if *translogAddr != "" {
+		if tlog, err = newTransparencyLog(cfg, svr, *translogAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start transparency log: %v\n", err)
+			svr.Shutdown()
+			os.Exit(-1)
+		}
+		defer tlog.halt()
+	}
+
+	// Start the whitelist synchronization, if enabled.
+	var wlSync *whitelistSync
+	if *syncAddr != "" || *syncPeers != "" {
+		var peers []string
+		if *syncPeers != "" {
+			peers = strings.Split(*syncPeers, ",")
+		}
+		if wlSync, err = newWhitelistSync(cfg, svr, *syncAddr, peers, *syncInterval); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start whitelist synchronization: %v\n", err)
+			svr.Shutdown()
+			os.Exit(-1)
+		}
+		defer wlSync.halt()
+	}
+
+	// Start probing the nodes, if enabled.
+	if measurement != nil {
+		if err = measurement.start(cfg, *measureInterval, *measureAddr, svr.droppedNodes); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start node measurement: %v\n", err)
+			svr.Shutdown()
+			measurement.halt()
+			os.Exit(-1)
+		}
+	}
+
 	// Halt the authority gracefully on SIGINT/SIGTERM.
 	go func() {
 		<-ch
@@ -69,8 +257,46 @@ func main() {
 	go func() {
 		<-rotateCh
 		svr.RotateLog()
+		if archive != nil {
+			archive.rotateLog()
+		}
+		if tlog != nil {
+			tlog.rotateLog()
+		}
+		if measurement != nil {
+			measurement.rotateLog()
+		}
+		if wlSync != nil {
+			wlSync.rotateLog()
+		}
 	}()
 
 	// Wait for the authority to explode or be terminated.
 	svr.Wait()
 }
+
+// newLogBackend returns a log backend for the daemon's own subsystems,
+// logging to the same destination as the authority.
+func newLogBackend(cfg *config.Config) (*log.Backend, error) {
+	return log.New(logFile(cfg), cfg.Logging.Level, cfg.Logging.Disable)
+}
+
+// logFile returns the path of the log file, as the server resolves it, or
+// "" for stdout.
+func logFile(cfg *config.Config) string {
+	p := cfg.Logging.File
+	if !cfg.Logging.Disable && p != "" && !filepath.IsAbs(p) {
+		p = filepath.Join(cfg.Authority.DataDir, p)
+	}
+	return p
+}
+
+// loadIdentityKey loads the authority's identity key, without generating
+// it if it is missing.
+func loadIdentityKey(cfg *config.Config) (*eddsa.PrivateKey, error) {
+	if cfg.Debug.IdentityKey != nil {
+		k := new(eddsa.PrivateKey)
+		return k, k.FromBytes(cfg.Debug.IdentityKey.Bytes())
+	}
+	return eddsa.Load(filepath.Join(cfg.Authority.DataDir, "identity.private.pem"), "", nil)
+}
@@ -0,0 +1,128 @@
+// measure.go - Katzenpost voting-authority node measurement.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/katzenpost/authority/voting/client"
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/internal/measure"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const measureFile = "measurements.db"
+
+type nodeMeasurement struct {
+	logBackend *log.Backend
+	store      *measure.Store
+	prober     *measure.Prober
+	status     *measure.Status
+	thresholds *measure.Thresholds
+}
+
+func (m *nodeMeasurement) halt() {
+	if m.status != nil {
+		m.status.Halt()
+	}
+	if m.prober != nil {
+		m.prober.Halt()
+	}
+	m.store.Close()
+}
+
+func (m *nodeMeasurement) rotateLog() {
+	m.logBackend.Rotate()
+}
+
+// dropExcluded removes the nodes whose measurements do not meet the
+// thresholds from the [[Mixes]] and [[Providers]] of cfg, unless that leaves
+// too few nodes for a document, and returns the reasons for dropping the
+// nodes keyed by identity key.  A failure to query the measurements is
+// logged, and no nodes are dropped.
+func (m *nodeMeasurement) dropExcluded(cfg *config.Config, log *logging.Logger) map[[eddsa.PublicKeySize]byte]string {
+	excluded, err := m.store.Excluded(m.thresholds)
+	if err != nil {
+		log.Errorf("Failed to query the node measurements, not dropping any nodes: %v", err)
+		return nil
+	}
+	dropped := make(map[[eddsa.PublicKeySize]byte]string)
+	drop := func(nodes []*config.Node) []*config.Node {
+		var kept []*config.Node
+		for _, v := range nodes {
+			id := v.IdentityKey.ByteArray()
+			if reason, ok := excluded[id]; ok {
+				dropped[id] = reason
+				continue
+			}
+			kept = append(kept, v)
+		}
+		return kept
+	}
+	mixes, providers := drop(cfg.Mixes), drop(cfg.Providers)
+	if len(dropped) == 0 {
+		return nil
+	}
+	trial := *cfg
+	trial.Mixes, trial.Providers = mixes, providers
+	if err = checkConfig(&trial); err != nil {
+		log.Warningf("Not dropping the %v nodes that fail the measurement thresholds: %v", len(dropped), err)
+		return nil
+	}
+	cfg.Mixes, cfg.Providers = mixes, providers
+	return dropped
+}
+
+// newNodeMeasurement opens the measurement store in the DataDir, with the
+// measurements evaluated against t.
+func newNodeMeasurement(cfg *config.Config, t *measure.Thresholds) (*nodeMeasurement, error) {
+	var err error
+	m := &nodeMeasurement{thresholds: t}
+	if m.logBackend, err = newLogBackend(cfg); err != nil {
+		return nil, err
+	}
+	if m.store, err = measure.New(filepath.Join(cfg.Authority.DataDir, measureFile)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// start probes the nodes in the consensus documents of the authority's
+// peers every interval, and serves the measurements on addr if it is set,
+// with the nodes reported by dropped as dropped.
+func (m *nodeMeasurement) start(cfg *config.Config, interval time.Duration, addr string, dropped measure.DroppedFunc) error {
+	c, err := client.New(&client.Config{
+		LogBackend:  m.logBackend,
+		Authorities: cfg.Authorities,
+	})
+	if err != nil {
+		return err
+	}
+	m.prober = measure.NewProber(m.store, c, interval, m.logBackend.GetLogger("measure"))
+
+	if addr != "" {
+		m.status = measure.NewStatus(m.store, m.thresholds, dropped)
+		if err = m.status.Listen(addr, m.logBackend.GetLogger("measure/status")); err != nil {
+			m.status = nil
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// peerset.go - Katzenpost voting authority peer set changes.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/internal/peerset"
+)
+
+const (
+	peerSetFile = "peerset.proposal"
+
+	cmdPeerSetSubmit = "PEERSET_SUBMIT"
+	cmdPeerSetShow   = "PEERSET_SHOW"
+)
+
+var errNotInPeerSet = errors.New("this authority is not in the accepted peer set, halting")
+
+// loadPeerSet loads the accepted peer set proposal from the DataDir, if
+// any.  A proposal that fails to parse is logged and ignored, so that it
+// can't keep the authority from starting with the configured peers.
+func (a *authority) loadPeerSet(cfg *config.Config) error {
+	b, err := ioutil.ReadFile(filepath.Join(cfg.Authority.DataDir, peerSetFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// The proposal was verified against the peer set of the time when it
+	// was submitted.
+	if a.peerSet, _, err = peerset.Parse(string(b)); err != nil {
+		a.log.Errorf("Ignoring the accepted peer set proposal, it is invalid: %v", err)
+		a.peerSet = nil
+	}
+	return nil
+}
+
+// applyPeerSet replaces the peers in cfg with the accepted peer set once it
+// has taken effect, or schedules a restart for when it does.  A peer that
+// fails to validate is logged and skipped, so that it can't block every
+// restart.
+func (a *authority) applyPeerSet(cfg *config.Config) error {
+	if a.peerSet == nil {
+		return nil
+	}
+	if t := a.peerSet.ActivationTime(); time.Now().Before(t) {
+		a.scheduleReload(t)
+		return nil
+	}
+	identityKey, err := loadIdentityKey(cfg)
+	if err != nil {
+		return err
+	}
+	// Reset scrubs the public key as well, so take a copy.
+	self := new(eddsa.PublicKey)
+	err = self.FromBytes(identityKey.PublicKey().Bytes())
+	identityKey.Reset()
+	if err != nil {
+		return err
+	}
+	if !a.peerSet.Contains(self) {
+		return errNotInPeerSet
+	}
+	cfg.Authorities = nil
+	for _, v := range a.peerSet.Peers(self) {
+		if err = v.Validate(); err == nil && v.LinkPublicKey == nil {
+			err = errors.New("missing LinkPublicKey")
+		}
+		if err != nil {
+			a.log.Errorf("Skipping peer %v of the accepted peer set: %v", v.IdentityPublicKey, err)
+			continue
+		}
+		cfg.Authorities = append(cfg.Authorities, v)
+	}
+	return nil
+}
+
+// registerPeerSetCommands registers the peer set commands with the
+// management server.
+//
+//	PEERSET_SUBMIT <proposal>   Accept a proposal endorsed by a threshold of
+//	                            the current authorities.
+//	PEERSET_SHOW                Show the accepted proposal.
+func (a *authority) registerPeerSetCommands() {
+	a.management.RegisterCommand(cmdPeerSetSubmit, func(c *thwack.Conn, l string) error {
+		sp := strings.Fields(l)
+		if len(sp) != 2 {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		p, err := a.submitPeerSet(sp[1])
+		if err != nil {
+			return management.WriteLines(c, []string{err.Error()}, thwack.StatusTransactionFailed)
+		}
+		c.Log().Noticef("Accepted the peer set proposal for epoch %v.", p.Epoch)
+		return c.WriteReply(thwack.StatusOk)
+	})
+
+	a.management.RegisterCommand(cmdPeerSetShow, func(c *thwack.Conn, l string) error {
+		a.Lock()
+		p := a.peerSet
+		a.Unlock()
+		if p == nil {
+			return management.WriteLines(c, []string{"No accepted proposal."}, thwack.StatusOk)
+		}
+		return management.WriteLines(c, formatPeerSet(p), thwack.StatusOk)
+	})
+}
+
+func (a *authority) submitPeerSet(s string) (*peerset.Proposal, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	current := []*eddsa.PublicKey{a.svr.IdentityKey()}
+	for _, v := range a.cfg.Authorities {
+		current = append(current, v.IdentityPublicKey)
+	}
+	p, err := peerset.Verify(s, current)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(p.ActivationTime()) {
+		return nil, fmt.Errorf("peerset: the proposal for epoch %v would have to be in effect since %v", p.Epoch, p.ActivationTime())
+	}
+	f := filepath.Join(a.cfg.Authority.DataDir, peerSetFile)
+	if err = ioutil.WriteFile(f, []byte(strings.TrimSpace(s)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	a.peerSet = p
+	a.scheduleReload(p.ActivationTime())
+	select {
+	case a.rescheduleCh <- true:
+	default:
+	}
+	return p, nil
+}
+
+func formatPeerSet(p *peerset.Proposal) []string {
+	lines := []string{
+		fmt.Sprintf("Epoch %v, in effect from %v, document threshold %v of %v:", p.Epoch,
+			p.ActivationTime().UTC().Format(time.RFC3339), p.Threshold(), len(p.Authorities)),
+	}
+	for _, v := range p.Authorities {
+		lines = append(lines, fmt.Sprintf("  %v link=%v addresses=%v", v.IdentityPublicKey, v.LinkPublicKey, strings.Join(v.Addresses, ",")))
+	}
+	return lines
+}
+
+// proposePeerSet writes a proposal for the [[Authorities]] of the TOML file
+// f to take effect at epoch, signed by this authority, to stdout.  The
+// authority must be listed in f, as the proposal is the complete set.
+func proposePeerSet(cfg *config.Config, f string, epoch uint64) error {
+	peers, err := peerset.LoadPeers(f)
+	if err != nil {
+		return err
+	}
+	if epoch == 0 {
+		// Leave the authorities a full epoch to collect the endorsements.
+		now, _, _ := epochtime.Now()
+		epoch = now + 3
+	}
+	identityKey, err := loadIdentityKey(cfg)
+	if err != nil {
+		return err
+	}
+	defer identityKey.Reset()
+
+	p := &peerset.Proposal{Epoch: epoch, Authorities: peers}
+	if !p.Contains(identityKey.PublicKey()) {
+		return fmt.Errorf("this authority (%v) is not in '%v'", identityKey.PublicKey(), f)
+	}
+	s, err := p.Sign(identityKey)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, s)
+	return nil
+}
+
+// endorsePeerSet shows the proposal in the file f, and writes it endorsed
+// by this authority to stdout.
+func endorsePeerSet(cfg *config.Config, f string) error {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	p, signers, err := peerset.Parse(string(b))
+	if err != nil {
+		return err
+	}
+	identityKey, err := loadIdentityKey(cfg)
+	if err != nil {
+		return err
+	}
+	defer identityKey.Reset()
+
+	for _, v := range formatPeerSet(p) {
+		fmt.Fprintln(os.Stderr, v)
+	}
+	fmt.Fprintf(os.Stderr, "Endorsed by %v authorities:\n", len(signers))
+	for _, v := range signers {
+		fmt.Fprintf(os.Stderr, "  %v\n", v)
+	}
+
+	s, err := peerset.Endorse(identityKey, string(b))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, s)
+	return nil
+}
@@ -0,0 +1,114 @@
+// peerset_test.go - Katzenpost voting authority peer set tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/daemons/internal/peerset"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerSetRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "authority_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peer := newIdentityKey(t)
+	cfgFile := writeConfig(t, dir, peer)
+	cfg, err := config.LoadFile(cfgFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stored proposal that fails to parse does not keep the authority
+	// from starting with the configured peers.
+	if err = ioutil.WriteFile(filepath.Join(dir, peerSetFile), []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthority(cfgFile, cfg, false, true, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		a.Shutdown()
+		a.Wait()
+	}()
+	assert.Nil(a.peerSet)
+	assert.Len(a.cfg.Authorities, 1)
+
+	// A proposal endorsed by the current authorities is accepted.
+	identityKey, err := loadIdentityKey(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkKey, err := loadLinkKey(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPeer := newIdentityKey(t)
+	newPeerLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now, _, _ := epochtime.Now()
+	p := &peerset.Proposal{
+		Epoch: now + 3,
+		Authorities: []*config.AuthorityPeer{
+			{IdentityPublicKey: identityKey.PublicKey(), LinkPublicKey: linkKey.PublicKey(), Addresses: []string{"127.0.0.1:1"}},
+			{IdentityPublicKey: newPeer.PublicKey(), LinkPublicKey: newPeerLinkKey.PublicKey(), Addresses: []string{"127.0.0.1:2"}},
+		},
+	}
+	s, err := p.Sign(identityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.submitPeerSet(s)
+	assert.Error(err, "submitPeerSet: not endorsed by the peer")
+	if s, err = peerset.Endorse(peer, s); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.submitPeerSet(s)
+	assert.NoError(err, "submitPeerSet")
+
+	// The peers are replaced once the proposal takes effect.
+	assert.NoError(a.restart(), "restart: before the activation")
+	assert.True(a.cfg.Authorities[0].IdentityPublicKey.Equal(peer.PublicKey()))
+	a.peerSet.Epoch = now
+	assert.NoError(a.restart(), "restart: after the activation")
+	if assert.Len(a.cfg.Authorities, 1) {
+		assert.True(a.cfg.Authorities[0].IdentityPublicKey.Equal(newPeer.PublicKey()), "restart: peers not replaced")
+	}
+
+	// A peer that fails to validate is skipped, without blocking the
+	// restart.
+	a.peerSet.Authorities[1].Addresses = []string{"not an address"}
+	svr := a.svr
+	assert.NoError(a.restart(), "restart: invalid peer")
+	assert.True(svr != a.svr, "restart: invalid peer blocked the restart")
+	assert.Empty(a.cfg.Authorities, "restart: invalid peer kept")
+}
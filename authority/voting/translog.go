@@ -0,0 +1,83 @@
+// translog.go - Katzenpost voting-authority transparency log.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/internal/archive"
+	"github.com/katzenpost/daemons/internal/translog"
+)
+
+const translogFile = "translog.db"
+
+type transparencyLog struct {
+	logBackend *log.Backend
+	translog   *translog.Log
+	archiver   *archive.Archiver
+	server     *translog.Server
+}
+
+func (t *transparencyLog) halt() {
+	if t.server != nil {
+		t.server.Halt()
+	}
+	t.archiver.Halt()
+	t.translog.Close()
+}
+
+func (t *transparencyLog) rotateLog() {
+	t.logBackend.Rotate()
+}
+
+// newTransparencyLog appends the consensus documents published by svr to
+// the transparency log, and serves the log, with tree heads signed by the
+// authority, over HTTP on addr.
+func newTransparencyLog(cfg *config.Config, svr *authority, addr string) (*transparencyLog, error) {
+	var err error
+	t := new(transparencyLog)
+	if t.logBackend, err = newLogBackend(cfg); err != nil {
+		return nil, err
+	}
+	identityKey, err := loadIdentityKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if t.translog, err = translog.New(filepath.Join(cfg.Authority.DataDir, translogFile)); err != nil {
+		return nil, err
+	}
+
+	linkKey, err := loadLinkKey(cfg)
+	if err != nil {
+		t.translog.Close()
+		return nil, err
+	}
+	c, err := newSelfClient(cfg, svr, linkKey, t.logBackend)
+	if err != nil {
+		t.translog.Close()
+		return nil, err
+	}
+	t.archiver = archive.NewArchiver(t.translog, c, t.logBackend.GetLogger("translog"))
+
+	if t.server, err = translog.NewServer(t.translog, identityKey, addr, t.logBackend.GetLogger("translog/server")); err != nil {
+		t.halt()
+		return nil, err
+	}
+	return t, nil
+}
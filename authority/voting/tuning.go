@@ -0,0 +1,56 @@
+// tuning.go - Katzenpost voting-authority parameter tuning.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/daemons/internal/tuning"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// tuneParameters overrides the Mu and LambdaM [Parameters] of cfg with the
+// ones derived by the tuning policy p from the authorized mixes, and logs
+// how they were derived.  The published document only changes when the
+// server is (re)started, as that is when the server reads its parameters.  The
+// parameters are voted on like any other, so every authority must use the
+// same policy and authorize the same mixes for the votes to agree.
+func tuneParameters(cfg *config.Config, p *tuning.Policy, log *logging.Logger) error {
+	params := cfg.Parameters
+	r, err := p.ComputeForNodes(cfg.Debug.Layers, len(cfg.Mixes), &tuning.Parameters{
+		SendRatePerMinute: params.SendRatePerMinute,
+		LambdaP:           params.LambdaP,
+		LambdaPMaxDelay:   params.LambdaPMaxDelay,
+		LambdaL:           params.LambdaL,
+		LambdaLMaxDelay:   params.LambdaLMaxDelay,
+		LambdaD:           params.LambdaD,
+		LambdaDMaxDelay:   params.LambdaDMaxDelay,
+	})
+	if err != nil {
+		return err
+	}
+	params.Mu = r.Parameters.Mu
+	params.MuMaxDelay = r.Parameters.MuMaxDelay
+	params.LambdaM = r.Parameters.LambdaM
+	params.LambdaMMaxDelay = r.Parameters.LambdaMMaxDelay
+	if err = cfg.FixupAndValidate(); err != nil {
+		return err
+	}
+	for _, v := range r.Reasons {
+		log.Noticef("Tuning: %v", v)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// whitelist_test.go - Katzenpost voting authority whitelist tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/internal/whitelist"
+	"github.com/stretchr/testify/assert"
+)
+
+func newIdentityKey(t *testing.T) *eddsa.PrivateKey {
+	k, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// approve submits and approves a join request signed with k.
+func approve(t *testing.T, s *whitelist.Store, r *whitelist.JoinRequest, k *eddsa.PrivateKey) {
+	signed, err := r.Sign(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = whitelist.ParseJoinRequest(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Submit(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Approve(k.PublicKey(), &whitelist.Entry{AddedBy: "test"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeConfig writes an authority config file to dir, with the peer
+// authority peer, 7 mixes and a provider, and returns its path.
+func writeConfig(t *testing.T, dir string, peer *eddsa.PrivateKey) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	peerLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Authority]\n  Addresses = [ %q ]\n  DataDir = %q\n", addr, dir)
+	fmt.Fprintf(&b, "[Logging]\n  File = %q\n  Level = \"ERROR\"\n", filepath.Join(dir, "authority.log"))
+	fmt.Fprintf(&b, "[[Authorities]]\n  IdentityPublicKey = %q\n  LinkPublicKey = %q\n  Addresses = [ \"127.0.0.1:1\" ]\n", peer.PublicKey(), peerLinkKey.PublicKey())
+	for i := 0; i < 7; i++ {
+		fmt.Fprintf(&b, "[[Mixes]]\n  IdentityKey = %q\n", newIdentityKey(t).PublicKey())
+	}
+	fmt.Fprintf(&b, "[[Providers]]\n  Identifier = \"provider\"\n  IdentityKey = %q\n", newIdentityKey(t).PublicKey())
+	cfgFile := filepath.Join(dir, "authority.toml")
+	if err = ioutil.WriteFile(cfgFile, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfgFile
+}
+
+func TestRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "authority_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peer := newIdentityKey(t)
+	cfgFile := writeConfig(t, dir, peer)
+	cfg, err := config.LoadFile(cfgFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAuthority(cfgFile, cfg, true, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		a.Shutdown()
+		a.Wait()
+	}()
+
+	// A valid join restarts the server with the new node, and an entry that
+	// the config rejects is skipped without blocking the restart.
+	approve(t, a.whitelist, new(whitelist.JoinRequest), newIdentityKey(t))
+	approve(t, a.whitelist, &whitelist.JoinRequest{IsProvider: true, Identifier: "provider"}, newIdentityKey(t))
+	svr := a.svr
+	assert.NoError(a.restart(), "restart")
+	assert.True(svr != a.svr, "restart: server not replaced")
+	assert.Len(a.cfg.Mixes, 8)
+	assert.Len(a.cfg.Providers, 1)
+
+	// The entries approved at a peer are synchronized, and restart the
+	// server.
+	peerDir := filepath.Join(dir, "peer")
+	if err = os.Mkdir(peerDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	peerWhitelist, err := whitelist.New(filepath.Join(peerDir, whitelistFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerWhitelist.Close()
+	approve(t, peerWhitelist, new(whitelist.JoinRequest), newIdentityKey(t))
+	peerSync := &whitelistSync{identityKey: peer}
+	peerSync.svr = &authority{whitelist: peerWhitelist}
+	ts := httptest.NewServer(peerSync)
+	defer ts.Close()
+
+	logBackend, err := log.New("", "ERROR", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &whitelistSync{svr: a, client: ts.Client(), log: logBackend.GetLogger("test")}
+	assert.NoError(s.sync(ts.URL), "sync")
+	select {
+	case <-a.reloadCh:
+	default:
+		t.Fatal("sync: no restart")
+	}
+	assert.NoError(a.restart(), "restart: synchronized")
+	assert.Len(a.cfg.Mixes, 9)
+
+	// Only the peer authorities' whitelists are synchronized.
+	peerSync.identityKey = newIdentityKey(t)
+	assert.Equal(whitelist.ErrUnknownPeer, s.sync(ts.URL), "sync: unknown peer")
+}
@@ -0,0 +1,162 @@
+// whitelistsync.go - Katzenpost voting authority whitelist synchronization.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/worker"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// whitelistSyncPath is the HTTP path that the whitelist is served on.
+	whitelistSyncPath = "/whitelist"
+
+	whitelistSyncTimeout = 30 * time.Second
+	maxWhitelistSize     = 4 * 1024 * 1024
+)
+
+// whitelistSync propagates the whitelist entries approved at this
+// authority to the peer authorities, and the ones approved at the peers to
+// this authority.  Each authority serves the entries approved at it, signed
+// with its identity key, and periodically fetches the peers' entries,
+// keeping the ones signed by a current peer.
+type whitelistSync struct {
+	worker.Worker
+
+	logBackend  *log.Backend
+	log         *logging.Logger
+	svr         *authority
+	identityKey *eddsa.PrivateKey
+	l           net.Listener
+	peers       []string
+	client      *http.Client
+}
+
+func (s *whitelistSync) halt() {
+	if s.l != nil {
+		s.l.Close()
+	}
+	s.Halt()
+}
+
+func (s *whitelistSync) rotateLog() {
+	s.logBackend.Rotate()
+}
+
+func (s *whitelistSync) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	signed, err := s.svr.whitelist.SignedLocal(s.identityKey)
+	if err != nil {
+		s.log.Errorf("Failed to sign the whitelist: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(signed)
+}
+
+func (s *whitelistSync) worker(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for _, v := range s.peers {
+			if err := s.sync(v); err != nil {
+				s.log.Warningf("Failed to synchronize the whitelist with %v: %v", v, err)
+			}
+		}
+		select {
+		case <-s.HaltCh():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sync fetches the whitelist served at url, and restarts the authority if
+// any entry changed.
+func (s *whitelistSync) sync(url string) error {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %v", resp.Status)
+	}
+	signed, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxWhitelistSize})
+	if err != nil {
+		return err
+	}
+	n, err := s.svr.whitelist.Sync(signed, s.svr.peerKeys())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.log.Noticef("Synchronized %v whitelist entries with %v.", n, url)
+		s.svr.reload()
+	}
+	return nil
+}
+
+// newWhitelistSync serves the whitelist entries approved at the authority
+// svr on addr, if it is set, and fetches the entries approved at the peer
+// authorities from the peers URLs every interval.
+func newWhitelistSync(cfg *config.Config, svr *authority, addr string, peers []string, interval time.Duration) (*whitelistSync, error) {
+	if svr.whitelist == nil {
+		return nil, errors.New("whitelist synchronization requires -whitelist-db")
+	}
+	var err error
+	s := &whitelistSync{
+		svr:    svr,
+		peers:  peers,
+		client: &http.Client{Timeout: whitelistSyncTimeout},
+	}
+	if s.logBackend, err = newLogBackend(cfg); err != nil {
+		return nil, err
+	}
+	s.log = s.logBackend.GetLogger("whitelist/sync")
+	if s.identityKey, err = loadIdentityKey(cfg); err != nil {
+		return nil, err
+	}
+	if addr != "" {
+		if s.l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+		mux := http.NewServeMux()
+		mux.Handle(whitelistSyncPath, s)
+		go func() {
+			s.log.Noticef("Serving the whitelist on: http://%v%v", s.l.Addr(), whitelistSyncPath)
+			http.Serve(s.l, mux)
+		}()
+	}
+	if len(peers) > 0 {
+		s.Go(func() {
+			s.worker(interval)
+		})
+	}
+	return s, nil
+}
@@ -0,0 +1,318 @@
+// archive.go - Katzenpost authority document archive.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package archive implements a bounded archive of the signed PKI documents
+// published by a directory authority, and of the signed descriptors that
+// each document carries.
+//
+// Only the descriptors embedded in published documents are archived.  The
+// descriptors that nodes upload are held by the authority server, which
+// does not expose them, so an upload that never makes it into a document,
+// such as a late or rejected one, is not kept.  This is by design: the
+// archive only covers what was published, and the authorities' record of
+// rejected uploads (the REJECTION_LIST management command) keeps the
+// reason for a rejection, but not the descriptor.
+package archive
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	documentsBucket   = "documents"
+	descriptorsBucket = "descriptors"
+
+	// DocumentFile is the name of the file holding the raw signed document
+	// in each per-epoch directory written by Export.
+	DocumentFile = "document"
+
+	// DescriptorsDir is the name of the directory holding the raw signed
+	// descriptors in each per-epoch directory written by Export.
+	DescriptorsDir = "descriptors"
+)
+
+// ErrNotFound is the error returned when the archive does not hold a
+// document for the requested epoch.
+var ErrNotFound = errors.New("archive: no document for epoch")
+
+var jsonHandle *codec.JsonHandle
+
+// Archive is a bolt backed archive of signed PKI documents.
+type Archive struct {
+	db        *bolt.DB
+	maxEpochs uint64
+}
+
+// Close closes the archive.
+func (a *Archive) Close() {
+	a.db.Sync()
+	a.db.Close()
+}
+
+// Put archives the raw signed document for the given epoch, along with
+// the raw signed descriptors it contains, and discards any documents that
+// have fallen out of the archive window.  The caller is responsible for
+// having verified the document signature(s).
+func (a *Archive) Put(epoch uint64, rawDoc []byte) error {
+	descs, err := documentDescriptors(rawDoc)
+	if err != nil {
+		return err
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		k := epochToBytes(epoch)
+		if err := tx.Bucket([]byte(documentsBucket)).Put(k, rawDoc); err != nil {
+			return err
+		}
+		descsBkt := tx.Bucket([]byte(descriptorsBucket))
+		if descsBkt.Bucket(k) != nil {
+			if err := descsBkt.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		eBkt, err := descsBkt.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		for id, rawDesc := range descs {
+			if err := eBkt.Put(id[:], rawDesc); err != nil {
+				return err
+			}
+		}
+		return a.prune(tx)
+	})
+}
+
+func (a *Archive) prune(tx *bolt.Tx) error {
+	// Transaction is held (called from Put).
+
+	docsBkt := tx.Bucket([]byte(documentsBucket))
+	descsBkt := tx.Bucket([]byte(descriptorsBucket))
+
+	k, _ := docsBkt.Cursor().Last()
+	if k == nil {
+		return nil
+	}
+	newest := epochFromBytes(k)
+	if a.maxEpochs == 0 || newest < a.maxEpochs {
+		return nil
+	}
+	cmpEpoch := newest - a.maxEpochs
+
+	var stale [][]byte
+	c := docsBkt.Cursor()
+	for k, _ := c.First(); k != nil && epochFromBytes(k) <= cmpEpoch; k, _ = c.Next() {
+		stale = append(stale, append([]byte{}, k...))
+	}
+	for _, k := range stale {
+		if err := docsBkt.Delete(k); err != nil {
+			return err
+		}
+		if descsBkt.Bucket(k) != nil {
+			if err := descsBkt.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Document returns the raw signed document for the given epoch.
+func (a *Archive) Document(epoch uint64) ([]byte, error) {
+	var rawDoc []byte
+	err := a.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(documentsBucket)).Get(epochToBytes(epoch)); b != nil {
+			rawDoc = append([]byte{}, b...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rawDoc == nil {
+		return nil, ErrNotFound
+	}
+	return rawDoc, nil
+}
+
+// Descriptors returns the raw signed descriptors carried by the document
+// archived for the given epoch, keyed by node identity key.
+func (a *Archive) Descriptors(epoch uint64) (map[[eddsa.PublicKeySize]byte][]byte, error) {
+	descs := make(map[[eddsa.PublicKeySize]byte][]byte)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		eBkt := tx.Bucket([]byte(descriptorsBucket)).Bucket(epochToBytes(epoch))
+		if eBkt == nil {
+			return ErrNotFound
+		}
+		return eBkt.ForEach(func(k, v []byte) error {
+			var id [eddsa.PublicKeySize]byte
+			copy(id[:], k)
+			descs[id] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return descs, nil
+}
+
+// Epochs returns the epochs of every archived document, in ascending order.
+func (a *Archive) Epochs() ([]uint64, error) {
+	var epochs []uint64
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(documentsBucket)).ForEach(func(k, v []byte) error {
+			epochs = append(epochs, epochFromBytes(k))
+			return nil
+		})
+	})
+	return epochs, err
+}
+
+// Export writes the archive to the directory dir, as one sub-directory per
+// epoch, each holding the raw signed document and a directory of the raw
+// signed descriptors named by the Base16 encoded identity key.
+func (a *Archive) Export(dir string) error {
+	const dirMode = 0700
+
+	epochs, err := a.Epochs()
+	if err != nil {
+		return err
+	}
+	for _, epoch := range epochs {
+		eDir := filepath.Join(dir, strconv.FormatUint(epoch, 10))
+		if err := os.MkdirAll(filepath.Join(eDir, DescriptorsDir), dirMode); err != nil {
+			return err
+		}
+		rawDoc, err := a.Document(epoch)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(eDir, DocumentFile), rawDoc, 0600); err != nil {
+			return err
+		}
+		descs, err := a.Descriptors(epoch)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		for id, rawDesc := range descs {
+			f := filepath.Join(eDir, DescriptorsDir, hex.EncodeToString(id[:]))
+			if err := ioutil.WriteFile(f, rawDesc, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// documentDescriptors extracts the raw signed descriptors from a raw signed
+// document, keyed by the identity key that each descriptor is signed with.
+func documentDescriptors(rawDoc []byte) (map[[eddsa.PublicKeySize]byte][]byte, error) {
+	payload, err := cert.GetCertified(rawDoc)
+	if err != nil {
+		return nil, err
+	}
+	var d struct {
+		Topology  [][][]byte
+		Providers [][]byte
+	}
+	if err = codec.NewDecoderBytes(payload, jsonHandle).Decode(&d); err != nil {
+		return nil, err
+	}
+
+	rawDescs := d.Providers
+	for _, nodes := range d.Topology {
+		rawDescs = append(rawDescs, nodes...)
+	}
+	descs := make(map[[eddsa.PublicKeySize]byte][]byte)
+	for _, rawDesc := range rawDescs {
+		payload, err := cert.GetCertified(rawDesc)
+		if err != nil {
+			return nil, err
+		}
+		var desc struct {
+			IdentityKey *eddsa.PublicKey
+		}
+		if err = codec.NewDecoderBytes(payload, jsonHandle).Decode(&desc); err != nil {
+			return nil, err
+		}
+		if desc.IdentityKey == nil {
+			return nil, fmt.Errorf("archive: descriptor missing IdentityKey")
+		}
+		if _, err = cert.Verify(desc.IdentityKey, rawDesc); err != nil {
+			return nil, fmt.Errorf("archive: descriptor for %v: %v", desc.IdentityKey, err)
+		}
+		descs[desc.IdentityKey.ByteArray()] = rawDesc
+	}
+	return descs, nil
+}
+
+// New opens (or creates) the archive backed by the bolt database f,
+// that will hold the documents for at most maxEpochs epochs, or for every
+// epoch if maxEpochs is 0.
+func New(f string, maxEpochs uint64) (*Archive, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("archive: failed to open '%v': %v", f, err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, v := range []string{documentsBucket, descriptorsBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Archive{
+		db:        db,
+		maxEpochs: maxEpochs,
+	}, nil
+}
+
+func epochToBytes(e uint64) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, e)
+	return ret
+}
+
+func epochFromBytes(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b[0:8])
+}
+
+func init() {
+	// This MUST match the authority's serialization settings.
+	jsonHandle = new(codec.JsonHandle)
+	jsonHandle.Canonical = true
+	jsonHandle.IntegerAsString = 'A'
+	jsonHandle.MapKeyAsString = true
+}
@@ -0,0 +1,112 @@
+// archive_test.go - Katzenpost authority document archive tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package archive
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+func signedPayload(t *testing.T, signer *eddsa.PrivateKey, v interface{}) []byte {
+	var payload []byte
+	err := codec.NewEncoderBytes(&payload, jsonHandle).Encode(v)
+	assert.NoError(t, err)
+	signed, err := cert.Sign(signer, payload, time.Now().Add(time.Hour).Unix())
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestArchive(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "archive_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	authKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	mixKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	providerKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+
+	type desc struct {
+		Name        string
+		IdentityKey *eddsa.PublicKey
+	}
+	rawMix := signedPayload(t, mixKey, &desc{"mix", mixKey.PublicKey()})
+	rawProvider := signedPayload(t, providerKey, &desc{"provider", providerKey.PublicKey()})
+	rawDoc := signedPayload(t, authKey, &struct {
+		Epoch     uint64
+		Topology  [][][]byte
+		Providers [][]byte
+	}{
+		Epoch:     1,
+		Topology:  [][][]byte{[][]byte{rawMix}},
+		Providers: [][]byte{rawProvider},
+	})
+
+	a, err := New(filepath.Join(dir, "archive.db"), 2)
+	assert.NoError(err)
+	defer a.Close()
+
+	for _, epoch := range []uint64{1, 2, 3} {
+		assert.NoError(a.Put(epoch, rawDoc))
+	}
+
+	epochs, err := a.Epochs()
+	assert.NoError(err)
+	assert.Equal([]uint64{2, 3}, epochs, "Put() prunes to maxEpochs")
+
+	_, err = a.Document(1)
+	assert.Equal(ErrNotFound, err, "Document() for pruned epoch")
+	b, err := a.Document(3)
+	assert.NoError(err)
+	assert.Equal(rawDoc, b, "Document() round trips")
+
+	descs, err := a.Descriptors(3)
+	assert.NoError(err)
+	assert.Len(descs, 2)
+	assert.Equal(rawMix, descs[mixKey.PublicKey().ByteArray()])
+	assert.Equal(rawProvider, descs[providerKey.PublicKey().ByteArray()])
+
+	exportDir := filepath.Join(dir, "export")
+	assert.NoError(a.Export(exportDir))
+	b, err = ioutil.ReadFile(filepath.Join(exportDir, "2", DocumentFile))
+	assert.NoError(err)
+	assert.Equal(rawDoc, b, "Export() writes the document")
+	b, err = ioutil.ReadFile(filepath.Join(exportDir, "2", DescriptorsDir, hex.EncodeToString(mixKey.PublicKey().Bytes())))
+	assert.NoError(err)
+	assert.Equal(rawMix, b, "Export() writes the descriptors")
+
+	// Descriptors that are not self-signed are rejected.
+	forged := signedPayload(t, authKey, &desc{"mix", mixKey.PublicKey()})
+	badDoc := signedPayload(t, authKey, &struct {
+		Topology [][][]byte
+	}{[][][]byte{[][]byte{forged}}})
+	assert.Error(a.Put(4, badDoc))
+}
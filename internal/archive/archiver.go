@@ -0,0 +1,104 @@
+// archiver.go - Katzenpost authority document archiver.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package archive
+
+import (
+	"context"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/worker"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// Store is where an Archiver puts the documents that it fetches, such as
+// an Archive.
+type Store interface {
+	Put(epoch uint64, rawDoc []byte) error
+}
+
+// Archiver periodically fetches the documents published by an authority,
+// and adds them to a Store.
+type Archiver struct {
+	worker.Worker
+
+	store  Store
+	client pki.Client
+	log    *logging.Logger
+}
+
+func (a *Archiver) worker() {
+	const (
+		wakeInterval = 5 * time.Minute
+		fetchTimeout = 30 * time.Second
+	)
+
+	t := time.NewTicker(wakeInterval)
+	defer func() {
+		t.Stop()
+		a.log.Debugf("Halting worker.")
+	}()
+
+	archived := make(map[uint64]bool)
+	for {
+		now, _, _ := epochtime.Now()
+		for _, epoch := range []uint64{now, now + 1} {
+			if archived[epoch] {
+				continue
+			}
+			ctx, cancelFn := context.WithTimeout(context.Background(), fetchTimeout)
+			_, rawDoc, err := a.client.Get(ctx, epoch)
+			cancelFn()
+			if err != nil {
+				a.log.Debugf("No document for epoch %v yet: %v", epoch, err)
+				continue
+			}
+			if err = a.store.Put(epoch, rawDoc); err != nil {
+				a.log.Errorf("Failed to archive document for epoch %v: %v", epoch, err)
+				continue
+			}
+			a.log.Noticef("Archived document for epoch %v.", epoch)
+			archived[epoch] = true
+		}
+		for e := range archived {
+			if e < now {
+				delete(archived, e)
+			}
+		}
+
+		select {
+		case <-a.HaltCh():
+			a.log.Debugf("Terminating gracefully.")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// NewArchiver starts an Archiver that fetches documents with the client c,
+// which MUST verify the document signature(s), and puts them in the Store
+// s.
+func NewArchiver(s Store, c pki.Client, log *logging.Logger) *Archiver {
+	ar := &Archiver{
+		store:  s,
+		client: c,
+		log:    log,
+	}
+	ar.Go(ar.worker)
+	return ar
+}
@@ -0,0 +1,160 @@
+// listener.go - Katzenpost authority document archive wire protocol service.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package archive
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// Listener serves archived documents over the wire protocol, answering
+// get_consensus commands for any archived epoch.  It authenticates as the
+// authority, so the standard PKI clients can be pointed at it unmodified.
+type Listener struct {
+	sync.WaitGroup
+
+	archive     *Archive
+	identityKey *eddsa.PublicKey
+	linkKey     *ecdh.PrivateKey
+	log         *logging.Logger
+
+	l        net.Listener
+	haltOnce sync.Once
+}
+
+// Halt stops the Listener, and waits for all connections to terminate.
+func (l *Listener) Halt() {
+	l.haltOnce.Do(func() {
+		l.l.Close()
+		l.Wait()
+	})
+}
+
+func (l *Listener) listenWorker() {
+	addr := l.l.Addr()
+	l.log.Noticef("Serving archived documents on: %v", addr)
+	defer func() {
+		l.log.Noticef("Stopping listening on: %v", addr)
+		l.Done()
+	}()
+
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				return
+			}
+			continue
+		}
+		l.Add(1)
+		go l.onConn(conn)
+	}
+
+	// NOTREACHED
+}
+
+func (l *Listener) onConn(conn net.Conn) {
+	const (
+		initialDeadline  = 30 * time.Second
+		responseDeadline = 60 * time.Second
+	)
+
+	rAddr := conn.RemoteAddr()
+	defer func() {
+		conn.Close()
+		l.Done()
+	}()
+
+	cfg := &wire.SessionConfig{
+		Authenticator:     l,
+		AdditionalData:    l.identityKey.Bytes(),
+		AuthenticationKey: l.linkKey,
+		RandomReader:      rand.Reader,
+	}
+	s, err := wire.NewSession(cfg, false)
+	if err != nil {
+		l.log.Debugf("Peer %v: Failed to initialize session: %v", rAddr, err)
+		return
+	}
+	defer s.Close()
+
+	conn.SetDeadline(time.Now().Add(initialDeadline))
+	if err = s.Initialize(conn); err != nil {
+		l.log.Debugf("Peer %v: Failed session handshake: %v", rAddr, err)
+		return
+	}
+	cmd, err := s.RecvCommand()
+	if err != nil {
+		l.log.Debugf("Peer %v: Failed to receive command: %v", rAddr, err)
+		return
+	}
+
+	c, ok := cmd.(*commands.GetConsensus)
+	if !ok {
+		l.log.Debugf("Peer %v: Invalid command: %T", rAddr, cmd)
+		return
+	}
+	resp := &commands.Consensus{ErrorCode: commands.ConsensusOk}
+	resp.Payload, err = l.archive.Document(c.Epoch)
+	switch err {
+	case nil:
+		l.log.Debugf("Peer %v: Serving archived document for epoch %v.", rAddr, c.Epoch)
+	case ErrNotFound:
+		resp.ErrorCode = commands.ConsensusGone
+	default:
+		l.log.Errorf("Failed to query archive for epoch %v: %v", c.Epoch, err)
+		resp.ErrorCode = commands.ConsensusNotFound
+	}
+
+	conn.SetDeadline(time.Now().Add(responseDeadline))
+	if err = s.SendCommand(resp); err != nil {
+		l.log.Debugf("Peer %v: Failed to send response: %v", rAddr, err)
+	}
+}
+
+// IsPeerValid implements the wire.PeerAuthenticator interface.  Archived
+// documents are public, so every peer is accepted.
+func (l *Listener) IsPeerValid(creds *wire.PeerCredentials) bool {
+	return true
+}
+
+// NewListener starts a Listener on addr serving documents from the Archive
+// a, authenticating with the authority's identity key and link key.
+func NewListener(a *Archive, addr string, identityKey *eddsa.PublicKey, linkKey *ecdh.PrivateKey, log *logging.Logger) (*Listener, error) {
+	l := &Listener{
+		archive:     a,
+		identityKey: identityKey,
+		linkKey:     linkKey,
+		log:         log,
+	}
+
+	var err error
+	if l.l, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	l.Add(1)
+	go l.listenWorker()
+	return l, nil
+}
@@ -0,0 +1,97 @@
+// client.go - Katzenpost provider key directory client.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package keydir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/daemons/internal/translog"
+)
+
+// Client queries the key directory served by a provider.
+type Client struct {
+	// URL is the base URL of the directory server.
+	URL string
+
+	// HTTPClient is the client used to query the directory.
+	HTTPClient *http.Client
+}
+
+// SignedHead returns the directory's signed tree head, which the caller
+// MUST verify with translog.VerifyTreeHead.
+func (c *Client) SignedHead() ([]byte, error) {
+	return c.get(HeadPath, nil)
+}
+
+// Entries returns the JSON encoded entries from start up to end, or fewer
+// if there are more than MaxEntries.
+func (c *Client) Entries(start, end uint64) ([][]byte, error) {
+	var entries [][]byte
+	return entries, c.getJSON(EntriesPath, url.Values{
+		"start": {strconv.FormatUint(start, 10)},
+		"end":   {strconv.FormatUint(end, 10)},
+	}, &entries)
+}
+
+// Consistency returns the proof that the directory of size first is a
+// prefix of the directory of size second.
+func (c *Client) Consistency(first, second uint64) (*translog.ConsistencyProof, error) {
+	p := new(translog.ConsistencyProof)
+	return p, c.getJSON(ConsistencyPath, url.Values{
+		"first":  {strconv.FormatUint(first, 10)},
+		"second": {strconv.FormatUint(second, 10)},
+	}, p)
+}
+
+func (c *Client) getJSON(path string, q url.Values, v interface{}) error {
+	b, err := c.get(path, q)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (c *Client) get(path string, q url.Values) ([]byte, error) {
+	u := strings.TrimSuffix(c.URL, "/") + path
+	if q != nil {
+		u += "?" + q.Encode()
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := hc.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keydir: %v: %v", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
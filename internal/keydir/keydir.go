@@ -0,0 +1,251 @@
+// keydir.go - Katzenpost provider key directory.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package keydir implements an append-only Merkle tree directory of the
+// identity keys that a provider serves for its users, in the style of
+// CONIKS.  Every key served comes with the proof that it is in the
+// directory, and monitors that follow the directory see every change of a
+// user's key, so a provider that serves different keys to different
+// clients, or replaces a user's key, is detected.
+package keydir
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/daemons/internal/translog"
+)
+
+const (
+	entriesBucket = "entries"
+	usersBucket   = "users"
+
+	// headRefresh is how often the signed tree head is re-signed, when the
+	// directory does not change.
+	headRefresh = time.Hour
+)
+
+// Entry is a leaf of the directory, a user's identity key from Timestamp
+// on.  An empty IdentityKey means that the user no longer has one.
+type Entry struct {
+	User        string
+	IdentityKey string
+	Timestamp   int64
+}
+
+// LookupProof proves that Entry, the JSON encoded entry that the directory
+// serves for a user, is the leaf Index of the directory as of SignedHead.
+// It is an inclusion proof, so it does not show that there is no later
+// entry for the user, which only a Monitor of the directory can tell.
+type LookupProof struct {
+	Entry      []byte
+	Index      uint64
+	Proof      [][]byte
+	SignedHead []byte
+}
+
+// Verify verifies the proof against the directory's signing key, and
+// returns the entry and the tree head.
+func (p *LookupProof) Verify(key *eddsa.PublicKey) (*Entry, *translog.TreeHead, error) {
+	th, _, err := translog.VerifyTreeHead(p.SignedHead, []*eddsa.PublicKey{key})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = translog.VerifyInclusion(translog.LeafHash(p.Entry), p.Index, th.Size, p.Proof, th.Root); err != nil {
+		return nil, nil, err
+	}
+	e := new(Entry)
+	if err = json.Unmarshal(p.Entry, e); err != nil {
+		return nil, nil, err
+	}
+	return e, th, nil
+}
+
+// Directory is a bolt backed key directory.  The leaf hashes are also
+// kept in memory, to build the proofs.
+type Directory struct {
+	sync.Mutex
+
+	db         *bolt.DB
+	signingKey *eddsa.PrivateKey
+	leaves     [][]byte
+
+	signedHead []byte
+	headSize   uint64
+	headTime   time.Time
+}
+
+// Close closes the directory.
+func (d *Directory) Close() {
+	d.db.Sync()
+	d.db.Close()
+}
+
+// Update records identityKey as the key of user, unless it already is its
+// latest entry, and returns the proof of the latest entry.  An empty
+// identityKey records that the user has no key, and returns nil if the
+// user never had one.
+func (d *Directory) Update(user, identityKey string) (*LookupProof, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	var raw []byte
+	var idx uint64
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		entries, users := tx.Bucket([]byte(entriesBucket)), tx.Bucket([]byte(usersBucket))
+		if b := users.Get([]byte(user)); b != nil {
+			idx = binary.BigEndian.Uint64(b)
+			raw = append([]byte{}, entries.Get(b)...)
+			e := new(Entry)
+			if err := json.Unmarshal(raw, e); err != nil {
+				return err
+			}
+			if e.IdentityKey == identityKey {
+				return nil
+			}
+		} else if identityKey == "" {
+			return nil
+		}
+
+		var err error
+		if raw, err = json.Marshal(&Entry{User: user, IdentityKey: identityKey, Timestamp: time.Now().Unix()}); err != nil {
+			return err
+		}
+		idx = entries.Sequence()
+		if err = entries.Put(uint64ToBytes(idx), raw); err != nil {
+			return err
+		}
+		if err = entries.SetSequence(idx + 1); err != nil {
+			return err
+		}
+		return users.Put([]byte(user), uint64ToBytes(idx))
+	})
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	if idx == uint64(len(d.leaves)) {
+		d.leaves = append(d.leaves, translog.LeafHash(raw))
+	}
+
+	head, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	return &LookupProof{
+		Entry:      raw,
+		Index:      idx,
+		Proof:      translog.AuditPath(idx, d.leaves),
+		SignedHead: head,
+	}, nil
+}
+
+// SignedHead returns the current signed tree head.
+func (d *Directory) SignedHead() ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.head()
+}
+
+func (d *Directory) head() ([]byte, error) {
+	size := uint64(len(d.leaves))
+	if d.signedHead != nil && d.headSize == size && time.Since(d.headTime) < headRefresh {
+		return d.signedHead, nil
+	}
+	th := &translog.TreeHead{
+		Size:      size,
+		Root:      translog.RootHash(d.leaves),
+		Timestamp: time.Now(),
+	}
+	b, err := translog.SignTreeHead(d.signingKey, th)
+	if err != nil {
+		return nil, err
+	}
+	d.signedHead, d.headSize, d.headTime = b, size, th.Timestamp
+	return b, nil
+}
+
+// Entries returns the JSON encoded entries from start up to end.
+func (d *Directory) Entries(start, end uint64) ([][]byte, error) {
+	var entries [][]byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(entriesBucket))
+		if start > end || end > bkt.Sequence() {
+			return fmt.Errorf("keydir: invalid range %v-%v of %v entries", start, end, bkt.Sequence())
+		}
+		c := bkt.Cursor()
+		for k, v := c.Seek(uint64ToBytes(start)); k != nil && binary.BigEndian.Uint64(k) < end; k, v = c.Next() {
+			entries = append(entries, append([]byte{}, v...))
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Consistency returns the proof that the directory of size first is a
+// prefix of the directory of size second.
+func (d *Directory) Consistency(first, second uint64) (*translog.ConsistencyProof, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if first > second || second > uint64(len(d.leaves)) {
+		return nil, fmt.Errorf("keydir: invalid consistency proof sizes %v-%v", first, second)
+	}
+	p := &translog.ConsistencyProof{First: first, Second: second}
+	if first > 0 {
+		p.Proof = translog.ConsistencyHashes(first, d.leaves[:second])
+	}
+	return p, nil
+}
+
+// New opens (or creates) the key directory backed by the bolt database f,
+// with tree heads signed by signingKey.
+func New(f string, signingKey *eddsa.PrivateKey) (*Directory, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("keydir: failed to open '%v': %v", f, err)
+	}
+	d := &Directory{db: db, signingKey: signingKey}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, v := range []string{entriesBucket, usersBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(v)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(entriesBucket)).ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint64(k) != uint64(len(d.leaves)) {
+				return errors.New("keydir: entries are not contiguous")
+			}
+			d.leaves = append(d.leaves, translog.LeafHash(v))
+			return nil
+		})
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func uint64ToBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
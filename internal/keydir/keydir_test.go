@@ -0,0 +1,106 @@
+// keydir_test.go - Katzenpost provider key directory tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package keydir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keydir_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	logBackend, err := log.New("", "ERROR", false)
+	assert.NoError(err)
+	signingKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+
+	f := filepath.Join(dir, "keydir.db")
+	d, err := New(f, signingKey)
+	assert.NoError(err)
+
+	lookup := func(user, key string) *Entry {
+		p, err := d.Update(user, key)
+		assert.NoError(err, "Update")
+		if p == nil {
+			return nil
+		}
+		e, _, err := p.Verify(signingKey.PublicKey())
+		assert.NoError(err, "Verify")
+		return e
+	}
+
+	assert.Nil(lookup("alice", ""), "Update: no key")
+	e := lookup("alice", "key1")
+	assert.Equal("key1", e.IdentityKey, "Update")
+	assert.Equal(*e, *lookup("alice", "key1"), "Update: same key")
+	lookup("bob", "key2")
+
+	s, err := NewServer(d, "127.0.0.1:0", logBackend.GetLogger("keydir"))
+	assert.NoError(err)
+	c := &Client{URL: "http://" + s.l.Addr().String()}
+
+	state := new(MonitorState)
+	changes, err := Monitor(c, signingKey.PublicKey(), state)
+	assert.NoError(err, "Monitor")
+	if assert.Len(changes, 2, "Monitor") {
+		assert.True(changes[0].First, "Monitor: first key")
+	}
+	th := state.Head
+
+	// A change of key, and a removal, are seen by the monitor.
+	lookup("alice", "key3")
+	assert.Equal("", lookup("bob", "").IdentityKey, "Update: removal")
+	changes, err = Monitor(c, signingKey.PublicKey(), state)
+	assert.NoError(err, "Monitor")
+	if assert.Len(changes, 2, "Monitor") {
+		assert.False(changes[0].First, "Monitor: key change")
+		assert.Equal("key1", changes[0].Previous, "Monitor: key change")
+		assert.Equal("key3", changes[0].IdentityKey, "Monitor: key change")
+		assert.Equal("key2", changes[1].Previous, "Monitor: removal")
+	}
+	p, err := c.Consistency(th.Size, state.Head.Size)
+	assert.NoError(err, "Consistency")
+	assert.NoError(p.Verify(th, state.Head), "Consistency")
+
+	// A monitor detects a directory that does not extend its state.
+	forked := &MonitorState{Leaves: append([][]byte{state.Leaves[1]}, state.Leaves[1:]...)}
+	_, err = Monitor(c, signingKey.PublicKey(), forked)
+	assert.Error(err, "Monitor: fork")
+	otherKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	_, err = Monitor(c, otherKey.PublicKey(), new(MonitorState))
+	assert.Error(err, "Monitor: wrong key")
+
+	s.Halt()
+	d.Close()
+	d, err = New(f, signingKey)
+	assert.NoError(err, "New: reopen")
+	assert.Equal(state.Leaves, d.leaves, "New: reopen")
+	assert.Equal("key3", lookup("alice", "key3").IdentityKey, "Update: reopen")
+	d.Close()
+}
@@ -0,0 +1,96 @@
+// monitor.go - Katzenpost provider key directory monitor.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package keydir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/daemons/internal/translog"
+)
+
+// MonitorState is what a monitor keeps of a directory between runs: the
+// last verified tree head, every leaf hash, and the latest key of every
+// user.
+type MonitorState struct {
+	Head   *translog.TreeHead
+	Leaves [][]byte
+	Keys   map[string]string
+}
+
+// Change is a new entry seen by a monitor, with the user's previous key,
+// unless the entry is the user's First.
+type Change struct {
+	Entry
+
+	Index    uint64
+	First    bool
+	Previous string
+}
+
+// Monitor fetches the directory's signed tree head, and the entries added
+// since state, which it checks are an append-only extension of the
+// directory that state holds, with the tree head's root.  It updates state
+// and returns the changes only if they all check out.
+func Monitor(c *Client, key *eddsa.PublicKey, state *MonitorState) ([]*Change, error) {
+	raw, err := c.SignedHead()
+	if err != nil {
+		return nil, err
+	}
+	th, _, err := translog.VerifyTreeHead(raw, []*eddsa.PublicKey{key})
+	if err != nil {
+		return nil, err
+	}
+	if th.Size < uint64(len(state.Leaves)) {
+		return nil, fmt.Errorf("keydir: the directory shrank from %v entries to %v", len(state.Leaves), th.Size)
+	}
+
+	leaves := state.Leaves
+	keys := make(map[string]string)
+	for k, v := range state.Keys {
+		keys[k] = v
+	}
+	var changes []*Change
+	for uint64(len(leaves)) < th.Size {
+		entries, err := c.Entries(uint64(len(leaves)), th.Size)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, errors.New("keydir: the directory served no entries")
+		}
+		for _, b := range entries {
+			e := new(Entry)
+			if err = json.Unmarshal(b, e); err != nil {
+				return nil, fmt.Errorf("keydir: invalid entry %v: %v", len(leaves), err)
+			}
+			prev, seen := keys[e.User]
+			changes = append(changes, &Change{Entry: *e, Index: uint64(len(leaves)), First: !seen, Previous: prev})
+			keys[e.User] = e.IdentityKey
+			leaves = append(leaves, translog.LeafHash(b))
+		}
+	}
+	if uint64(len(leaves)) != th.Size || !bytes.Equal(translog.RootHash(leaves), th.Root) {
+		return nil, errors.New("keydir: the entries do not match the tree head")
+	}
+
+	state.Head, state.Leaves, state.Keys = th, leaves, keys
+	return changes, nil
+}
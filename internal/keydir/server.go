@@ -0,0 +1,129 @@
+// server.go - Katzenpost provider key directory server.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package keydir
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// HeadPath is the HTTP path that the signed tree head is served on.
+	HeadPath = "/keydir/head"
+
+	// EntriesPath is the HTTP path that the entries are served on, with
+	// the start and end query parameters.
+	EntriesPath = "/keydir/entries"
+
+	// ConsistencyPath is the HTTP path that consistency proofs are served
+	// on, with the first and second query parameters.
+	ConsistencyPath = "/keydir/consistency"
+
+	// MaxEntries is the maximum number of entries served at once.
+	MaxEntries = 1000
+)
+
+// Server serves a Directory, its signed tree heads, entries and
+// consistency proofs over HTTP, for monitors.
+type Server struct {
+	dir *Directory
+	log *logging.Logger
+
+	l net.Listener
+}
+
+// Halt stops the Server.
+func (s *Server) Halt() {
+	s.l.Close()
+}
+
+func (s *Server) serveHead(w http.ResponseWriter, r *http.Request) {
+	b, err := s.dir.SignedHead()
+	if err != nil {
+		s.log.Errorf("Failed to sign the tree head: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+func (s *Server) serveEntries(w http.ResponseWriter, r *http.Request) {
+	start, err1 := strconv.ParseUint(r.FormValue("start"), 10, 64)
+	end, err2 := strconv.ParseUint(r.FormValue("end"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid start or end", http.StatusBadRequest)
+		return
+	}
+	if end > start+MaxEntries {
+		end = start + MaxEntries
+	}
+	entries, err := s.dir.Entries(start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func (s *Server) serveConsistency(w http.ResponseWriter, r *http.Request) {
+	first, err1 := strconv.ParseUint(r.FormValue("first"), 10, 64)
+	second, err2 := strconv.ParseUint(r.FormValue("second"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid first or second size", http.StatusBadRequest)
+		return
+	}
+	p, err := s.dir.Consistency(first, second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// NewServer starts serving the Directory d over HTTP on addr.
+func NewServer(d *Directory, addr string, log *logging.Logger) (*Server, error) {
+	s := &Server{
+		dir: d,
+		log: log,
+	}
+
+	var err error
+	if s.l, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(HeadPath, s.serveHead)
+	mux.HandleFunc(EntriesPath, s.serveEntries)
+	mux.HandleFunc(ConsistencyPath, s.serveConsistency)
+	go func() {
+		log.Noticef("Serving the key directory on: http://%v%v", s.l.Addr(), HeadPath)
+		http.Serve(s.l, mux)
+	}()
+	return s, nil
+}
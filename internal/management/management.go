@@ -0,0 +1,105 @@
+// management.go - Katzenpost daemon management interface.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package management implements the thwack management socket of the
+// daemons, and a client for issuing commands to it.
+package management
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+)
+
+// SocketFile is the name of the management socket in the daemon's DataDir.
+const SocketFile = "management_sock"
+
+const dialTimeout = 10 * time.Second
+
+// New returns a new, not yet started, management server listening on the
+// unix socket path.  Any stale socket left behind by a previous instance is
+// removed.
+func New(path, serviceName string, logBackend *log.Backend) (*thwack.Server, error) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("management: failed to delete stale socket '%v': %v", path, err)
+		}
+	}
+	return thwack.New(&thwack.Config{
+		Net:         "unix",
+		Addr:        path,
+		ServiceName: serviceName + " Katzenpost Management Interface",
+		LogModule:   "mgmt",
+		NewLoggerFn: logBackend.GetLogger,
+	})
+}
+
+// WriteLines sends lines as the body of a multi-line reply, followed by
+// the final status line.
+func WriteLines(c *thwack.Conn, lines []string, status thwack.StatusCode) error {
+	w := c.Writer()
+	for _, v := range lines {
+		if err := w.PrintfLine("%d-%s", status, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(status)
+}
+
+// Run issues the command cmd to the management server listening on the
+// unix socket path, and writes the body of the reply to w.  An error is
+// returned if the command failed.
+func Run(path, cmd string, w io.Writer) error {
+	msg, err := Query(path, cmd)
+	if err != nil {
+		return err
+	}
+
+	// The last line of a multi-line reply is the status message.
+	lines := strings.Split(msg, "\n")
+	for _, v := range lines[:len(lines)-1] {
+		fmt.Fprintln(w, v)
+	}
+	return nil
+}
+
+// Query issues the command cmd to the management server listening on the
+// unix socket path, and returns the whole reply, which ends with the status
+// message.  A command that fails returns a *textproto.Error.
+func Query(path, cmd string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return "", err
+	}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+
+	if _, _, err = c.ReadResponse(int(thwack.StatusServiceReady)); err != nil {
+		return "", err
+	}
+	if err = c.PrintfLine("%s", cmd); err != nil {
+		return "", err
+	}
+	_, msg, err := c.ReadResponse(int(thwack.StatusOk))
+	return msg, err
+}
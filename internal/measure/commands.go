@@ -0,0 +1,55 @@
+// commands.go - Katzenpost node measurement management commands.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package measure
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+)
+
+const cmdMeasurementList = "MEASUREMENT_LIST"
+
+// RegisterCommands registers the node measurement commands with the
+// management server m.
+//
+//	MEASUREMENT_LIST                   List the measured nodes, and whether
+//	                                   they are excluded and dropped.
+func RegisterCommands(m *thwack.Server, s *Status) {
+	m.RegisterCommand(cmdMeasurementList, func(c *thwack.Conn, l string) error {
+		nodes, err := s.Nodes()
+		if err != nil {
+			return management.WriteLines(c, []string{err.Error()}, thwack.StatusTransactionFailed)
+		}
+		var lines []string
+		for _, v := range nodes {
+			lines = append(lines, formatNode(v))
+		}
+		return management.WriteLines(c, lines, thwack.StatusOk)
+	})
+}
+
+func formatNode(s *NodeStatus) string {
+	listed := "never"
+	if !s.LastListed.IsZero() {
+		listed = s.LastListed.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%v %q probes=%v failures=%v uptime=%.3f latency=%v weight=%v listed=%v excluded=%q dropped=%v",
+		s.IdentityKey, s.Name, s.Probes, s.Failures, s.Uptime, s.Latency, s.Weight, listed, s.ExcludedReason, s.Dropped)
+}
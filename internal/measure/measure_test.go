@@ -0,0 +1,93 @@
+// measure_test.go - Katzenpost node measurement tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package measure
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasure(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "measure_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	desc := &pki.MixDescriptor{
+		Name:        "node",
+		IdentityKey: identityKey.PublicKey(),
+		LinkKey:     identityKey.ToECDH().PublicKey(),
+	}
+	_, err = probe(desc)
+	assert.Equal(errNoAddress, err, "probe() of a node without addresses")
+
+	rtt := 50 * time.Millisecond
+	s, err := New(filepath.Join(dir, "measure.db"))
+	assert.NoError(err)
+	defer s.Close()
+	assert.NoError(s.Record(desc, true, rtt, nil))
+	for i := 0; i < 9; i++ {
+		assert.NoError(s.Record(desc, false, 0, errors.New("probe failed")))
+	}
+	all, err := s.All()
+	assert.NoError(err)
+	assert.Len(all, 1)
+	ns := all[0]
+	assert.Equal(uint64(10), ns.Probes)
+	assert.Equal(uint64(9), ns.Failures)
+	assert.Equal(rtt, ns.Latency)
+	assert.Equal("probe failed", ns.LastError)
+	assert.InDelta(0.387, ns.Uptime, 0.001)
+
+	th := &Thresholds{MinProbes: 10, MinUptime: 0.5}
+	excluded, reason := th.Excluded(ns)
+	assert.True(excluded)
+	assert.NotEmpty(reason)
+	m, err := s.Excluded(th)
+	assert.NoError(err)
+	assert.Equal(reason, m[identityKey.PublicKey().ByteArray()], "Store.Excluded()")
+	th.MinProbes = 11
+	excluded, _ = th.Excluded(ns)
+	assert.False(excluded, "Excluded() requires MinProbes")
+	m, err = s.Excluded(th)
+	assert.NoError(err)
+	assert.Empty(m, "Store.Excluded() requires MinProbes")
+
+	// An unlisted node can still be probed, till its measurements expire.
+	assert.Equal(desc.LinkKey.Bytes(), ns.Descriptor().LinkKey.Bytes(), "Descriptor()")
+	n, err := s.Expire(ns.LastListed)
+	assert.NoError(err)
+	assert.Equal(0, n, "Expire() of a listed node")
+	n, err = s.Expire(ns.LastListed.Add(time.Second))
+	assert.NoError(err)
+	assert.Equal(1, n, "Expire()")
+	all, err = s.All()
+	assert.NoError(err)
+	assert.Empty(all, "Expire()")
+}
@@ -0,0 +1,225 @@
+// prober.go - Katzenpost node prober.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package measure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/worker"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	fetchTimeout = 30 * time.Second
+	probeTimeout = 15 * time.Second
+)
+
+var (
+	errNoAddress = errors.New("measure: no usable address")
+	errNoLinkKey = errors.New("measure: no link key")
+)
+
+// Prober periodically probes every node listed in the current PKI document
+// and records the results in a Store.  The nodes in the Store that are no
+// longer listed, such as the nodes excluded for failing the thresholds, are
+// still probed with the descriptor recorded at their last probe, so that
+// they can recover, till their measurements expire after ExpiryAge.
+//
+// A probe connects to the node, and performs the initiator side of the wire
+// protocol handshake with an ephemeral key, up to the point where the node
+// proves that it holds the link key listed in its descriptor.  The node
+// will then reject the prober, as it is not a valid peer.
+type Prober struct {
+	worker.Worker
+
+	store    *Store
+	client   pki.Client
+	interval time.Duration
+	log      *logging.Logger
+}
+
+func (p *Prober) worker() {
+	t := time.NewTicker(p.interval)
+	defer func() {
+		t.Stop()
+		p.log.Debugf("Halting worker.")
+	}()
+
+	for {
+		p.probeAll()
+
+		select {
+		case <-p.HaltCh():
+			p.log.Debugf("Terminating gracefully.")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *Prober) probeAll() {
+	epoch, _, _ := epochtime.Now()
+	ctx, cancelFn := context.WithTimeout(context.Background(), fetchTimeout)
+	doc, _, err := p.client.Get(ctx, epoch)
+	cancelFn()
+	var descs []*pki.MixDescriptor
+	if err != nil {
+		p.log.Warningf("Failed to fetch document for epoch %v: %v", epoch, err)
+	} else {
+		descs = append(descs, doc.Providers...)
+		for _, nodes := range doc.Topology {
+			descs = append(descs, nodes...)
+		}
+	}
+	listed := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, desc := range descs {
+		listed[desc.IdentityKey.ByteArray()] = true
+	}
+
+	if n, err := p.store.Expire(time.Now().Add(-ExpiryAge)); err != nil {
+		p.log.Errorf("Failed to expire measurements: %v", err)
+	} else if n > 0 {
+		p.log.Noticef("Expired the measurements of %v nodes no longer listed.", n)
+	}
+	all, err := p.store.All()
+	if err != nil {
+		p.log.Errorf("Failed to query measurements: %v", err)
+	}
+	nrListed := len(descs)
+	for _, ns := range all {
+		if !listed[ns.IdentityKey.ByteArray()] {
+			descs = append(descs, ns.Descriptor())
+		}
+	}
+
+	for _, desc := range descs {
+		select {
+		case <-p.HaltCh():
+			return
+		default:
+		}
+
+		rtt, err := probe(desc)
+		if err != nil {
+			p.log.Debugf("Probe of '%v' failed: %v", desc.Name, err)
+		}
+		if err = p.store.Record(desc, listed[desc.IdentityKey.ByteArray()], rtt, err); err != nil {
+			p.log.Errorf("Failed to record probe of '%v': %v", desc.Name, err)
+		}
+	}
+	p.log.Debugf("Probed %v listed and %v unlisted nodes for epoch %v.", nrListed, len(descs)-nrListed, epoch)
+}
+
+// probe probes the node desc, and returns the time taken to connect to and
+// authenticate the node.
+func probe(desc *pki.MixDescriptor) (time.Duration, error) {
+	var addr string
+	for _, t := range []pki.Transport{pki.TransportTCPv4, pki.TransportTCPv6, pki.TransportTCP} {
+		if v := desc.Addresses[t]; len(v) > 0 {
+			addr = v[0]
+			break
+		}
+	}
+	if addr == "" {
+		return 0, errNoAddress
+	}
+	if desc.LinkKey == nil {
+		return 0, errNoLinkKey
+	}
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return 0, err
+	}
+	auth := &nodeAuthenticator{linkKey: desc.LinkKey, identityKey: desc.IdentityKey}
+	cfg := &wire.SessionConfig{
+		Authenticator:     auth,
+		AdditionalData:    []byte{},
+		AuthenticationKey: linkKey,
+		RandomReader:      rand.Reader,
+	}
+	s, err := wire.NewSession(cfg, true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	auth.start = time.Now()
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(auth.start.Add(probeTimeout))
+
+	// The node is expected to reject the prober after the handshake, so
+	// the probe succeeds as soon as the node has been authenticated.
+	err = s.Initialize(conn)
+	if auth.verified {
+		return auth.rtt, nil
+	}
+	if err == nil {
+		err = errors.New("measure: node was not authenticated")
+	}
+	return 0, err
+}
+
+// nodeAuthenticator accepts only the node whose descriptor is being probed,
+// and records when the node was authenticated.
+type nodeAuthenticator struct {
+	linkKey     *ecdh.PublicKey
+	identityKey *eddsa.PublicKey
+
+	start    time.Time
+	rtt      time.Duration
+	verified bool
+}
+
+func (a *nodeAuthenticator) IsPeerValid(creds *wire.PeerCredentials) bool {
+	if !a.linkKey.Equal(creds.PublicKey) {
+		return false
+	}
+	if !bytes.Equal(a.identityKey.Bytes(), creds.AdditionalData) {
+		return false
+	}
+	a.rtt = time.Since(a.start)
+	a.verified = true
+	return true
+}
+
+// NewProber starts a Prober that probes the nodes in the documents fetched
+// with the client c every interval, and records the results in the Store s.
+func NewProber(s *Store, c pki.Client, interval time.Duration, log *logging.Logger) *Prober {
+	p := &Prober{
+		store:    s,
+		client:   c,
+		interval: interval,
+		log:      log,
+	}
+	p.Go(p.worker)
+	return p
+}
@@ -0,0 +1,126 @@
+// status.go - Katzenpost node measurement status endpoint.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package measure
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// StatusPath is the HTTP path that the measurements are served on.
+const StatusPath = "/measurements"
+
+// NodeStatus is a node's measurements, and the resulting node selection
+// decision.
+type NodeStatus struct {
+	*NodeStats
+
+	Weight         uint8
+	Excluded       bool
+	ExcludedReason string `json:",omitempty"`
+
+	// Dropped is set iff the authority currently drops the node from the
+	// authorized nodes.
+	Dropped bool
+}
+
+// DroppedFunc returns the identity keys of the nodes that the authority
+// currently drops from the authorized nodes.
+type DroppedFunc func() map[[eddsa.PublicKeySize]byte]bool
+
+// Status reports the measurements, and serves them as JSON over HTTP.
+type Status struct {
+	store      *Store
+	thresholds *Thresholds
+	dropped    DroppedFunc
+	log        *logging.Logger
+
+	l net.Listener
+}
+
+// Halt stops the Status server.
+func (s *Status) Halt() {
+	if s.l != nil {
+		s.l.Close()
+	}
+}
+
+// Nodes returns the status of every measured node, sorted by name.
+func (s *Status) Nodes() ([]*NodeStatus, error) {
+	all, err := s.store.All()
+	if err != nil {
+		return nil, err
+	}
+	var dropped map[[eddsa.PublicKeySize]byte]bool
+	if s.dropped != nil {
+		dropped = s.dropped()
+	}
+	ret := make([]*NodeStatus, 0, len(all))
+	for _, ns := range all {
+		st := &NodeStatus{NodeStats: ns, Weight: ns.Weight()}
+		st.Excluded, st.ExcludedReason = s.thresholds.Excluded(ns)
+		st.Dropped = dropped[ns.IdentityKey.ByteArray()]
+		ret = append(ret, st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.Nodes()
+	if err != nil {
+		s.log.Errorf("Failed to query measurements: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(nodes)
+}
+
+// Listen starts serving the measurements over HTTP on addr.
+func (s *Status) Listen(addr string, log *logging.Logger) error {
+	var err error
+	if s.l, err = net.Listen("tcp", addr); err != nil {
+		return err
+	}
+	s.log = log
+	mux := http.NewServeMux()
+	mux.Handle(StatusPath, s)
+	go func() {
+		log.Noticef("Serving measurements on: http://%v%v", s.l.Addr(), StatusPath)
+		http.Serve(s.l, mux)
+	}()
+	return nil
+}
+
+// NewStatus returns the status of the measurements in the Store st,
+// evaluated against the thresholds t.  dropped, if set, reports the nodes
+// that the authority currently drops.
+func NewStatus(st *Store, t *Thresholds, dropped DroppedFunc) *Status {
+	return &Status{
+		store:      st,
+		thresholds: t,
+		dropped:    dropped,
+	}
+}
@@ -0,0 +1,266 @@
+// store.go - Katzenpost node measurement store.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package measure implements active reachability and latency measurement
+// of the nodes listed in the PKI document, for use in node selection.
+package measure
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+const (
+	nodesBucket = "nodes"
+
+	// ewmaAlpha is the weight given to the newest probe in the moving
+	// averages.
+	ewmaAlpha = 0.1
+
+	// ExpiryAge is how long the measurements of a node that is no longer
+	// listed in a document are kept, and the node probed.
+	ExpiryAge = 7 * 24 * time.Hour
+)
+
+// NodeStats are the measurements of a node.
+type NodeStats struct {
+	// Name is the node's name, as of the last probe.
+	Name string
+
+	// IdentityKey is the node's identity key.
+	IdentityKey *eddsa.PublicKey
+
+	// LinkKey and Addresses are the node's link key and addresses, as of
+	// the last probe, so that the node can still be probed once it is no
+	// longer listed in the document.
+	LinkKey   *ecdh.PublicKey
+	Addresses map[pki.Transport][]string
+
+	// Probes and Failures are the total number of probes, and of failed
+	// probes.
+	Probes   uint64
+	Failures uint64
+
+	// Uptime is the exponentially weighted moving average of the probe
+	// success rate, in [0, 1].
+	Uptime float64
+
+	// Latency is the exponentially weighted moving average of the
+	// time taken to connect to and authenticate the node.
+	Latency time.Duration
+
+	// LastSuccess and LastFailure are the times of the most recent
+	// successful and failed probes.
+	LastSuccess time.Time
+	LastFailure time.Time
+
+	// LastError is the error of the most recent failed probe.
+	LastError string
+
+	// LastListed is the time of the most recent probe made while the node
+	// was listed in the document.
+	LastListed time.Time
+}
+
+// Thresholds are the limits that a node's measurements must meet for it to
+// be included in the next document.
+type Thresholds struct {
+	// MinProbes is the number of probes required before a node can be
+	// excluded.
+	MinProbes uint64
+
+	// MinUptime is the minimum Uptime.
+	MinUptime float64
+
+	// MaxLatency is the maximum Latency, 0 for no limit.
+	MaxLatency time.Duration
+}
+
+// Excluded returns true and the reason iff the node should be excluded.
+func (t *Thresholds) Excluded(s *NodeStats) (bool, string) {
+	switch {
+	case s.Probes < t.MinProbes:
+		return false, ""
+	case s.Uptime < t.MinUptime:
+		return true, fmt.Sprintf("uptime %.3f is below %.3f", s.Uptime, t.MinUptime)
+	case t.MaxLatency > 0 && s.Latency > t.MaxLatency:
+		return true, fmt.Sprintf("latency %v is above %v", s.Latency, t.MaxLatency)
+	}
+	return false, ""
+}
+
+// Weight returns the node's load balancing weight derived from its Uptime,
+// scaled to the range of the descriptor LoadWeight field.
+func (s *NodeStats) Weight() uint8 {
+	return uint8(s.Uptime * 255)
+}
+
+// Store is a bolt backed store of node measurements.
+type Store struct {
+	db *bolt.DB
+}
+
+// Close closes the store.
+func (s *Store) Close() {
+	s.db.Sync()
+	s.db.Close()
+}
+
+// Record records the outcome of a probe of the node desc, that took rtt if
+// probeErr is nil.  listed is set iff the node is listed in the document.
+func (s *Store) Record(desc *pki.MixDescriptor, listed bool, rtt time.Duration, probeErr error) error {
+	now := time.Now()
+	id := desc.IdentityKey.ByteArray()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(nodesBucket))
+		ns := new(NodeStats)
+		if b := bkt.Get(id[:]); b != nil {
+			if err := json.Unmarshal(b, ns); err != nil {
+				return err
+			}
+		}
+		ns.Name = desc.Name
+		ns.IdentityKey = desc.IdentityKey
+		ns.LinkKey = desc.LinkKey
+		ns.Addresses = desc.Addresses
+		ns.Probes++
+		if listed {
+			ns.LastListed = now
+		}
+
+		success := 1.0
+		if probeErr != nil {
+			success = 0
+			ns.Failures++
+			ns.LastFailure = now
+			ns.LastError = probeErr.Error()
+		} else {
+			ns.LastSuccess = now
+			if ns.Latency == 0 {
+				ns.Latency = rtt
+			} else {
+				ns.Latency = time.Duration((1-ewmaAlpha)*float64(ns.Latency) + ewmaAlpha*float64(rtt))
+			}
+		}
+		if ns.Probes == 1 {
+			ns.Uptime = success
+		} else {
+			ns.Uptime = (1-ewmaAlpha)*ns.Uptime + ewmaAlpha*success
+		}
+
+		b, err := json.Marshal(ns)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(id[:], b)
+	})
+}
+
+// All returns the measurements of every node.
+func (s *Store) All() ([]*NodeStats, error) {
+	var all []*NodeStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(nodesBucket)).ForEach(func(k, v []byte) error {
+			ns := new(NodeStats)
+			if err := json.Unmarshal(v, ns); err != nil {
+				return err
+			}
+			all = append(all, ns)
+			return nil
+		})
+	})
+	return all, err
+}
+
+// Descriptor returns a descriptor of the node, with the name, keys and
+// addresses recorded at the last probe, for probing the node.
+func (ns *NodeStats) Descriptor() *pki.MixDescriptor {
+	return &pki.MixDescriptor{
+		Name:        ns.Name,
+		IdentityKey: ns.IdentityKey,
+		LinkKey:     ns.LinkKey,
+		Addresses:   ns.Addresses,
+	}
+}
+
+// Expire deletes the measurements of the nodes that have not been listed in
+// the document since before, and returns the number of nodes deleted.
+func (s *Store) Expire(before time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(nodesBucket))
+		var expired [][]byte
+		if err := bkt.ForEach(func(k, v []byte) error {
+			ns := new(NodeStats)
+			if err := json.Unmarshal(v, ns); err != nil {
+				return err
+			}
+			if ns.LastListed.Before(before) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Excluded returns the reasons for excluding the nodes whose measurements
+// do not meet the thresholds t, keyed by node identity key.
+func (s *Store) Excluded(t *Thresholds) (map[[eddsa.PublicKeySize]byte]string, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[[eddsa.PublicKeySize]byte]string)
+	for _, ns := range all {
+		if ok, reason := t.Excluded(ns); ok {
+			excluded[ns.IdentityKey.ByteArray()] = reason
+		}
+	}
+	return excluded, nil
+}
+
+// New opens (or creates) the measurement store backed by the bolt
+// database f.
+func New(f string) (*Store, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("measure: failed to open '%v': %v", f, err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(nodesBucket))
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
@@ -0,0 +1,295 @@
+// mixkey.go - Katzenpost sub-epoch mix keys.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package mixkey implements a sub-epoch mix key schedule.  Each epoch is
+// split into a number of key windows, each with its own mix key and replay
+// filter, and a key, along with its replay state, is erased as soon as its
+// window ends, so that compromising a mix only exposes the packets of the
+// current window, instead of the rest of the epoch.
+//
+// This is the key schedule only.  The server library's mix key handling,
+// and the descriptor's epoch keyed MixKeys, are not aware of windows.
+package mixkey
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.schwanenlied.me/yawning/bloom.git"
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+)
+
+const (
+	replayBucket   = "replay"
+	metadataBucket = "metadata"
+
+	writeBackSize = 4096
+
+	// TagLength is the replay tag length in bytes.
+	TagLength = sha512.Size256
+
+	// KeyGlob is the pattern that matches the filenames for sub-keys that
+	// have been persisted to disk.
+	KeyGlob = "subkey-*.db"
+
+	// KeyFmt is the format string corresponding to filenames for sub-keys
+	// that have been persisted to disk.
+	KeyFmt = "subkey-%d.db"
+
+	// epochFilterLn2 is the log2 of the size in bits of the replay filter
+	// of an epoch long key, as used by the server's mix keys.  The filter
+	// of a sub-key is scaled down by the number of windows.
+	epochFilterLn2 = 29
+)
+
+// Window returns the key window at t, with w windows per epoch, and the
+// time till the window ends.
+func Window(t time.Time, w uint64) (uint64, time.Duration) {
+	fromEpoch := t.Sub(epochtime.Epoch)
+	epoch := uint64(fromEpoch / epochtime.Period)
+	elapsed := fromEpoch - time.Duration(epoch)*epochtime.Period
+	length := WindowLength(w)
+	i := uint64(elapsed / length)
+	if i >= w {
+		i = w - 1
+	}
+	return epoch*w + i, length*time.Duration(i+1) - elapsed
+}
+
+// WindowLength returns the length of a key window, with w windows per
+// epoch.
+func WindowLength(w uint64) time.Duration {
+	return epochtime.Period / time.Duration(w)
+}
+
+// SubKey is the mix key of a key window.
+type SubKey struct {
+	sync.Mutex
+
+	db      *bolt.DB
+	keypair *ecdh.PrivateKey
+	window  uint64
+
+	f         *bloom.Filter
+	writeBack map[[TagLength]byte]bool
+
+	refCount int32
+	erase    bool
+}
+
+// PublicKey returns the public component of the key.
+func (k *SubKey) PublicKey() *ecdh.PublicKey {
+	return k.keypair.PublicKey()
+}
+
+// PrivateKey returns the private component of the key.
+func (k *SubKey) PrivateKey() *ecdh.PrivateKey {
+	return k.keypair
+}
+
+// Window returns the key window associated with the keypair.
+func (k *SubKey) Window() uint64 {
+	return k.window
+}
+
+// IsReplay marks a given replay tag as seen, and returns true iff the tag has
+// been seen previously under this sub-key (Test and Set).
+func (k *SubKey) IsReplay(rawTag []byte) bool {
+	// Treat all pathologically malformed tags as replays.
+	if len(rawTag) != TagLength {
+		return true
+	}
+	var tag [TagLength]byte
+	copy(tag[:], rawTag)
+
+	k.Lock()
+	defer k.Unlock()
+	if k.f.Entries() < k.f.MaxEntries() && !k.f.TestAndSet(tag[:]) {
+		k.writeBack[tag] = true
+		if len(k.writeBack) >= writeBackSize {
+			k.flush()
+		}
+		return false
+	}
+	if k.writeBack[tag] {
+		return true
+	}
+
+	// Slow path, either a false positive, a saturated filter, or a replay.
+	isReplay := false
+	if err := k.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(replayBucket))
+		isReplay = bkt.Get(tag[:]) != nil
+		return bkt.Put(tag[:], []byte{})
+	}); err != nil {
+		panic("BUG: mixkey: Failed to query the replay filter: " + err.Error())
+	}
+	return isReplay
+}
+
+// Flush writes the pending replay tags to disk.
+func (k *SubKey) Flush() {
+	k.Lock()
+	defer k.Unlock()
+	k.flush()
+}
+
+func (k *SubKey) flush() {
+	if len(k.writeBack) == 0 || k.db == nil {
+		return
+	}
+	if err := k.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(replayBucket))
+		for tag := range k.writeBack {
+			if err := bkt.Put(tag[:], []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		panic("BUG: mixkey: Failed to flush write-back cache: " + err.Error())
+	}
+	k.writeBack = make(map[[TagLength]byte]bool)
+}
+
+// Deref reduces the refcount by one, and closes the key if the refcount hits
+// 0, erasing it if its window has ended.
+func (k *SubKey) Deref() {
+	i := atomic.AddInt32(&k.refCount, -1)
+	if i == 0 {
+		k.forceClose()
+	} else if i < 0 {
+		panic("BUG: mixkey: Refcount is negative")
+	}
+}
+
+// Ref increases the refcount by one.
+func (k *SubKey) Ref() {
+	i := atomic.AddInt32(&k.refCount, 1)
+	if i <= 1 {
+		panic("BUG: mixkey: Refcount was 0 or negative")
+	}
+}
+
+func (k *SubKey) forceClose() {
+	k.Lock()
+	defer k.Unlock()
+	if k.db != nil {
+		f := k.db.Path()
+		if k.erase {
+			// The replay state is only useful while the key is, so it
+			// is discarded along with the key.
+			k.writeBack = nil
+		} else {
+			k.flush()
+			k.db.Sync()
+		}
+		k.db.Close()
+		k.db = nil
+		if k.erase {
+			// As with the server's mix keys, this is not "secure"
+			// deletion, that is a lost cause at this level.  Use FDE.
+			os.Remove(f)
+		}
+	}
+	if k.keypair != nil {
+		k.keypair.Reset()
+		k.keypair = nil
+	}
+}
+
+// newSubKey creates (or loads) the sub-key for the window in the provided
+// data directory, with w windows per epoch.
+func newSubKey(dataDir string, window, w uint64) (*SubKey, error) {
+	const (
+		versionKey = "version"
+		pkKey      = "privateKey"
+		windowKey  = "window"
+	)
+	var err error
+
+	k := &SubKey{
+		window:    window,
+		refCount:  1,
+		writeBack: make(map[[TagLength]byte]bool),
+	}
+	ln2 := epochFilterLn2
+	for n := w; n > 1 && ln2 > 20; n >>= 1 {
+		ln2--
+	}
+	if k.f, err = bloom.New(rand.Reader, ln2, 0.001); err != nil {
+		return nil, err
+	}
+
+	f := filepath.Join(dataDir, fmt.Sprintf(KeyFmt, window))
+	if k.db, err = bolt.Open(f, 0600, nil); err != nil {
+		return nil, err
+	}
+	if err = k.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		replayBkt, err := tx.CreateBucketIfNotExists([]byte(replayBucket))
+		if err != nil {
+			return err
+		}
+
+		if b := bkt.Get([]byte(versionKey)); b != nil {
+			if len(b) != 1 || b[0] != 0 {
+				return fmt.Errorf("mixkey: incompatible version: %d", uint(b[0]))
+			}
+			if b = bkt.Get([]byte(pkKey)); b == nil {
+				return fmt.Errorf("mixkey: db missing privateKey entry")
+			}
+			k.keypair = new(ecdh.PrivateKey)
+			if err = k.keypair.FromBytes(b); err != nil {
+				return err
+			}
+			if b = bkt.Get([]byte(windowKey)); len(b) != 8 || binary.LittleEndian.Uint64(b) != window {
+				return fmt.Errorf("mixkey: db window mismatch")
+			}
+
+			// Rebuild the bloom filter.
+			return replayBkt.ForEach(func(tag, v []byte) error {
+				k.f.TestAndSet(tag)
+				return nil
+			})
+		}
+
+		if k.keypair, err = ecdh.NewKeypair(rand.Reader); err != nil {
+			return err
+		}
+		var windowBytes [8]byte
+		binary.LittleEndian.PutUint64(windowBytes[:], window)
+		bkt.Put([]byte(versionKey), []byte{0})
+		bkt.Put([]byte(pkKey), k.keypair.Bytes())
+		return bkt.Put([]byte(windowKey), windowBytes[:])
+	}); err != nil {
+		k.db.Close()
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,132 @@
+// mixkey_test.go - Katzenpost sub-epoch mix key tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mixkey
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "mixkey_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const windows, ahead = 64, 2
+	length := WindowLength(windows)
+	start := epochtime.Epoch.Add(100*epochtime.Period + length/2)
+	w, till := Window(start.Add(length), windows)
+	assert.Equal(uint64(100*windows+1), w, "Window()")
+	assert.Equal(length/2, till, "Window(): till")
+
+	now := start
+	s := &Schedule{
+		dataDir: dir,
+		windows: windows,
+		ahead:   ahead,
+		grace:   time.Minute,
+		keys:    make(map[uint64]*SubKey),
+		now:     func() time.Time { return now },
+	}
+	defer s.Halt()
+	current, _ := Window(now, windows)
+	till, err = s.rotate()
+	assert.NoError(err)
+	assert.Equal(length/2, till, "rotate(): till")
+	assert.Len(s.PublicKeys(), ahead+1, "PublicKeys()")
+
+	k, ok := s.Get(current)
+	if !ok {
+		t.Fatal("Get(): no current key")
+	}
+	tag := make([]byte, TagLength)
+	assert.False(k.IsReplay(tag), "IsReplay(): first use")
+	assert.True(k.IsReplay(tag), "IsReplay(): replay")
+	assert.True(k.IsReplay(tag[1:]), "IsReplay(): malformed tag")
+	k.Deref()
+
+	// The key is kept for the grace period after its window.
+	now = start.Add(length / 2)
+	_, err = s.rotate()
+	assert.NoError(err)
+	k, ok = s.Get(current)
+	if assert.True(ok, "Get(): key erased within the grace period") {
+		k.Deref()
+	}
+	assert.Len(s.PublicKeys(), ahead+1, "PublicKeys(): expired key published")
+
+	// The key and its replay state are erased after the grace period.
+	now = now.Add(time.Minute)
+	_, err = s.rotate()
+	assert.NoError(err)
+	_, ok = s.Get(current)
+	assert.False(ok, "Get(): expired key kept")
+	_, err = os.Stat(filepath.Join(dir, fmt.Sprintf(KeyFmt, current)))
+	assert.True(os.IsNotExist(err), "expired key not unlinked")
+	files, err := filepath.Glob(filepath.Join(dir, KeyGlob))
+	assert.NoError(err)
+	assert.Len(files, ahead+1)
+}
+
+// benchmarkIsReplay measures the replay check of a key with windows key
+// windows per epoch, where windows is 1 for the current epoch long keys.
+func benchmarkIsReplay(b *testing.B, windows uint64) {
+	dir, err := ioutil.TempDir("", "mixkey_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k, err := newSubKey(dir, 0, windows)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer k.Deref()
+
+	tag := make([]byte, TagLength)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.LittleEndian.PutUint64(tag, uint64(i))
+		if k.IsReplay(tag) {
+			b.Fatal("IsReplay(): false positive")
+		}
+	}
+}
+
+func BenchmarkIsReplayEpoch(b *testing.B) {
+	benchmarkIsReplay(b, 1)
+}
+
+func BenchmarkIsReplayWindow12(b *testing.B) {
+	benchmarkIsReplay(b, 12)
+}
+
+func BenchmarkIsReplayWindow64(b *testing.B) {
+	benchmarkIsReplay(b, 64)
+}
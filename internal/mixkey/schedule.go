@@ -0,0 +1,203 @@
+// schedule.go - Katzenpost sub-epoch mix key schedule.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mixkey
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/worker"
+)
+
+// writeBackInterval is the interval at which the pending replay tags of
+// the sub-keys are written to disk.
+const writeBackInterval = 10 * time.Second
+
+// Schedule is the sub-epoch mix key schedule of a mix.  It holds the keys of
+// the current window and of the Ahead following windows, to be published
+// ahead of time, and erases each key once its window, plus Grace for clock
+// skew and packets in flight, has ended.
+type Schedule struct {
+	sync.Mutex
+	worker.Worker
+
+	dataDir string
+	windows uint64
+	ahead   uint64
+	grace   time.Duration
+	keys    map[uint64]*SubKey
+	now     func() time.Time
+}
+
+// Get returns the sub-key of the window, with a reference that must be
+// released with Deref, or false if the window has no key, either because it
+// has been erased or has not been generated yet.
+func (s *Schedule) Get(window uint64) (*SubKey, bool) {
+	s.Lock()
+	defer s.Unlock()
+	k, ok := s.keys[window]
+	if ok {
+		k.Ref()
+	}
+	return k, ok
+}
+
+// PublicKeys returns the public keys of the current and upcoming windows,
+// keyed by window, for publication in the descriptor.
+func (s *Schedule) PublicKeys() map[uint64]*ecdh.PublicKey {
+	s.Lock()
+	defer s.Unlock()
+	current, _ := Window(s.now(), s.windows)
+	ret := make(map[uint64]*ecdh.PublicKey)
+	for w, k := range s.keys {
+		if w >= current {
+			ret[w] = k.PublicKey()
+		}
+	}
+	return ret
+}
+
+// rotate generates the keys of the current and upcoming windows that are
+// missing, erases the keys of the windows that have ended, and returns the
+// time till the next rotation.
+func (s *Schedule) rotate() (time.Duration, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	current, till := Window(now, s.windows)
+	graceWindow, graceTill := Window(now.Add(-s.grace), s.windows)
+	for w, k := range s.keys {
+		if w < graceWindow {
+			k.erase = true
+			k.Deref()
+			delete(s.keys, w)
+		}
+	}
+	for w := current; w <= current+s.ahead; w++ {
+		if _, ok := s.keys[w]; ok {
+			continue
+		}
+		k, err := newSubKey(s.dataDir, w, s.windows)
+		if err != nil {
+			return 0, err
+		}
+		s.keys[w] = k
+	}
+	if graceWindow < current && graceTill < till {
+		till = graceTill
+	}
+	return till, nil
+}
+
+func (s *Schedule) worker() {
+	flush := time.NewTicker(writeBackInterval)
+	defer flush.Stop()
+
+	for {
+		till, err := s.rotate()
+		if err != nil {
+			// Retry, the current key is still usable.
+			till = writeBackInterval
+		}
+		t := time.NewTimer(till)
+		for rotate := false; !rotate; {
+			select {
+			case <-s.HaltCh():
+				t.Stop()
+				return
+			case <-flush.C:
+				s.flush()
+			case <-t.C:
+				rotate = true
+			}
+		}
+	}
+}
+
+func (s *Schedule) flush() {
+	s.Lock()
+	defer s.Unlock()
+	for _, k := range s.keys {
+		k.Flush()
+	}
+}
+
+// Halt stops the Schedule, and closes the keys, without erasing the keys of
+// windows that have not ended.
+func (s *Schedule) Halt() {
+	s.Worker.Halt()
+	s.Lock()
+	defer s.Unlock()
+	for w, k := range s.keys {
+		k.Deref()
+		delete(s.keys, w)
+	}
+}
+
+// New creates (or loads) the sub-epoch mix key schedule in the provided data
+// directory, with windows key windows per epoch, the keys of ahead windows
+// generated ahead of time, and each key kept for grace after its window.
+// The keys of windows that ended while the schedule was not running are
+// erased.
+func New(dataDir string, windows, ahead uint64, grace time.Duration) (*Schedule, error) {
+	if windows == 0 {
+		return nil, fmt.Errorf("mixkey: invalid number of windows: %v", windows)
+	}
+	s := &Schedule{
+		dataDir: dataDir,
+		windows: windows,
+		ahead:   ahead,
+		grace:   grace,
+		keys:    make(map[uint64]*SubKey),
+		now:     time.Now,
+	}
+	if err := s.load(); err != nil {
+		s.Halt()
+		return nil, err
+	}
+	if _, err := s.rotate(); err != nil {
+		s.Halt()
+		return nil, err
+	}
+	s.Go(s.worker)
+	return s, nil
+}
+
+// load opens the persisted sub-keys, so that the expired ones are erased by
+// the first rotation.
+func (s *Schedule) load() error {
+	files, err := filepath.Glob(filepath.Join(s.dataDir, KeyGlob))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		var w uint64
+		if _, err = fmt.Sscanf(filepath.Base(f), KeyFmt, &w); err != nil {
+			continue
+		}
+		k, err := newSubKey(s.dataDir, w, s.windows)
+		if err != nil {
+			return err
+		}
+		s.keys[w] = k
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// peerset.go - Katzenpost voting authority peer set changes.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package peerset implements signed proposals to change the voting
+// authority peer set, which take effect once endorsed by a threshold of
+// the current authorities.
+package peerset
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+)
+
+const proposalVersion = 0
+
+// Proposal is a proposed authority peer set.
+type Proposal struct {
+	// Version is the proposal format version.
+	Version int
+
+	// Epoch is the first epoch whose document is voted on by the new peer
+	// set.
+	Epoch uint64
+
+	// Authorities is the complete new authority set, including the
+	// proposer.
+	Authorities []*config.AuthorityPeer
+}
+
+// Threshold returns the number of signatures required on a document
+// produced by the new peer set, which is fixed by the authority as a
+// simple majority.
+func (p *Proposal) Threshold() int {
+	return Threshold(len(p.Authorities))
+}
+
+// Threshold returns the number of endorsements or signatures required from
+// a set of n authorities.
+func Threshold(n int) int {
+	return n/2 + 1
+}
+
+// ActivationTime returns when the authorities must switch to the new peer
+// set, which is the start of the epoch during which the document for Epoch
+// is voted on.
+func (p *Proposal) ActivationTime() time.Time {
+	return EpochStart(p.Epoch - 1)
+}
+
+// Contains returns true iff the authority with the identity key k is in
+// the new peer set.
+func (p *Proposal) Contains(k *eddsa.PublicKey) bool {
+	for _, v := range p.Authorities {
+		if v.IdentityPublicKey.Equal(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers returns the new peer set as seen by the authority with the
+// identity key self, which is the set without self.
+func (p *Proposal) Peers(self *eddsa.PublicKey) []*config.AuthorityPeer {
+	var peers []*config.AuthorityPeer
+	for _, v := range p.Authorities {
+		if !v.IdentityPublicKey.Equal(self) {
+			peers = append(peers, v)
+		}
+	}
+	return peers
+}
+
+func (p *Proposal) validate() error {
+	if p.Version != proposalVersion {
+		return fmt.Errorf("peerset: unsupported proposal version %v", p.Version)
+	}
+	if p.Epoch == 0 {
+		return errors.New("peerset: proposal is missing Epoch")
+	}
+	if len(p.Authorities) == 0 {
+		return errors.New("peerset: proposal has no Authorities")
+	}
+	seen := make(map[[eddsa.PublicKeySize]byte]bool)
+	for _, v := range p.Authorities {
+		if v.IdentityPublicKey == nil || v.LinkPublicKey == nil {
+			return errors.New("peerset: proposal has an authority with a missing key")
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		id := v.IdentityPublicKey.ByteArray()
+		if seen[id] {
+			return fmt.Errorf("peerset: authority %v is present more than once", v.IdentityPublicKey)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// Sign signs the proposal with the proposing authority's identity key, and
+// returns it as a single line of Base64.  The signature expires at the end
+// of the epoch that the proposal takes effect.
+func (p *Proposal) Sign(identityKey *eddsa.PrivateKey) (string, error) {
+	p.Version = proposalVersion
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	signed, err := cert.Sign(identityKey, payload, EpochStart(p.Epoch+1).Unix())
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signed), nil
+}
+
+// Endorse adds the identity key's signature to the proposal s.
+func Endorse(identityKey *eddsa.PrivateKey, s string) (string, error) {
+	signed, err := decode(s)
+	if err != nil {
+		return "", err
+	}
+	if signed, err = cert.SignMulti(identityKey, signed); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signed), nil
+}
+
+// Parse decodes the proposal s without verifying any signatures, and
+// returns the proposal and the identities of the signers, skipping the
+// malformed ones.
+func Parse(s string) (*Proposal, []*eddsa.PublicKey, error) {
+	signed, err := decode(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := cert.GetCertified(signed)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := new(Proposal)
+	if err = json.Unmarshal(payload, p); err != nil {
+		return nil, nil, err
+	}
+	if err = p.validate(); err != nil {
+		return nil, nil, err
+	}
+	sigs, err := cert.GetSignatures(signed)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signers []*eddsa.PublicKey
+	for _, v := range sigs {
+		// A malformed endorsement only fails to count, as with one that
+		// does not verify.
+		k := new(eddsa.PublicKey)
+		if k.FromBytes(v.Identity) != nil {
+			continue
+		}
+		signers = append(signers, k)
+	}
+	return p, signers, nil
+}
+
+// Verify decodes the proposal s, and verifies that it is endorsed by a
+// threshold of the current authority set.
+func Verify(s string, current []*eddsa.PublicKey) (*Proposal, error) {
+	p, _, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := decode(s)
+	if err != nil {
+		return nil, err
+	}
+	verifiers := make([]cert.Verifier, 0, len(current))
+	for _, v := range current {
+		verifiers = append(verifiers, v)
+	}
+	if _, good, _, err := cert.VerifyThreshold(verifiers, Threshold(len(current)), signed); err != nil {
+		return nil, fmt.Errorf("peerset: proposal endorsed by %v of %v authorities: %v", len(good), len(current), err)
+	}
+	return p, nil
+}
+
+// LoadPeers loads the [[Authorities]] of the TOML file f, which may be an
+// authority config file.  Every other section of the file is ignored.
+func LoadPeers(f string) ([]*config.AuthorityPeer, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Authorities []*config.AuthorityPeer
+	}
+	if _, err = toml.Decode(string(b), &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Authorities) == 0 {
+		return nil, fmt.Errorf("peerset: no [[Authorities]] in '%v'", f)
+	}
+	return cfg.Authorities, nil
+}
+
+// EpochStart returns the start time of the epoch e.
+func EpochStart(e uint64) time.Time {
+	return epochtime.Epoch.Add(time.Duration(e) * epochtime.Period)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+}
@@ -0,0 +1,82 @@
+// peerset_test.go - Katzenpost voting authority peer set change tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package peerset
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProposal(t *testing.T) {
+	assert := assert.New(t)
+
+	// Three current authorities, plus one that is joining.
+	var keys []*eddsa.PrivateKey
+	var peers []*config.AuthorityPeer
+	for i := 0; i < 4; i++ {
+		identityKey, err := eddsa.NewKeypair(rand.Reader)
+		assert.NoError(err)
+		linkKey, err := ecdh.NewKeypair(rand.Reader)
+		assert.NoError(err)
+		keys = append(keys, identityKey)
+		peers = append(peers, &config.AuthorityPeer{
+			IdentityPublicKey: identityKey.PublicKey(),
+			LinkPublicKey:     linkKey.PublicKey(),
+			Addresses:         []string{fmt.Sprintf("127.0.0.1:%d", 30000+i)},
+		})
+	}
+	current := []*eddsa.PublicKey{keys[0].PublicKey(), keys[1].PublicKey(), keys[2].PublicKey()}
+
+	epoch, _, _ := epochtime.Now()
+	p := &Proposal{Epoch: epoch + 3, Authorities: peers}
+	assert.Equal(3, p.Threshold())
+	assert.Equal(EpochStart(epoch+2), p.ActivationTime())
+	assert.Len(p.Peers(keys[0].PublicKey()), 3)
+
+	s, err := p.Sign(keys[0])
+	assert.NoError(err)
+	_, err = Verify(s, current)
+	assert.Error(err, "Verify() with 1 of 3 endorsements")
+
+	// An endorsement by the joining authority does not count.
+	s2, err := Endorse(keys[3], s)
+	assert.NoError(err)
+	_, err = Verify(s2, current)
+	assert.Error(err, "Verify() with 1 of 3 endorsements, and a non-member")
+
+	s, err = Endorse(keys[1], s)
+	assert.NoError(err)
+	accepted, err := Verify(s, current)
+	assert.NoError(err)
+	assert.Equal(epoch+3, accepted.Epoch)
+	assert.True(accepted.Contains(keys[3].PublicKey()))
+
+	_, signers, err := Parse(s)
+	assert.NoError(err)
+	assert.Len(signers, 2)
+
+	p = &Proposal{Epoch: epoch + 3, Authorities: append(peers, peers[0])}
+	_, err = p.Sign(keys[0])
+	assert.Error(err, "Sign() with a duplicate authority")
+}
@@ -0,0 +1,114 @@
+// commands.go - Katzenpost provider registration management commands.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package registration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+)
+
+const (
+	cmdInvitationMint   = "INVITATION_MINT"
+	cmdInvitationList   = "INVITATION_LIST"
+	cmdInvitationRevoke = "INVITATION_REVOKE"
+
+	// maxMint is the maximum number of invitations minted at once.
+	maxMint = 1000
+)
+
+// RegisterCommands registers the invitation commands with the management
+// server m.
+//
+//	INVITATION_MINT [count] [expires=<RFC 3339 time or duration>] [notes]
+//	                                   Mint invitations, 1 by default, and
+//	                                   list their codes.
+//	INVITATION_LIST                    List the unused invitations.
+//	INVITATION_REVOKE <id>             Revoke an unused invitation.
+func RegisterCommands(m *thwack.Server, s *Invitations) {
+	m.RegisterCommand(cmdInvitationMint, func(c *thwack.Conn, l string) error {
+		args := strings.Fields(l)[1:]
+		n := 1
+		if len(args) > 0 {
+			if v, err := strconv.Atoi(args[0]); err == nil {
+				if v < 1 || v > maxMint {
+					return writeError(c, fmt.Errorf("registration: invalid count %v", v))
+				}
+				n, args = v, args[1:]
+			}
+		}
+		var expires time.Time
+		if len(args) > 0 && strings.HasPrefix(args[0], "expires=") {
+			v := strings.TrimPrefix(args[0], "expires=")
+			if d, err := time.ParseDuration(v); err == nil {
+				expires = time.Now().Add(d)
+			} else if expires, err = time.Parse(time.RFC3339, v); err != nil {
+				return writeError(c, fmt.Errorf("registration: invalid expiry '%v'", v))
+			}
+			args = args[1:]
+		}
+		codes, err := s.Mint(n, expires, strings.Join(args, " "))
+		if err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Minted %v invitation(s).", n)
+		return management.WriteLines(c, codes, thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdInvitationList, func(c *thwack.Conn, l string) error {
+		invitations, err := s.List()
+		if err != nil {
+			return writeError(c, err)
+		}
+		now := time.Now()
+		var lines []string
+		for _, i := range invitations {
+			expires := "never"
+			if !i.Expires.IsZero() {
+				expires = i.Expires.UTC().Format(time.RFC3339)
+				if i.Expired(now) {
+					expires += " (expired)"
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%v created=%v expires=%v notes=%q",
+				i.ID, i.Created.UTC().Format(time.RFC3339), expires, i.Notes))
+		}
+		return management.WriteLines(c, lines, thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdInvitationRevoke, func(c *thwack.Conn, l string) error {
+		sp := strings.Fields(l)
+		if len(sp) != 2 {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		if err := s.Revoke(sp[1]); err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Revoked invitation %v.", sp[1])
+		return c.WriteReply(thwack.StatusOk)
+	})
+}
+
+// writeError sends err as the body of a failure reply, as thwack status
+// lines carry no detail.
+func writeError(c *thwack.Conn, err error) error {
+	return management.WriteLines(c, []string{err.Error()}, thwack.StatusTransactionFailed)
+}
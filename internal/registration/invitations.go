@@ -0,0 +1,247 @@
+// invitations.go - Katzenpost provider registration invitations.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package registration implements user registration with a provider that
+// can be restricted to holders of single-use invitation codes, over HTTP
+// with per-address rate limits, and an audit log of the registrations.
+package registration
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	invitationsBucket = "invitations"
+
+	// codeLength is the number of random bytes of an invitation code.
+	codeLength = 20
+
+	// idLength is the number of bytes of the code's hash that identify an
+	// invitation.
+	idLength = 8
+)
+
+var (
+	// ErrInvalidInvitation is the error returned for an invitation code that
+	// is unknown, already used or expired.
+	ErrInvalidInvitation = errors.New("registration: invalid invitation")
+
+	// ErrNotFound is the error returned when there is no invitation with an
+	// ID.
+	ErrNotFound = errors.New("registration: no such invitation")
+
+	codeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Invitation is an unused invitation.  Only the hash of its code is stored,
+// so the codes can not be recovered from the database.
+type Invitation struct {
+	// ID identifies the invitation without revealing its code.
+	ID string `json:"-"`
+
+	// Created is when the invitation was minted.
+	Created time.Time
+
+	// Expires is when the invitation expires, if set.
+	Expires time.Time
+
+	// Notes are free form notes about the invitation.
+	Notes string
+}
+
+// Expired returns true iff the invitation has expired as of now.
+func (i *Invitation) Expired(now time.Time) bool {
+	return !i.Expires.IsZero() && !now.Before(i.Expires)
+}
+
+// InvitationID returns the ID of the invitation with the code.
+func InvitationID(code string) string {
+	h := codeHash(code)
+	return hex.EncodeToString(h[:idLength])
+}
+
+func codeHash(code string) []byte {
+	h := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(code))))
+	return h[:]
+}
+
+// Invitations is a bolt backed store of invitations.
+type Invitations struct {
+	db *bolt.DB
+}
+
+// Close closes the store.
+func (s *Invitations) Close() {
+	s.db.Sync()
+	s.db.Close()
+}
+
+// Mint creates n invitations, and returns their codes.  Expired invitations
+// are removed.
+func (s *Invitations) Mint(n int, expires time.Time, notes string) ([]string, error) {
+	now := time.Now()
+	var codes []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(invitationsBucket))
+		if err := sweep(bkt, now); err != nil {
+			return err
+		}
+		b, err := json.Marshal(&Invitation{Created: now, Expires: expires, Notes: notes})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			var raw [codeLength]byte
+			if _, err := rand.Reader.Read(raw[:]); err != nil {
+				return err
+			}
+			code := codeEncoding.EncodeToString(raw[:])
+			if err := bkt.Put(codeHash(code), b); err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func sweep(bkt *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := bkt.ForEach(func(k, v []byte) error {
+		i := new(Invitation)
+		if err := json.Unmarshal(v, i); err != nil {
+			return err
+		}
+		if i.Expired(now) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err = bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check returns ErrInvalidInvitation unless code is the code of an
+// unexpired invitation.
+func (s *Invitations) Check(code string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return check(tx.Bucket([]byte(invitationsBucket)), code)
+	})
+}
+
+func check(bkt *bolt.Bucket, code string) error {
+	v := bkt.Get(codeHash(code))
+	if v == nil {
+		return ErrInvalidInvitation
+	}
+	i := new(Invitation)
+	if err := json.Unmarshal(v, i); err != nil {
+		return err
+	}
+	if i.Expired(time.Now()) {
+		return ErrInvalidInvitation
+	}
+	return nil
+}
+
+// Redeem uses up the invitation with the code, or returns
+// ErrInvalidInvitation.
+func (s *Invitations) Redeem(code string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(invitationsBucket))
+		if err := check(bkt, code); err != nil {
+			return err
+		}
+		return bkt.Delete(codeHash(code))
+	})
+}
+
+// List returns the unused invitations, oldest first.
+func (s *Invitations) List() ([]*Invitation, error) {
+	var invitations []*Invitation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(invitationsBucket)).ForEach(func(k, v []byte) error {
+			i := new(Invitation)
+			if err := json.Unmarshal(v, i); err != nil {
+				return err
+			}
+			i.ID = hex.EncodeToString(k[:idLength])
+			invitations = append(invitations, i)
+			return nil
+		})
+	})
+	sort.SliceStable(invitations, func(a, b int) bool {
+		return invitations[a].Created.Before(invitations[b].Created)
+	})
+	return invitations, err
+}
+
+// Revoke removes the unused invitation with the ID.
+func (s *Invitations) Revoke(id string) error {
+	prefix, err := hex.DecodeString(id)
+	if err != nil || len(prefix) != idLength {
+		return fmt.Errorf("registration: invalid invitation ID '%v'", id)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(invitationsBucket))
+		c := bkt.Cursor()
+		k, _ := c.Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return ErrNotFound
+		}
+		return bkt.Delete(k)
+	})
+}
+
+// NewInvitations opens (or creates) the invitation store backed by the bolt
+// database f.
+func NewInvitations(f string) (*Invitations, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("registration: failed to open '%v': %v", f, err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(invitationsBucket))
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Invitations{db: db}, nil
+}
@@ -0,0 +1,187 @@
+// registrar.go - Katzenpost provider user registration.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package registration
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+)
+
+const (
+	cmdAddUser         = "ADD_USER"
+	cmdRemoveUser      = "REMOVE_USER"
+	cmdSetUserIdentity = "SET_USER_IDENTITY"
+)
+
+var (
+	// ErrInvalidRequest is the error returned for a registration with an
+	// invalid user name or key.
+	ErrInvalidRequest = errors.New("registration: invalid user or key")
+
+	// ErrRejected is the error returned when the provider refuses to add
+	// the user, usually because the user already exists.
+	ErrRejected = errors.New("registration: user rejected by the provider")
+)
+
+// Request is a registration request.
+type Request struct {
+	// User is the user name.
+	User string
+
+	// LinkKey is the user's link key.
+	LinkKey *ecdh.PublicKey
+
+	// IdentityKey is the user's identity key, if any.
+	IdentityKey *ecdh.PublicKey
+
+	// Invitation is the invitation code.
+	Invitation string
+}
+
+// Registrar adds users to a provider through its management socket.
+type Registrar struct {
+	sync.Mutex
+
+	mgmtSocket  string
+	invitations *Invitations
+	audit       *AuditLog
+}
+
+// Register registers the user of the request req, which came from source,
+// and records it in the audit log.  The request must carry a valid
+// invitation code if the Registrar has invitations, which is used up once
+// the user is added.
+func (r *Registrar) Register(req *Request, source string) error {
+	err := r.register(req)
+	var id string
+	if r.invitations != nil {
+		id = InvitationID(req.Invitation)
+	}
+	r.audit.record(source, req.User, id, err)
+	return err
+}
+
+func (r *Registrar) register(req *Request) error {
+	if !validUser(req.User) || req.LinkKey == nil {
+		return ErrInvalidRequest
+	}
+
+	// Registrations are serialized, so that an invitation is only used once.
+	r.Lock()
+	defer r.Unlock()
+
+	if r.invitations != nil {
+		if err := r.invitations.Check(req.Invitation); err != nil {
+			return err
+		}
+	}
+	if err := r.query(fmt.Sprintf("%v %v %v", cmdAddUser, req.User, req.LinkKey)); err != nil {
+		return err
+	}
+	if req.IdentityKey != nil {
+		if err := r.query(fmt.Sprintf("%v %v %v", cmdSetUserIdentity, req.User, req.IdentityKey)); err != nil {
+			r.query(cmdRemoveUser + " " + req.User)
+			return err
+		}
+	}
+	if r.invitations != nil {
+		return r.invitations.Redeem(req.Invitation)
+	}
+	return nil
+}
+
+// query issues the command cmd to the provider, and maps the failures of
+// the command to ErrInvalidRequest and ErrRejected.
+func (r *Registrar) query(cmd string) error {
+	_, err := management.Query(r.mgmtSocket, cmd)
+	if e, ok := err.(*textproto.Error); ok {
+		if e.Code == int(thwack.StatusSyntaxError) {
+			return ErrInvalidRequest
+		}
+		return ErrRejected
+	}
+	return err
+}
+
+// validUser returns true if user can be passed to the provider's management
+// interface as an argument.
+func validUser(user string) bool {
+	return user != "" && strings.IndexFunc(user, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+// NewRegistrar returns a Registrar that adds users through the provider's
+// management socket mgmtSocket.  invitations and audit are optional.
+func NewRegistrar(mgmtSocket string, invitations *Invitations, audit *AuditLog) *Registrar {
+	return &Registrar{
+		mgmtSocket:  mgmtSocket,
+		invitations: invitations,
+		audit:       audit,
+	}
+}
+
+// AuditLog is a log of the registration attempts, one per line.  The keys
+// of the users and the invitation codes are not recorded, only the IDs of
+// the invitations.
+type AuditLog struct {
+	sync.Mutex
+
+	f *os.File
+}
+
+// Close closes the log.
+func (a *AuditLog) Close() {
+	a.f.Close()
+}
+
+func (a *AuditLog) record(source, user, invitationID string, err error) {
+	if a == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	if invitationID == "" {
+		invitationID = "none"
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	fmt.Fprintf(a.f, "%v source=%v user=%q invitation=%v result=%q\n",
+		time.Now().UTC().Format(time.RFC3339), source, user, invitationID, result)
+}
+
+// OpenAuditLog opens (or creates) the audit log f for appending.
+func OpenAuditLog(f string) (*AuditLog, error) {
+	fd, err := os.OpenFile(f, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("registration: failed to open the audit log: %v", err)
+	}
+	return &AuditLog{f: fd}, nil
+}
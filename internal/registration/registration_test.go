@@ -0,0 +1,218 @@
+// registration_test.go - Katzenpost provider registration tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package registration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/server/registration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvitations(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewInvitations(filepath.Join(dir, "invitations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	codes, err := s.Mint(2, time.Time{}, "for friends")
+	assert.NoError(err, "Mint")
+	assert.Len(codes, 2)
+	expired, err := s.Mint(1, time.Now().Add(-time.Second), "")
+	assert.NoError(err, "Mint: expired")
+
+	assert.NoError(s.Check(strings.ToLower(codes[0])), "Check: codes are case insensitive")
+	assert.Equal(ErrInvalidInvitation, s.Check("AAAA"), "Check: unknown code")
+	assert.Equal(ErrInvalidInvitation, s.Check(expired[0]), "Check: expired code")
+
+	assert.NoError(s.Redeem(codes[0]), "Redeem")
+	assert.Equal(ErrInvalidInvitation, s.Redeem(codes[0]), "Redeem: used code")
+
+	// Minting sweeps the expired invitation.
+	_, err = s.Mint(1, time.Time{}, "")
+	assert.NoError(err, "Mint")
+	invitations, err := s.List()
+	assert.NoError(err, "List")
+	if assert.Len(invitations, 2) {
+		assert.Equal(InvitationID(codes[1]), invitations[0].ID)
+		assert.Equal("for friends", invitations[0].Notes)
+	}
+
+	assert.NoError(s.Revoke(InvitationID(codes[1])), "Revoke")
+	assert.Equal(ErrNotFound, s.Revoke(InvitationID(codes[1])), "Revoke: revoked invitation")
+	assert.Equal(ErrInvalidInvitation, s.Check(codes[1]), "Check: revoked code")
+}
+
+// fakeProvider is a provider management socket that keeps the users in
+// memory.
+type fakeProvider struct {
+	sync.Mutex
+
+	identities map[string]string
+}
+
+func (p *fakeProvider) identity(user string) string {
+	p.Lock()
+	defer p.Unlock()
+	return p.identities[user]
+}
+
+func (p *fakeProvider) register(m *thwack.Server) {
+	m.RegisterCommand(cmdAddUser, func(c *thwack.Conn, l string) error {
+		p.Lock()
+		defer p.Unlock()
+		sp := strings.Split(l, " ")
+		if len(sp) != 3 {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		if _, ok := p.identities[sp[1]]; ok {
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+		p.identities[sp[1]] = ""
+		return c.WriteReply(thwack.StatusOk)
+	})
+	m.RegisterCommand(cmdSetUserIdentity, func(c *thwack.Conn, l string) error {
+		p.Lock()
+		defer p.Unlock()
+		sp := strings.Split(l, " ")
+		p.identities[sp[1]] = sp[2]
+		return c.WriteReply(thwack.StatusOk)
+	})
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logBackend, err := log.New("", "ERROR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := &fakeProvider{identities: make(map[string]string)}
+	mgmtSocket := filepath.Join(dir, "management_sock")
+	m, err := management.New(mgmtSocket, "test", logBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.register(m)
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Halt()
+
+	invitations, err := NewInvitations(filepath.Join(dir, "invitations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer invitations.Close()
+	auditFile := filepath.Join(dir, "audit.log")
+	audit, err := OpenAuditLog(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	r := NewRegistrar(mgmtSocket, invitations, audit)
+	s, err := NewServer(r, &ServerConfig{Addresses: []string{"127.0.0.1:0"}, Rate: 1, Burst: 3}, logBackend.GetLogger("registration"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Halt()
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := invitations.Mint(1, time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(s *Server, user, code string) int {
+		u := "http://" + s.listeners[0].Addr().String() + registration.URLBase
+		resp, err := http.PostForm(u, url.Values{
+			registration.VersionField:     {registration.Version},
+			registration.CommandField:     {registration.RegisterLinkAndIdentityCommand},
+			registration.UserField:        {user},
+			registration.LinkKeyField:     {linkKey.PublicKey().String()},
+			registration.IdentityKeyField: {identityKey.PublicKey().String()},
+			InvitationField:               {code},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusForbidden, post(s, "alice", "AAAA"), "no invitation")
+	assert.Equal(http.StatusOK, post(s, "alice", codes[0]), "registration")
+	assert.Equal(identityKey.PublicKey().String(), users.identity("alice"))
+	assert.Equal(http.StatusForbidden, post(s, "bob", codes[0]), "used invitation")
+	assert.Equal(http.StatusTooManyRequests, post(s, "bob", codes[0]), "rate limit")
+
+	// Without invitations or rate limits.
+	s2, err := NewServer(NewRegistrar(mgmtSocket, nil, audit), &ServerConfig{Addresses: []string{"127.0.0.1:0"}}, logBackend.GetLogger("registration"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Halt()
+	assert.Equal(http.StatusConflict, post(s2, "alice", ""), "existing user")
+	assert.Equal(http.StatusBadRequest, post(s2, "b ob", ""), "invalid user")
+	assert.Equal(http.StatusOK, post(s2, "bob", ""), "registration")
+
+	// The audit log has every attempt, but no keys or codes.
+	b, err := ioutil.ReadFile(auditFile)
+	assert.NoError(err, "ReadFile")
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(lines, 6)
+	assert.Contains(lines[1], `source=http:127.0.0.1 user="alice" invitation=`+InvitationID(codes[0]))
+	assert.Contains(lines[1], `result="ok"`)
+	assert.Contains(lines[5], `user="bob" invitation=none result="ok"`)
+	for _, v := range []string{linkKey.PublicKey().String(), identityKey.PublicKey().String(), codes[0]} {
+		assert.NotContains(string(b), v)
+	}
+}
@@ -0,0 +1,259 @@
+// server.go - Katzenpost provider registration HTTP server.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package registration
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/registration"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// InvitationField is the form field of the invitation code, in addition
+	// to the fields of the provider's registration protocol.
+	InvitationField = "invitation"
+
+	shutdownTimeout = 10 * time.Second
+	pruneInterval   = time.Minute
+)
+
+// ServerConfig is the configuration of a Server.
+type ServerConfig struct {
+	// Addresses are the addresses to listen on.
+	Addresses []string
+
+	// CertFile and KeyFile are the PEM encoded TLS certificate and key, if
+	// the Server is to use TLS.
+	CertFile string
+	KeyFile  string
+
+	// Rate is the number of registration attempts allowed per address and
+	// per hour on average, and Burst the number allowed at once.  A Rate of
+	// 0 disables the limit.
+	Rate  float64
+	Burst int
+}
+
+// Server serves the provider's registration protocol over HTTP, with
+// registrations done by a Registrar.
+type Server struct {
+	r       *Registrar
+	log     *logging.Logger
+	limiter *addrLimiter
+
+	listeners []net.Listener
+	servers   []*http.Server
+}
+
+// Halt stops the Server.
+func (s *Server) Halt() {
+	for _, v := range s.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		v.Shutdown(ctx)
+		cancel()
+	}
+}
+
+// ServeHTTP serves a registration request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != registration.URLBase {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if s.limiter != nil && !s.limiter.allow(host) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	req, err := parseRequest(r)
+	if err == nil {
+		err = s.r.Register(req, "http:"+host)
+	}
+	switch err {
+	case nil:
+		s.log.Noticef("Registered user: %v", req.User)
+		w.Write([]byte("OK\n"))
+	case ErrInvalidRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrInvalidInvitation:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrRejected:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		s.log.Errorf("Failed to register user: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func parseRequest(r *http.Request) (*Request, error) {
+	if r.FormValue(registration.VersionField) != registration.Version {
+		return nil, ErrInvalidRequest
+	}
+	req := &Request{
+		User:       r.FormValue(registration.UserField),
+		LinkKey:    new(ecdh.PublicKey),
+		Invitation: r.FormValue(InvitationField),
+	}
+	if err := req.LinkKey.FromString(r.FormValue(registration.LinkKeyField)); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	switch r.FormValue(registration.CommandField) {
+	case registration.RegisterLinkCommand:
+	case registration.RegisterLinkAndIdentityCommand:
+		req.IdentityKey = new(ecdh.PublicKey)
+		if err := req.IdentityKey.FromString(r.FormValue(registration.IdentityKeyField)); err != nil {
+			return nil, ErrInvalidRequest
+		}
+	default:
+		return nil, ErrInvalidRequest
+	}
+	return req, nil
+}
+
+// NewServer starts serving registrations done by r over HTTP, as configured
+// by cfg.
+func NewServer(r *Registrar, cfg *ServerConfig, log *logging.Logger) (*Server, error) {
+	s := &Server{
+		r:   r,
+		log: log,
+	}
+	if cfg.Rate > 0 {
+		if cfg.Burst < 1 {
+			return nil, errors.New("registration: the burst must be at least 1")
+		}
+		s.limiter = newAddrLimiter(cfg.Rate/3600, cfg.Burst)
+	}
+
+	var tlsCfg *tls.Config
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	for _, addr := range cfg.Addresses {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, v := range s.listeners {
+				v.Close()
+			}
+			return nil, err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	for _, l := range s.listeners {
+		srv := &http.Server{Handler: s, TLSConfig: tlsCfg}
+		s.servers = append(s.servers, srv)
+		go func(l net.Listener) {
+			var err error
+			if tlsCfg != nil {
+				log.Noticef("Serving registrations on: https://%v%v", l.Addr(), registration.URLBase)
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				log.Noticef("Serving registrations on: http://%v%v", l.Addr(), registration.URLBase)
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				log.Errorf("Failed to serve registrations: %v", err)
+			}
+		}(l)
+	}
+	return s, nil
+}
+
+// addrLimiter is a token bucket per address, which allows burst requests
+// at once, and rate requests per second on average.
+type addrLimiter struct {
+	sync.Mutex
+
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *addrLimiter) allow(addr string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > pruneInterval {
+		l.prune(now)
+	}
+	b, ok := l.buckets[addr]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[addr] = b
+	}
+	b.refill(now, l.rate, l.burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the addresses whose buckets are full again, as they are
+// no different from a new bucket.
+func (l *addrLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.refill(now, l.rate, l.burst); b.tokens >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastPrune = now
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+func newAddrLimiter(rate float64, burst int) *addrLimiter {
+	return &addrLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
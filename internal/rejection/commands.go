@@ -0,0 +1,45 @@
+// commands.go - Katzenpost authority descriptor rejection commands.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rejection
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+)
+
+const cmdRejectionList = "REJECTION_LIST"
+
+// RegisterCommands registers the descriptor rejection commands with the
+// management server m.
+//
+//	REJECTION_LIST                     List the rejection counts by code,
+//	                                   and the most recent rejections.
+func RegisterCommands(m *thwack.Server, l *Log) {
+	m.RegisterCommand(cmdRejectionList, func(c *thwack.Conn, _ string) error {
+		counts := l.Counts()
+		lines := []string{fmt.Sprintf("%v=%v %v=%v %v=%v",
+			CodeForbidden, counts[CodeForbidden], CodeInvalid, counts[CodeInvalid], CodeConflict, counts[CodeConflict])}
+		for _, v := range l.Recent() {
+			lines = append(lines, fmt.Sprintf("%v %v %v key=%q %v",
+				v.Time.UTC().Format(time.RFC3339), v.Peer, v.Code, v.IdentityKey, v.Reason))
+		}
+		return management.WriteLines(c, lines, thwack.StatusOk)
+	})
+}
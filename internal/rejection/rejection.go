@@ -0,0 +1,127 @@
+// rejection.go - Katzenpost authority descriptor rejections.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package rejection records the descriptor uploads that an authority
+// rejects, and why.
+//
+// The authority server only reports a rejection to the uploading node as a
+// bare post_descriptor_status code, and logs the reason, so the reasons are
+// recovered from the server's log, which is passed through a Tee.
+package rejection
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The rejection codes, as returned in the post_descriptor_status command.
+const (
+	CodeForbidden = "Forbidden"
+	CodeInvalid   = "Invalid"
+	CodeConflict  = "Conflict"
+)
+
+// maxRecent is the number of recent rejections that are kept.
+const maxRecent = 128
+
+var (
+	peerRe = regexp.MustCompile(`: Peer (\S+): (.*)$`)
+	keyRe  = regexp.MustCompile(`^Identity key '([^']*)'`)
+)
+
+// Rejection is a rejected descriptor upload.
+type Rejection struct {
+	// Time is when the rejection was recorded.
+	Time time.Time
+
+	// Peer is the address of the uploading node.
+	Peer string
+
+	// IdentityKey is the uploaded descriptor's identity key, if it was
+	// parsed.
+	IdentityKey string
+
+	// Code is the code returned to the uploading node.
+	Code string
+
+	// Reason is the server's description of the rejection.
+	Reason string
+}
+
+// Parse parses a line of the authority server's log, and returns the
+// rejection that it records, if any.
+func Parse(line string) (*Rejection, bool) {
+	m := peerRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	r := &Rejection{Peer: m[1], Reason: m[2]}
+	switch {
+	case strings.HasPrefix(r.Reason, "Invalid descriptor"):
+		r.Code = CodeInvalid
+	case strings.HasPrefix(r.Reason, "Identity key '") && (strings.HasSuffix(r.Reason, "not authorized") || strings.Contains(r.Reason, "' is not link key '")):
+		r.Code = CodeForbidden
+		r.IdentityKey = keyRe.FindStringSubmatch(r.Reason)[1]
+	case strings.HasPrefix(r.Reason, "Rejected probably a conflict"):
+		r.Code = CodeConflict
+	default:
+		return nil, false
+	}
+	return r, true
+}
+
+// Log is the record of the rejected descriptor uploads, with a count of
+// rejections by code, and the most recent rejections.
+type Log struct {
+	sync.Mutex
+
+	counts map[string]uint64
+	recent []*Rejection
+}
+
+// Record records the rejection r.
+func (l *Log) Record(r *Rejection) {
+	l.Lock()
+	defer l.Unlock()
+	if l.counts == nil {
+		l.counts = make(map[string]uint64)
+	}
+	l.counts[r.Code]++
+	l.recent = append(l.recent, r)
+	if len(l.recent) > maxRecent {
+		l.recent = l.recent[len(l.recent)-maxRecent:]
+	}
+}
+
+// Counts returns the number of rejections by code.
+func (l *Log) Counts() map[string]uint64 {
+	l.Lock()
+	defer l.Unlock()
+	ret := make(map[string]uint64)
+	for _, v := range []string{CodeForbidden, CodeInvalid, CodeConflict} {
+		ret[v] = l.counts[v]
+	}
+	return ret
+}
+
+// Recent returns the most recent rejections, oldest first.
+func (l *Log) Recent() []*Rejection {
+	l.Lock()
+	defer l.Unlock()
+	return append([]*Rejection{}, l.recent...)
+}
@@ -0,0 +1,81 @@
+// rejection_test.go - Katzenpost authority descriptor rejection tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rejection
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTee(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rejection_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logBackend, err := log.New("", "ERROR", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := new(Log)
+	f := filepath.Join(dir, "authority.log")
+	tee, err := NewTee(f, l, logBackend.GetLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Log as the server does, through the Tee's path.
+	svrLog, err := log.New(tee.Path(), "DEBUG", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := svrLog.GetLogger("authority")
+	s.Errorf("Peer %v: Identity key '%v' not authorized", "192.0.2.1:1234", "AAAA")
+	s.Errorf("Peer %v: Invalid descriptor epoch '%v'", "192.0.2.2:1234", 7)
+	s.Errorf("Peer %v: Rejected probably a conflict: %v", "192.0.2.3:1234", "descriptor already present")
+	s.Debugf("Peer %v: Accepted descriptor for epoch %v: '%v'", "192.0.2.4:1234", 7, "desc")
+
+	for i := 0; i < 100 && len(l.Recent()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tee.Close()
+
+	assert.Equal(map[string]uint64{CodeForbidden: 1, CodeInvalid: 1, CodeConflict: 1}, l.Counts())
+	recent := l.Recent()
+	if assert.Len(recent, 3) {
+		assert.Equal("192.0.2.1:1234", recent[0].Peer)
+		assert.Equal("AAAA", recent[0].IdentityKey)
+		assert.Equal(CodeInvalid, recent[1].Code)
+		assert.Equal(CodeConflict, recent[2].Code)
+	}
+	b, err := ioutil.ReadFile(f)
+	assert.NoError(err)
+	assert.Contains(string(b), fmt.Sprintf("Peer %v: Accepted descriptor", "192.0.2.4:1234"), "Tee: log not passed through")
+
+	_, ok := Parse("12:00:00.000 ERRO authority: Peer 192.0.2.1:1234: Failed to retreive document for epoch '7': no document")
+	assert.False(ok, "Parse(): not a rejection")
+}
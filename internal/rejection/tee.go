@@ -0,0 +1,129 @@
+// tee.go - Katzenpost authority server log tee.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rejection
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/worker"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// drainTimeout is how long the server's log is drained for on Close.
+const drainTimeout = 100 * time.Millisecond
+
+// Tee passes the authority server's log through to the log file, and
+// records the descriptor rejections that it logs.  The server is pointed at
+// the Tee with its Logging.File set to Path, which works for as long as the
+// Tee is open, across server restarts and log rotations.
+type Tee struct {
+	sync.Mutex
+	worker.Worker
+
+	r, w *os.File
+	f    string
+	out  io.WriteCloser
+
+	rejections *Log
+	log        *logging.Logger
+}
+
+// Path returns the path that the server must log to.
+func (t *Tee) Path() string {
+	return fmt.Sprintf("/dev/fd/%d", t.w.Fd())
+}
+
+// Rotate reopens the log file.
+func (t *Tee) Rotate() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.out != os.Stdout {
+		t.out.Close()
+	}
+	return t.open()
+}
+
+func (t *Tee) open() error {
+	if t.f == "" {
+		t.out = os.Stdout
+		return nil
+	}
+	var err error
+	t.out, err = os.OpenFile(t.f, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func (t *Tee) worker() {
+	s := bufio.NewScanner(t.r)
+	for s.Scan() {
+		line := s.Text()
+		t.Lock()
+		if t.out != nil {
+			fmt.Fprintln(t.out, line)
+		}
+		t.Unlock()
+		if r, ok := Parse(line); ok {
+			r.Time = time.Now()
+			t.rejections.Record(r)
+			t.log.Warningf("Rejected a descriptor from %v (%v): %v", r.Peer, r.Code, r.Reason)
+		}
+	}
+}
+
+// Close closes the Tee, after which the server must no longer log to it.
+// The server does not close its end of the pipe, so what the server has
+// already logged is drained for up to drainTimeout.
+func (t *Tee) Close() {
+	t.w.Close()
+	t.r.SetReadDeadline(time.Now().Add(drainTimeout))
+	t.Halt()
+	t.r.Close()
+	t.Lock()
+	defer t.Unlock()
+	if t.out != os.Stdout {
+		t.out.Close()
+	}
+	t.out = nil
+}
+
+// NewTee creates a Tee that appends the server's log to the file f, or to
+// stdout if f is empty, and records the rejections in l, logging them to
+// log.
+func NewTee(f string, l *Log, log *logging.Logger) (*Tee, error) {
+	t := &Tee{
+		f:          f,
+		rejections: l,
+		log:        log,
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	var err error
+	if t.r, t.w, err = os.Pipe(); err != nil {
+		if t.out != os.Stdout {
+			t.out.Close()
+		}
+		return nil, err
+	}
+	t.Go(t.worker)
+	return t, nil
+}
@@ -0,0 +1,157 @@
+// sharedrandom.go - Katzenpost voting authority shared random verification.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sharedrandom recomputes the shared random value of a voting
+// authority consensus from the commit-and-reveal transcript that produced
+// it, using the same construction as the voting authority.
+package sharedrandom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// Length is the length of commit and reveal values, an epoch followed
+	// by a digest.
+	Length = 40
+
+	// ValueLength is the length of a shared random value.
+	ValueLength = 32
+
+	domainSeparator = "shared-random"
+)
+
+// Entry is an authority's contribution to the shared random value of an
+// epoch.
+type Entry struct {
+	// IdentityKey is the authority's identity key.
+	IdentityKey *eddsa.PublicKey
+
+	// Commit is the commit value from the authority's vote, the epoch
+	// followed by the digest of Reveal.
+	Commit []byte
+
+	// Reveal is the authority's reveal value, the epoch followed by the
+	// digest of the authority's random number.
+	Reveal []byte
+}
+
+// Verify returns nil iff the entry's reveal matches its commit for epoch.
+func (e *Entry) Verify(epoch uint64) error {
+	if len(e.Commit) != Length || len(e.Reveal) != Length {
+		return fmt.Errorf("sharedrandom: %v: invalid commit or reveal length", e.IdentityKey)
+	}
+	if binary.BigEndian.Uint64(e.Commit) != epoch || binary.BigEndian.Uint64(e.Reveal) != epoch {
+		return fmt.Errorf("sharedrandom: %v: commit or reveal is not for epoch %v", e.IdentityKey, epoch)
+	}
+	digest := sha3.Sum256(e.Reveal)
+	if !bytes.Equal(e.Commit[8:], digest[:]) {
+		return fmt.Errorf("sharedrandom: %v: reveal does not match commit", e.IdentityKey)
+	}
+	return nil
+}
+
+// Transcript is the commit-and-reveal transcript of an epoch.
+type Transcript struct {
+	// Epoch is the epoch of the consensus.
+	Epoch uint64
+
+	// Entries are the contributions of the authorities.
+	Entries []*Entry
+}
+
+// Compute returns the shared random value for the transcript, chained to
+// the previous epoch's shared random value prev, which is nil if there is
+// no previous consensus.  Entries that fail verification are excluded, as
+// the authority does, and returned with the reason.
+func (t *Transcript) Compute(prev []byte) ([]byte, map[*Entry]error) {
+	excluded := make(map[*Entry]error)
+	var valid []*Entry
+	for _, e := range t.Entries {
+		if err := e.Verify(t.Epoch); err != nil {
+			excluded[e] = err
+			continue
+		}
+		valid = append(valid, e)
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		return string(valid[i].Reveal) > string(valid[j].Reveal)
+	})
+
+	var epoch [8]byte
+	binary.BigEndian.PutUint64(epoch[:], t.Epoch)
+	h := sha3.New256()
+	h.Write([]byte(domainSeparator))
+	h.Write(epoch[:])
+	for _, e := range valid {
+		h.Write(e.IdentityKey.Bytes())
+		h.Write(e.Reveal)
+	}
+	if prev == nil {
+		prev = make([]byte, ValueLength)
+	}
+	h.Write(prev)
+	return h.Sum(nil), excluded
+}
+
+// NewEntry returns a new entry for epoch with a commit and reveal derived
+// from the entropy source r, as the authority does.
+func NewEntry(identityKey *eddsa.PublicKey, epoch uint64, r io.Reader) (*Entry, error) {
+	rn := make([]byte, 32)
+	if _, err := io.ReadFull(r, rn); err != nil {
+		return nil, err
+	}
+	e := &Entry{
+		IdentityKey: identityKey,
+		Commit:      make([]byte, Length),
+		Reveal:      make([]byte, Length),
+	}
+	binary.BigEndian.PutUint64(e.Reveal, epoch)
+	binary.BigEndian.PutUint64(e.Commit, epoch)
+	digest := sha3.Sum256(rn)
+	copy(e.Reveal[8:], digest[:])
+	digest = sha3.Sum256(e.Reveal)
+	copy(e.Commit[8:], digest[:])
+	return e, nil
+}
+
+// LoadTranscript loads a JSON encoded transcript from the file f.
+func LoadTranscript(f string) (*Transcript, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	t := new(Transcript)
+	if err = json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	for _, e := range t.Entries {
+		if e.IdentityKey == nil {
+			return nil, errors.New("sharedrandom: transcript entry is missing IdentityKey")
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,60 @@
+// sharedrandom_test.go - Katzenpost shared random verification tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sharedrandom
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranscript(t *testing.T) {
+	assert := assert.New(t)
+
+	const epoch = 1234
+	tr := &Transcript{Epoch: epoch}
+	for i := 0; i < 3; i++ {
+		identityKey, err := eddsa.NewKeypair(rand.Reader)
+		assert.NoError(err)
+		e, err := NewEntry(identityKey.PublicKey(), epoch, rand.Reader)
+		assert.NoError(err)
+		assert.NoError(e.Verify(epoch))
+		assert.Error(e.Verify(epoch+1), "Verify() for another epoch")
+		tr.Entries = append(tr.Entries, e)
+	}
+
+	srv, excluded := tr.Compute(nil)
+	assert.Len(srv, ValueLength)
+	assert.Len(excluded, 0)
+
+	// The value does not depend on the order of the entries, but does on
+	// the previous value.
+	tr.Entries[0], tr.Entries[2] = tr.Entries[2], tr.Entries[0]
+	srv2, _ := tr.Compute(nil)
+	assert.Equal(srv, srv2)
+	srv2, _ = tr.Compute(srv)
+	assert.NotEqual(srv, srv2)
+
+	// A reveal that does not match its commit is excluded.
+	tr.Entries[1].Reveal[39] ^= 0xff
+	srv2, excluded = tr.Compute(nil)
+	assert.NotEqual(srv, srv2)
+	assert.Len(excluded, 1)
+	assert.Error(excluded[tr.Entries[1]])
+}
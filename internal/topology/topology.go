@@ -0,0 +1,380 @@
+// topology.go - Katzenpost mix topology layer assignment.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package topology implements deterministic layer assignment policies for
+// the mix network topology.
+//
+// Assignment only depends on the policy, the set of eligible nodes, the
+// previous topology and a seed (such as the shared random value), so every
+// authority that applies the same policy to the same inputs arrives at the
+// same topology.
+package topology
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/sphinx/constants"
+)
+
+const (
+	defaultLayers           = 3
+	defaultMinNodesPerLayer = 2
+
+	// MaxLayers is the maximum number of mix layers, leaving a hop each
+	// for the ingress and egress providers.
+	MaxLayers = constants.NrHops - 2
+)
+
+// NodeID is a node identifier (the identity key).
+type NodeID [constants.NodeIDLength]byte
+
+// Node is a mix eligible for assignment.
+type Node struct {
+	// ID is the node identifier.
+	ID NodeID
+
+	// Addresses are the node's addresses, if known, used to derive subnet
+	// families.
+	Addresses []string
+}
+
+// Family is a set of mixes that are run by the same operator.
+type Family struct {
+	// Name is the family (operator) name.
+	Name string
+
+	// Members are the identity keys of the family's mixes.
+	Members []*eddsa.PublicKey
+}
+
+// Pin is an operator assigned layer for a mix.
+type Pin struct {
+	// IdentityKey is the mix's identity signing key.
+	IdentityKey *eddsa.PublicKey
+
+	// Layer is the layer the mix is always assigned to.
+	Layer int
+}
+
+// Policy is a layer assignment policy.
+type Policy struct {
+	// Layers is the number of mix layers.
+	Layers int
+
+	// MinNodesPerLayer is the minimum number of nodes per layer required
+	// for a topology to be valid.
+	MinNodesPerLayer int
+
+	// Stable preserves the layer of each node that was present in the
+	// previous topology, as long as the layer is not over its share.
+	Stable bool
+
+	// Pinned are the operator assigned layers.
+	Pinned []*Pin
+
+	// Families are the declared mix families.  All of a family's mixes
+	// are placed in the same layer, so that no route through the mix
+	// layers can traverse the family more than once.
+	Families []*Family
+
+	// SubnetPrefixIPv4 and SubnetPrefixIPv6, if set, place mixes without a
+	// declared family that share an address prefix of that length in the
+	// same implicit family.
+	SubnetPrefixIPv4 int
+	SubnetPrefixIPv6 int
+
+	families map[NodeID]string
+}
+
+// Validate applies the defaults and validates the policy.
+func (p *Policy) Validate() error {
+	if p.Layers == 0 {
+		p.Layers = defaultLayers
+	}
+	if p.MinNodesPerLayer == 0 {
+		p.MinNodesPerLayer = defaultMinNodesPerLayer
+	}
+	if p.Layers < 0 || p.Layers > MaxLayers {
+		return fmt.Errorf("topology: Layers %v is not in [1, %v]", p.Layers, MaxLayers)
+	}
+	if p.MinNodesPerLayer < 0 {
+		return fmt.Errorf("topology: MinNodesPerLayer %v is negative", p.MinNodesPerLayer)
+	}
+	pinned := make(map[NodeID]bool)
+	for _, v := range p.Pinned {
+		if v.IdentityKey == nil {
+			return fmt.Errorf("topology: Pinned: IdentityKey is missing")
+		}
+		if v.Layer < 0 || v.Layer >= p.Layers {
+			return fmt.Errorf("topology: Pinned: %v: Layer %v is out of range", v.IdentityKey, v.Layer)
+		}
+		id := NodeID(v.IdentityKey.ByteArray())
+		if pinned[id] {
+			return fmt.Errorf("topology: Pinned: %v is present more than once", v.IdentityKey)
+		}
+		pinned[id] = true
+	}
+	if p.SubnetPrefixIPv4 < 0 || p.SubnetPrefixIPv4 > 8*net.IPv4len {
+		return fmt.Errorf("topology: SubnetPrefixIPv4 %v is out of range", p.SubnetPrefixIPv4)
+	}
+	if p.SubnetPrefixIPv6 < 0 || p.SubnetPrefixIPv6 > 8*net.IPv6len {
+		return fmt.Errorf("topology: SubnetPrefixIPv6 %v is out of range", p.SubnetPrefixIPv6)
+	}
+	p.families = make(map[NodeID]string)
+	for _, f := range p.Families {
+		if f.Name == "" {
+			return fmt.Errorf("topology: Families: Name is missing")
+		}
+		for _, v := range f.Members {
+			id := NodeID(v.ByteArray())
+			if other, ok := p.families[id]; ok {
+				return fmt.Errorf("topology: Families: %v is in both '%v' and '%v'", v, other, f.Name)
+			}
+			p.families[id] = f.Name
+		}
+	}
+	familyPin := make(map[string]*Pin)
+	for _, v := range p.Pinned {
+		f, ok := p.families[NodeID(v.IdentityKey.ByteArray())]
+		if !ok {
+			continue
+		}
+		if other, ok := familyPin[f]; ok && other.Layer != v.Layer {
+			return fmt.Errorf("topology: Pinned: %v and %v split family '%v' across layers %v and %v", other.IdentityKey, v.IdentityKey, f, other.Layer, v.Layer)
+		}
+		familyPin[f] = v
+	}
+	return nil
+}
+
+// FamilyOf returns the family of the node n, or "" if it has none.  The
+// policy must have been validated.
+func (p *Policy) FamilyOf(n *Node) string {
+	if f, ok := p.families[n.ID]; ok {
+		return f
+	}
+	for _, addr := range n.Addresses {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil && p.SubnetPrefixIPv4 > 0 {
+			mask := net.CIDRMask(p.SubnetPrefixIPv4, 8*net.IPv4len)
+			return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+		} else if ip4 == nil && p.SubnetPrefixIPv6 > 0 {
+			mask := net.CIDRMask(p.SubnetPrefixIPv6, 8*net.IPv6len)
+			return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+		}
+	}
+	return ""
+}
+
+// Assign assigns the eligible nodes to layers, given the previous
+// topology prev (which may be nil), and the seed used to order the nodes.
+// The policy must have been validated.
+func (p *Policy) Assign(nodes []*Node, prev [][]NodeID, seed []byte) ([][]NodeID, error) {
+	topology := make([][]NodeID, p.Layers)
+	pending := make(map[NodeID]*Node)
+	for _, n := range nodes {
+		pending[n.ID] = n
+	}
+	familyLayer := make(map[string]int)
+	place := func(n *Node, layer int) {
+		topology[layer] = append(topology[layer], n.ID)
+		delete(pending, n.ID)
+		if f := p.FamilyOf(n); f != "" {
+			if _, ok := familyLayer[f]; !ok {
+				familyLayer[f] = layer
+			}
+		}
+	}
+
+	// Operator pinned nodes are placed first, irrespective of balance, and
+	// drag the rest of their family along.  Pins that split a declared
+	// family are rejected by Validate, but subnet families are only known
+	// here.
+	for _, v := range p.Pinned {
+		if n, ok := pending[NodeID(v.IdentityKey.ByteArray())]; ok {
+			if f := p.FamilyOf(n); f != "" {
+				if l, ok := familyLayer[f]; ok && l != v.Layer {
+					return nil, fmt.Errorf("topology: Pinned: %v splits family '%v' across layers %v and %v", v.IdentityKey, f, l, v.Layer)
+				}
+			}
+			place(n, v.Layer)
+		}
+	}
+
+	// Families are placed whole, largest first, before the unaffiliated
+	// nodes fill in around them, so that a large family can't leave another
+	// layer short.  The nodes are examined in seeded order so that it is
+	// hard to predict which nodes get moved.
+	target := len(nodes) / p.Layers
+	toAssign := make([]NodeID, 0, len(pending))
+	for id := range pending {
+		toAssign = append(toAssign, id)
+	}
+	toAssign = seededOrder(toAssign, seed)
+	var families []string
+	members := make(map[string][]*Node)
+	var unaffiliated []*Node
+	for _, id := range toAssign {
+		n := pending[id]
+		f := p.FamilyOf(n)
+		if f == "" {
+			unaffiliated = append(unaffiliated, n)
+			continue
+		}
+		if _, ok := members[f]; !ok {
+			families = append(families, f)
+		}
+		members[f] = append(members[f], n)
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		return len(members[families[i]]) > len(members[families[j]])
+	})
+
+	prevLayer := make(map[NodeID]int)
+	if p.Stable {
+		for layer, prevNodes := range prev {
+			if layer >= p.Layers {
+				break
+			}
+			for _, id := range prevNodes {
+				prevLayer[id] = layer
+			}
+		}
+	}
+
+	// A family goes to the layer of its pinned members, or to the previous
+	// layer of most of its members if it still fits in that layer's share,
+	// to minimize churn, or else to the layer with the most room.
+	for _, f := range families {
+		layer, ok := familyLayer[f]
+		if !ok {
+			counts := make([]int, p.Layers)
+			for _, n := range members[f] {
+				if l, ok := prevLayer[n.ID]; ok {
+					counts[l]++
+				}
+			}
+			layer = -1
+			for l, c := range counts {
+				if c > 0 && (layer < 0 || c > counts[layer]) {
+					layer = l
+				}
+			}
+			if layer < 0 || len(topology[layer])+len(members[f]) > target {
+				layer = smallestLayer(topology)
+			}
+		}
+		for _, n := range members[f] {
+			place(n, layer)
+		}
+	}
+
+	// Unaffiliated nodes keep their previous layer, up to each layer's
+	// share, and everything else goes to the smallest layer.
+	var rest []*Node
+	for _, n := range unaffiliated {
+		if l, ok := prevLayer[n.ID]; ok && len(topology[l]) < target {
+			place(n, l)
+			continue
+		}
+		rest = append(rest, n)
+	}
+	for _, n := range rest {
+		place(n, smallestLayer(topology))
+	}
+
+	for layer, v := range topology {
+		if len(v) < p.MinNodesPerLayer {
+			return topology, fmt.Errorf("topology: layer %v has %v nodes, need %v", layer, len(v), p.MinNodesPerLayer)
+		}
+	}
+	return topology, nil
+}
+
+// smallestLayer returns the layer with the fewest nodes, which is the one
+// with the most room left in its share.
+func smallestLayer(topology [][]NodeID) int {
+	smallest := 0
+	for layer := range topology {
+		if len(topology[layer]) < len(topology[smallest]) {
+			smallest = layer
+		}
+	}
+	return smallest
+}
+
+// seededOrder returns the nodes sorted by SHA256(seed | id).
+func seededOrder(nodes []NodeID, seed []byte) []NodeID {
+	type keyed struct {
+		id  NodeID
+		key [sha256.Size]byte
+	}
+	v := make([]keyed, 0, len(nodes))
+	for _, id := range nodes {
+		h := sha256.New()
+		h.Write(seed)
+		h.Write(id[:])
+		k := keyed{id: id}
+		copy(k.key[:], h.Sum(nil))
+		v = append(v, k)
+	}
+	sort.Slice(v, func(i, j int) bool {
+		if c := bytes.Compare(v[i].key[:], v[j].key[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(v[i].id[:], v[j].id[:]) < 0
+	})
+
+	ret := make([]NodeID, 0, len(v))
+	for _, k := range v {
+		ret = append(ret, k.id)
+	}
+	return ret
+}
+
+// LoadPolicy loads and validates a Policy from the TOML file f.
+func LoadPolicy(f string) (*Policy, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	md, err := toml.Decode(string(b), p)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("topology: Policy has invalid keys: %v", undecoded)
+	}
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
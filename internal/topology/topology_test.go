@@ -0,0 +1,153 @@
+// topology_test.go - Katzenpost mix topology layer assignment tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package topology
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssign(t *testing.T) {
+	assert := assert.New(t)
+
+	// The keys are fixed, so that the seeded order of the nodes is.
+	r := rand.New(rand.NewSource(1))
+	var keys []*eddsa.PrivateKey
+	var nodes []*Node
+	for i := 0; i < 9; i++ {
+		k, err := eddsa.NewKeypair(r)
+		assert.NoError(err)
+		keys = append(keys, k)
+		nodes = append(nodes, &Node{ID: k.PublicKey().ByteArray()})
+	}
+
+	p := &Policy{
+		Stable: true,
+		Pinned: []*Pin{{IdentityKey: keys[0].PublicKey(), Layer: 2}},
+	}
+	assert.NoError(p.Validate())
+	assert.Equal(defaultLayers, p.Layers)
+
+	t1, err := p.Assign(nodes, nil, []byte("seed"))
+	assert.NoError(err)
+	for _, v := range t1 {
+		assert.Len(v, 3, "Assign() balances the layers")
+	}
+	assert.Contains(t1[2], nodes[0].ID, "Assign() honors pins")
+
+	again, err := p.Assign(nodes, nil, []byte("seed"))
+	assert.NoError(err)
+	assert.Equal(t1, again, "Assign() is deterministic")
+
+	// With a node gone and a new one, every surviving node keeps its layer.
+	k, err := eddsa.NewKeypair(r)
+	assert.NoError(err)
+	var next []*Node
+	for _, n := range nodes {
+		if n.ID != t1[0][0] {
+			next = append(next, n)
+		}
+	}
+	next = append(next, &Node{ID: k.PublicKey().ByteArray()})
+	t2, err := p.Assign(next, t1, []byte("other seed"))
+	assert.NoError(err)
+	for layer, v := range t1 {
+		for _, id := range v {
+			if id != t1[0][0] {
+				assert.Contains(t2[layer], id, "Assign() keeps stable layers")
+			}
+		}
+	}
+
+	// Family members share a layer, whether declared or by subnet.
+	p = &Policy{
+		Families:         []*Family{{Name: "op", Members: []*eddsa.PublicKey{keys[1].PublicKey(), keys[2].PublicKey(), keys[3].PublicKey()}}},
+		SubnetPrefixIPv4: 16,
+	}
+	assert.NoError(p.Validate())
+	nodes[4].Addresses = []string{"192.0.2.1:1234"}
+	nodes[5].Addresses = []string{"192.0.3.1:1234"}
+	nodes[6].Addresses = []string{"192.0.4.1:1234"}
+	assert.Equal("192.0.0.0/16", p.FamilyOf(nodes[4]))
+	t3, err := p.Assign(nodes, nil, []byte("seed"))
+	assert.NoError(err)
+	layerOf := make(map[NodeID]int)
+	for layer, v := range t3 {
+		for _, id := range v {
+			layerOf[id] = layer
+		}
+	}
+	assert.Equal(layerOf[nodes[1].ID], layerOf[nodes[2].ID], "Assign() keeps declared families together")
+	assert.Equal(layerOf[nodes[1].ID], layerOf[nodes[3].ID], "Assign() keeps declared families together")
+	assert.Equal(layerOf[nodes[4].ID], layerOf[nodes[5].ID], "Assign() keeps subnet families together")
+	assert.Equal(layerOf[nodes[4].ID], layerOf[nodes[6].ID], "Assign() keeps subnet families together")
+
+	// A family larger than a layer's share gets a layer of its own, and
+	// the other nodes are spread over the remaining layers.
+	p = &Policy{Families: []*Family{{Name: "big"}}}
+	for _, k := range keys[:5] {
+		p.Families[0].Members = append(p.Families[0].Members, k.PublicKey())
+	}
+	assert.NoError(p.Validate())
+	for i := 0; i < 20; i++ {
+		t4, err := p.Assign(nodes, nil, []byte{byte(i)})
+		assert.NoError(err, "Assign() with a large family")
+		for layer, v := range t4 {
+			if len(v) == 5 {
+				assert.Subset(v, []NodeID{nodes[0].ID, nodes[1].ID, nodes[2].ID, nodes[3].ID, nodes[4].ID}, "Assign() keeps a large family together")
+			} else {
+				assert.Len(v, 2, "Assign() fills in around a large family, layer %v", layer)
+			}
+		}
+	}
+
+	p = &Policy{
+		Families: []*Family{{Name: "op", Members: []*eddsa.PublicKey{keys[1].PublicKey()}}},
+	}
+	p.Families = append(p.Families, &Family{Name: "dup", Members: []*eddsa.PublicKey{keys[1].PublicKey()}})
+	assert.Error(p.Validate(), "Validate() rejects overlapping families")
+
+	p = &Policy{MinNodesPerLayer: 4}
+	assert.NoError(p.Validate())
+	_, err = p.Assign(nodes, nil, nil)
+	assert.Error(err, "Assign() enforces MinNodesPerLayer")
+
+	p.Pinned = []*Pin{{IdentityKey: keys[0].PublicKey(), Layer: 3}}
+	assert.Error(p.Validate(), "Validate() rejects out of range pins")
+
+	// Pins can't split a family, whether declared or by subnet.
+	p = &Policy{
+		Families: []*Family{{Name: "op", Members: []*eddsa.PublicKey{keys[1].PublicKey(), keys[2].PublicKey()}}},
+		Pinned:   []*Pin{{IdentityKey: keys[1].PublicKey(), Layer: 0}, {IdentityKey: keys[2].PublicKey(), Layer: 1}},
+	}
+	assert.Error(p.Validate(), "Validate() rejects pins that split a family")
+	p.Pinned[1].Layer = 0
+	assert.NoError(p.Validate())
+	t5, err := p.Assign(nodes, nil, nil)
+	assert.NoError(err)
+	assert.Subset(t5[0], []NodeID{nodes[1].ID, nodes[2].ID}, "Assign() keeps a pinned family together")
+	p = &Policy{
+		SubnetPrefixIPv4: 16,
+		Pinned:           []*Pin{{IdentityKey: keys[4].PublicKey(), Layer: 0}, {IdentityKey: keys[5].PublicKey(), Layer: 1}},
+	}
+	assert.NoError(p.Validate())
+	_, err = p.Assign(nodes, nil, nil)
+	assert.Error(err, "Assign() rejects pins that split a subnet family")
+}
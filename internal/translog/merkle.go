@@ -0,0 +1,198 @@
+// merkle.go - Katzenpost transparency log Merkle tree.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package translog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// The Merkle tree is the one of RFC 6962, section 2.1, with the inclusion
+// and consistency proof verification of RFC 6962-bis.
+
+var (
+	errInvalidProof = errors.New("translog: invalid proof")
+	errRootMismatch = errors.New("translog: proof does not match the root")
+)
+
+// LeafHash returns the Merkle tree hash of the leaf data b.
+func LeafHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n, for n > 1.
+func split(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// RootHash returns the Merkle tree hash of the leaf hashes.
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := split(uint64(len(leaves)))
+	return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// AuditPath returns the audit path of the leaf m in the tree of the
+// leaf hashes.
+func AuditPath(m uint64, leaves [][]byte) [][]byte {
+	n := uint64(len(leaves))
+	if n <= 1 {
+		return nil
+	}
+	k := split(n)
+	if m < k {
+		return append(AuditPath(m, leaves[:k]), RootHash(leaves[k:]))
+	}
+	return append(AuditPath(m-k, leaves[k:]), RootHash(leaves[:k]))
+}
+
+// ConsistencyHashes returns the proof that the tree of the first m leaf
+// hashes is a prefix of the tree of the leaf hashes.
+func ConsistencyHashes(m uint64, leaves [][]byte) [][]byte {
+	return subProof(m, leaves, true)
+}
+
+func subProof(m uint64, leaves [][]byte, complete bool) [][]byte {
+	n := uint64(len(leaves))
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(subProof(m, leaves[:k], complete), RootHash(leaves[k:]))
+	}
+	return append(subProof(m-k, leaves[k:], false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion verifies that the leaf hash leaf is at index in the tree
+// of size leaves with the root hash root, given the audit path proof.
+func VerifyInclusion(leaf []byte, index, size uint64, proof [][]byte, root []byte) error {
+	if index >= size {
+		return errInvalidProof
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return errInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errInvalidProof
+	}
+	if !bytes.Equal(r, root) {
+		return errRootMismatch
+	}
+	return nil
+}
+
+// VerifyConsistency verifies that the tree of size1 leaves with the root
+// hash root1 is a prefix of the tree of size2 leaves with the root hash
+// root2, given the consistency proof.
+func VerifyConsistency(size1, size2 uint64, root1, root2 []byte, proof [][]byte) error {
+	switch {
+	case size1 > size2:
+		return errInvalidProof
+	case size1 == size2:
+		if len(proof) != 0 {
+			return errInvalidProof
+		}
+		if !bytes.Equal(root1, root2) {
+			return errRootMismatch
+		}
+		return nil
+	case size1 == 0:
+		// The empty tree is a prefix of every tree.
+		if len(proof) != 0 {
+			return errInvalidProof
+		}
+		return nil
+	case len(proof) == 0:
+		return errInvalidProof
+	}
+
+	// If size1 is a power of two, the proof omits the first tree's root.
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errInvalidProof
+	}
+	if !bytes.Equal(fr, root1) || !bytes.Equal(sr, root2) {
+		return errRootMismatch
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// server.go - Katzenpost consensus transparency log server.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package translog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// HeadPath is the HTTP path that the signed tree head is served on.
+	HeadPath = "/translog/head"
+
+	// InclusionPath is the HTTP path that inclusion proofs are served on,
+	// with the epoch and size query parameters.
+	InclusionPath = "/translog/inclusion"
+
+	// ConsistencyPath is the HTTP path that consistency proofs are served
+	// on, with the first and second query parameters.
+	ConsistencyPath = "/translog/consistency"
+)
+
+// Server serves a Log, its signed tree heads, and proofs over HTTP.
+type Server struct {
+	translog    *Log
+	identityKey *eddsa.PrivateKey
+	log         *logging.Logger
+
+	l net.Listener
+}
+
+// Halt stops the Server.
+func (s *Server) Halt() {
+	s.l.Close()
+}
+
+func (s *Server) serveHead(w http.ResponseWriter, r *http.Request) {
+	th, err := s.translog.Head()
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	b, err := SignTreeHead(s.identityKey, th)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
+
+func (s *Server) serveInclusion(w http.ResponseWriter, r *http.Request) {
+	epoch, err1 := strconv.ParseUint(r.FormValue("epoch"), 10, 64)
+	size, err2 := strconv.ParseUint(r.FormValue("size"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid epoch or size", http.StatusBadRequest)
+		return
+	}
+	p, err := s.translog.Inclusion(epoch, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func (s *Server) serveConsistency(w http.ResponseWriter, r *http.Request) {
+	first, err1 := strconv.ParseUint(r.FormValue("first"), 10, 64)
+	second, err2 := strconv.ParseUint(r.FormValue("second"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid first or second size", http.StatusBadRequest)
+		return
+	}
+	p, err := s.translog.Consistency(first, second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func (s *Server) internalError(w http.ResponseWriter, err error) {
+	s.log.Errorf("Failed to query the log: %v", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// NewServer starts serving the Log l over HTTP on addr, with tree heads
+// signed by the authority's identity key.
+func NewServer(l *Log, identityKey *eddsa.PrivateKey, addr string, log *logging.Logger) (*Server, error) {
+	s := &Server{
+		translog:    l,
+		identityKey: identityKey,
+		log:         log,
+	}
+
+	var err error
+	if s.l, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(HeadPath, s.serveHead)
+	mux.HandleFunc(InclusionPath, s.serveInclusion)
+	mux.HandleFunc(ConsistencyPath, s.serveConsistency)
+	go func() {
+		log.Noticef("Serving the transparency log on: http://%v%v", s.l.Addr(), HeadPath)
+		http.Serve(s.l, mux)
+	}()
+	return s, nil
+}
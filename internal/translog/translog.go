@@ -0,0 +1,276 @@
+// translog.go - Katzenpost consensus transparency log.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package translog implements an append-only Merkle tree transparency log
+// of the PKI documents published by an authority, so that clients can
+// detect an authority serving different documents to different users.
+//
+// The leaves are the certified document bodies, without the signatures,
+// so the logs of every authority of a voting authority set hold the same
+// leaves.
+package translog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+const (
+	leavesBucket = "leaves"
+	epochsBucket = "epochs"
+
+	// treeHeadLifetime is how long a signed tree head is valid for.
+	treeHeadLifetime = 24 * time.Hour
+)
+
+// ErrNotFound is the error returned when the log has no leaf for an epoch.
+var ErrNotFound = errors.New("translog: no document for epoch")
+
+// TreeHead is the state of the log at a point in time.
+type TreeHead struct {
+	// Size is the number of leaves.
+	Size uint64
+
+	// Root is the Merkle tree hash of the leaves.
+	Root []byte
+
+	// Timestamp is when the tree head was produced.
+	Timestamp time.Time
+}
+
+// InclusionProof proves that the document for Epoch is in the log.
+type InclusionProof struct {
+	Epoch    uint64
+	Index    uint64
+	Size     uint64
+	LeafHash []byte
+	Proof    [][]byte
+}
+
+// Verify verifies the proof against the tree head th.
+func (p *InclusionProof) Verify(th *TreeHead) error {
+	if p.Size != th.Size {
+		return fmt.Errorf("translog: inclusion proof is for size %v, not %v", p.Size, th.Size)
+	}
+	return VerifyInclusion(p.LeafHash, p.Index, p.Size, p.Proof, th.Root)
+}
+
+// ConsistencyProof proves that the log at size First is a prefix of the
+// log at size Second.
+type ConsistencyProof struct {
+	First  uint64
+	Second uint64
+	Proof  [][]byte
+}
+
+// Verify verifies the proof between the tree heads a and b.
+func (p *ConsistencyProof) Verify(a, b *TreeHead) error {
+	if p.First != a.Size || p.Second != b.Size {
+		return fmt.Errorf("translog: consistency proof is for sizes %v-%v, not %v-%v", p.First, p.Second, a.Size, b.Size)
+	}
+	return VerifyConsistency(a.Size, b.Size, a.Root, b.Root, p.Proof)
+}
+
+// DocumentLeaf returns the leaf hash of the raw signed document rawDoc.
+func DocumentLeaf(rawDoc []byte) ([]byte, error) {
+	payload, err := cert.GetCertified(rawDoc)
+	if err != nil {
+		return nil, err
+	}
+	return LeafHash(payload), nil
+}
+
+// SignTreeHead signs the tree head th with the authority's identity key.
+func SignTreeHead(identityKey *eddsa.PrivateKey, th *TreeHead) ([]byte, error) {
+	b, err := json.Marshal(th)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Sign(identityKey, b, th.Timestamp.Add(treeHeadLifetime).Unix())
+}
+
+// VerifyTreeHead verifies the signed tree head raw against the authority
+// keys, and returns the tree head, and the key of the authority that
+// signed it.
+func VerifyTreeHead(raw []byte, keys []*eddsa.PublicKey) (*TreeHead, *eddsa.PublicKey, error) {
+	for _, k := range keys {
+		b, err := cert.Verify(k, raw)
+		if err != nil {
+			continue
+		}
+		th := new(TreeHead)
+		if err = json.Unmarshal(b, th); err != nil {
+			return nil, nil, err
+		}
+		return th, k, nil
+	}
+	return nil, nil, errors.New("translog: tree head is not signed by a known authority")
+}
+
+// Log is a bolt backed transparency log.
+type Log struct {
+	db *bolt.DB
+}
+
+// Close closes the log.
+func (l *Log) Close() {
+	l.db.Sync()
+	l.db.Close()
+}
+
+// Put appends the raw signed document rawDoc for epoch to the log, unless
+// the same document is already the log's leaf for epoch.  A different
+// document for an epoch is appended as well, as the log is append-only,
+// and auditors will see both.
+func (l *Log) Put(epoch uint64, rawDoc []byte) error {
+	leaf, err := DocumentLeaf(rawDoc)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		leaves := tx.Bucket([]byte(leavesBucket))
+		epochs := tx.Bucket([]byte(epochsBucket))
+		if b := epochs.Get(uint64ToBytes(epoch)); b != nil {
+			if string(leaves.Get(b)) == string(leaf) {
+				return nil
+			}
+		}
+		idx := leaves.Sequence()
+		if err := leaves.Put(uint64ToBytes(idx), leaf); err != nil {
+			return err
+		}
+		if err := leaves.SetSequence(idx + 1); err != nil {
+			return err
+		}
+		return epochs.Put(uint64ToBytes(epoch), uint64ToBytes(idx))
+	})
+}
+
+// Head returns the current tree head.
+func (l *Log) Head() (*TreeHead, error) {
+	var leaves [][]byte
+	err := l.db.View(func(tx *bolt.Tx) error {
+		var err error
+		leaves, err = readLeaves(tx, tx.Bucket([]byte(leavesBucket)).Sequence())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TreeHead{
+		Size:      uint64(len(leaves)),
+		Root:      RootHash(leaves),
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// Inclusion returns the proof that the latest document for epoch is in the
+// log of size leaves.
+func (l *Log) Inclusion(epoch, size uint64) (*InclusionProof, error) {
+	var p *InclusionProof
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(epochsBucket)).Get(uint64ToBytes(epoch))
+		if b == nil {
+			return ErrNotFound
+		}
+		idx := binary.BigEndian.Uint64(b)
+		if idx >= size {
+			return fmt.Errorf("translog: epoch %v is not in the log of size %v", epoch, size)
+		}
+		leaves, err := readLeaves(tx, size)
+		if err != nil {
+			return err
+		}
+		p = &InclusionProof{
+			Epoch:    epoch,
+			Index:    idx,
+			Size:     size,
+			LeafHash: leaves[idx],
+			Proof:    AuditPath(idx, leaves),
+		}
+		return nil
+	})
+	return p, err
+}
+
+// Consistency returns the proof that the log of size first is a prefix of
+// the log of size second.
+func (l *Log) Consistency(first, second uint64) (*ConsistencyProof, error) {
+	if first > second {
+		return nil, fmt.Errorf("translog: invalid consistency proof sizes %v-%v", first, second)
+	}
+	var p *ConsistencyProof
+	err := l.db.View(func(tx *bolt.Tx) error {
+		leaves, err := readLeaves(tx, second)
+		if err != nil {
+			return err
+		}
+		p = &ConsistencyProof{First: first, Second: second}
+		if first > 0 {
+			p.Proof = ConsistencyHashes(first, leaves)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// readLeaves returns the first size leaf hashes.
+func readLeaves(tx *bolt.Tx, size uint64) ([][]byte, error) {
+	bkt := tx.Bucket([]byte(leavesBucket))
+	if size > bkt.Sequence() {
+		return nil, fmt.Errorf("translog: the log has fewer than %v leaves", size)
+	}
+	leaves := make([][]byte, 0, size)
+	c := bkt.Cursor()
+	for k, v := c.First(); k != nil && uint64(len(leaves)) < size; k, v = c.Next() {
+		leaves = append(leaves, append([]byte{}, v...))
+	}
+	return leaves, nil
+}
+
+// New opens (or creates) the transparency log backed by the bolt database
+// f.
+func New(f string) (*Log, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("translog: failed to open '%v': %v", f, err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, v := range []string{leavesBucket, epochsBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Log{db: db}, nil
+}
+
+func uint64ToBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
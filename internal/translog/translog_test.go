@@ -0,0 +1,124 @@
+// translog_test.go - Katzenpost consensus transparency log tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package translog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProofs(t *testing.T) {
+	assert := assert.New(t)
+
+	var leaves [][]byte
+	for i := 0; i < 20; i++ {
+		leaves = append(leaves, LeafHash([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+
+	for n := 1; n <= len(leaves); n++ {
+		tree := leaves[:n]
+		root := RootHash(tree)
+		for m := 0; m < n; m++ {
+			proof := AuditPath(uint64(m), tree)
+			assert.NoError(VerifyInclusion(tree[m], uint64(m), uint64(n), proof, root), "inclusion %d/%d", m, n)
+			if n > 1 {
+				assert.Error(VerifyInclusion(tree[(m+1)%n], uint64(m), uint64(n), proof, root), "bad leaf %d/%d", m, n)
+			}
+		}
+		for m := 1; m <= n; m++ {
+			proof := ConsistencyHashes(uint64(m), tree)
+			root1 := RootHash(leaves[:m])
+			assert.NoError(VerifyConsistency(uint64(m), uint64(n), root1, root, proof), "consistency %d/%d", m, n)
+			if m < n {
+				assert.Error(VerifyConsistency(uint64(m), uint64(n), LeafHash(nil), root, proof), "bad root %d/%d", m, n)
+			}
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "translog_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	authKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	doc := func(s string) []byte {
+		b, err := cert.Sign(authKey, []byte(s), time.Now().Add(time.Hour).Unix())
+		assert.NoError(err)
+		return b
+	}
+
+	l, err := New(filepath.Join(dir, "translog.db"))
+	assert.NoError(err)
+	defer l.Close()
+
+	assert.NoError(l.Put(1, doc("epoch 1")))
+	first, err := l.Head()
+	assert.NoError(err)
+	assert.Equal(uint64(1), first.Size)
+
+	// Re-signing the same document does not add a leaf, a different document
+	// for the same epoch does.
+	assert.NoError(l.Put(1, doc("epoch 1")))
+	assert.NoError(l.Put(2, doc("epoch 2")))
+	assert.NoError(l.Put(2, doc("epoch 2, again")))
+	assert.NoError(l.Put(3, doc("epoch 3")))
+	th, err := l.Head()
+	assert.NoError(err)
+	assert.Equal(uint64(4), th.Size)
+
+	signed, err := SignTreeHead(authKey, th)
+	assert.NoError(err)
+	otherKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	_, _, err = VerifyTreeHead(signed, []*eddsa.PublicKey{otherKey.PublicKey()})
+	assert.Error(err)
+	vth, signer, err := VerifyTreeHead(signed, []*eddsa.PublicKey{otherKey.PublicKey(), authKey.PublicKey()})
+	assert.NoError(err)
+	assert.Equal(authKey.PublicKey(), signer)
+	assert.Equal(th.Root, vth.Root)
+
+	p, err := l.Inclusion(2, th.Size)
+	assert.NoError(err)
+	assert.Equal(uint64(2), p.Index)
+	leaf, err := DocumentLeaf(doc("epoch 2, again"))
+	assert.NoError(err)
+	assert.Equal(leaf, p.LeafHash)
+	assert.NoError(p.Verify(th))
+	_, err = l.Inclusion(3, 3)
+	assert.Error(err)
+	_, err = l.Inclusion(4, th.Size)
+	assert.Equal(ErrNotFound, err)
+
+	cp, err := l.Consistency(first.Size, th.Size)
+	assert.NoError(err)
+	assert.NoError(cp.Verify(first, th))
+	_, err = l.Consistency(th.Size, th.Size+1)
+	assert.Error(err)
+}
@@ -0,0 +1,231 @@
+// tuning.go - Katzenpost mix network parameter tuning.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package tuning derives the mix network parameters for an upcoming epoch
+// from a PKI document, or from the authorized nodes, and an operator
+// supplied policy.
+//
+// The computation only depends on its inputs and the policy, so every
+// authority that evaluates the same policy against the same consensus, or
+// the same authorized nodes, arrives at identical parameters.
+package tuning
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/core/pki"
+)
+
+const (
+	defaultMaxDelayFactor = 5.0
+	defaultMinLambdaM     = 0.00001
+	defaultMaxLambdaM     = 0.1
+)
+
+// Policy is the parameter tuning policy.
+type Policy struct {
+	// TargetLatency is the target mean end to end mixing delay, across all
+	// layers, in milliseconds.
+	TargetLatency uint64
+
+	// MaxDelayFactor is the ratio between each MaxDelay parameter and the
+	// mean of the distribution that it bounds.
+	MaxDelayFactor float64
+
+	// MinAnonymitySet is the minimum expected number of packets queued in
+	// each mix at any given time, from mix loop decoy traffic alone.
+	MinAnonymitySet float64
+
+	// MinLambdaM and MaxLambdaM bound the computed mix loop decoy rate.
+	MinLambdaM float64
+	MaxLambdaM float64
+}
+
+func (p *Policy) applyDefaults() {
+	if p.MaxDelayFactor == 0 {
+		p.MaxDelayFactor = defaultMaxDelayFactor
+	}
+	if p.MinLambdaM == 0 {
+		p.MinLambdaM = defaultMinLambdaM
+	}
+	if p.MaxLambdaM == 0 {
+		p.MaxLambdaM = defaultMaxLambdaM
+	}
+}
+
+func (p *Policy) validate() error {
+	if p.TargetLatency == 0 {
+		return errors.New("tuning: TargetLatency must be set")
+	}
+	if p.MaxDelayFactor < 1 {
+		return fmt.Errorf("tuning: MaxDelayFactor %v is less than 1", p.MaxDelayFactor)
+	}
+	if p.MinAnonymitySet < 0 {
+		return fmt.Errorf("tuning: MinAnonymitySet %v is negative", p.MinAnonymitySet)
+	}
+	if p.MinLambdaM <= 0 || p.MaxLambdaM < p.MinLambdaM {
+		return fmt.Errorf("tuning: invalid LambdaM bounds [%v, %v]", p.MinLambdaM, p.MaxLambdaM)
+	}
+	return nil
+}
+
+// Parameters are the mix network parameters, named as in the authority
+// [Parameters] configuration section.
+type Parameters struct {
+	SendRatePerMinute uint64
+	Mu                float64
+	MuMaxDelay        uint64
+	LambdaP           float64
+	LambdaPMaxDelay   uint64
+	LambdaL           float64
+	LambdaLMaxDelay   uint64
+	LambdaD           float64
+	LambdaDMaxDelay   uint64
+	LambdaM           float64
+	LambdaMMaxDelay   uint64
+}
+
+// Result is the outcome of applying a Policy to a document.
+type Result struct {
+	// Parameters are the computed parameters.
+	Parameters Parameters
+
+	// Reasons explains how each computed parameter was derived.
+	Reasons []string
+}
+
+func (r *Result) reasonf(format string, args ...interface{}) {
+	r.Reasons = append(r.Reasons, fmt.Sprintf(format, args...))
+}
+
+// Compute applies the policy to the document doc, and returns the
+// parameters for the next epoch.  The client side parameters are carried
+// over from doc unchanged.
+func (p *Policy) Compute(doc *pki.Document) (*Result, error) {
+	nLayers := len(doc.Topology)
+	if nLayers == 0 {
+		return nil, errors.New("tuning: document has no topology")
+	}
+	nMixes, maxWidth := 0, 0
+	for layer, nodes := range doc.Topology {
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("tuning: document layer %v is empty", layer)
+		}
+		nMixes += len(nodes)
+		if len(nodes) > maxWidth {
+			maxWidth = len(nodes)
+		}
+	}
+
+	cur := &Parameters{
+		SendRatePerMinute: doc.SendRatePerMinute,
+		LambdaP:           doc.LambdaP,
+		LambdaPMaxDelay:   doc.LambdaPMaxDelay,
+		LambdaL:           doc.LambdaL,
+		LambdaLMaxDelay:   doc.LambdaLMaxDelay,
+		LambdaD:           doc.LambdaD,
+		LambdaDMaxDelay:   doc.LambdaDMaxDelay,
+	}
+	return p.compute(nLayers, nMixes, maxWidth, cur, fmt.Sprintf("epoch %v", doc.Epoch))
+}
+
+// ComputeForNodes applies the policy to nMixes mixes spread evenly over
+// nLayers layers, as the authorities lay out the authorized mixes, and
+// returns the parameters.  The client side parameters are carried over from
+// cur unchanged.
+func (p *Policy) ComputeForNodes(nLayers, nMixes int, cur *Parameters) (*Result, error) {
+	if nLayers <= 0 || nMixes < nLayers {
+		return nil, fmt.Errorf("tuning: %v mixes do not fill %v layers", nMixes, nLayers)
+	}
+	maxWidth := (nMixes + nLayers - 1) / nLayers
+	return p.compute(nLayers, nMixes, maxWidth, cur, "the configuration")
+}
+
+func (p *Policy) compute(nLayers, nMixes, maxWidth int, cur *Parameters, from string) (*Result, error) {
+	pol := *p
+	pol.applyDefaults()
+	if err := pol.validate(); err != nil {
+		return nil, err
+	}
+
+	r := &Result{
+		Parameters: Parameters{
+			SendRatePerMinute: cur.SendRatePerMinute,
+			LambdaP:           cur.LambdaP,
+			LambdaPMaxDelay:   cur.LambdaPMaxDelay,
+			LambdaL:           cur.LambdaL,
+			LambdaLMaxDelay:   cur.LambdaLMaxDelay,
+			LambdaD:           cur.LambdaD,
+			LambdaDMaxDelay:   cur.LambdaDMaxDelay,
+		},
+	}
+	params := &r.Parameters
+	r.reasonf("Topology: %v layers, %v mixes, widest layer has %v mixes.", nLayers, nMixes, maxWidth)
+
+	// Split the target latency evenly across the layers.
+	meanHopDelay := float64(pol.TargetLatency) / float64(nLayers)
+	params.Mu = 1 / meanHopDelay
+	params.MuMaxDelay = uint64(math.Ceil(meanHopDelay * pol.MaxDelayFactor))
+	r.reasonf("Mu: %v ms target latency over %v layers is a %.3f ms mean per hop delay, Mu = %v, MuMaxDelay = %v ms.", pol.TargetLatency, nLayers, meanHopDelay, params.Mu, params.MuMaxDelay)
+
+	// Every mix loop traverses each layer once, so a mix in a layer of width
+	// w sees nMixes * LambdaM / w decoys per millisecond, and by Little's law
+	// holds that rate times the mean per hop delay in its queue.  Size the
+	// decoy rate so that the mixes in the widest layer meet the bound.
+	lambdaM := pol.MinAnonymitySet * float64(maxWidth) / (float64(nMixes) * meanHopDelay)
+	switch {
+	case lambdaM < pol.MinLambdaM:
+		r.reasonf("LambdaM: %v required for an anonymity set of %v is below MinLambdaM, using %v.", lambdaM, pol.MinAnonymitySet, pol.MinLambdaM)
+		lambdaM = pol.MinLambdaM
+	case lambdaM > pol.MaxLambdaM:
+		r.reasonf("LambdaM: %v required for an anonymity set of %v exceeds MaxLambdaM, using %v; the anonymity set bound is NOT met.", lambdaM, pol.MinAnonymitySet, pol.MaxLambdaM)
+		lambdaM = pol.MaxLambdaM
+	default:
+		r.reasonf("LambdaM: %v keeps at least %v decoys queued in each mix of the widest layer.", lambdaM, pol.MinAnonymitySet)
+	}
+	params.LambdaM = lambdaM
+	params.LambdaMMaxDelay = uint64(math.Ceil(pol.MaxDelayFactor / lambdaM))
+	r.reasonf("LambdaMMaxDelay: %v times the mean mix loop interval, %v ms.", pol.MaxDelayFactor, params.LambdaMMaxDelay)
+
+	r.reasonf("SendRatePerMinute, LambdaP, LambdaL, LambdaD: carried over from %v.", from)
+	return r, nil
+}
+
+// LoadPolicy loads a Policy from the TOML file f.
+func LoadPolicy(f string) (*Policy, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	md, err := toml.Decode(string(b), p)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("tuning: Policy has invalid keys: %v", undecoded)
+	}
+	pol := *p
+	pol.applyDefaults()
+	if err = pol.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
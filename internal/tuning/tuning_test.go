@@ -0,0 +1,74 @@
+// tuning_test.go - Katzenpost mix network parameter tuning tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tuning
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompute(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := &pki.Document{
+		Epoch:             7,
+		SendRatePerMinute: 30,
+		LambdaP:           0.001,
+		LambdaPMaxDelay:   10000,
+		Topology: [][]*pki.MixDescriptor{
+			make([]*pki.MixDescriptor, 2),
+			make([]*pki.MixDescriptor, 4),
+			make([]*pki.MixDescriptor, 2),
+		},
+	}
+	p := &Policy{
+		TargetLatency:   3000,
+		MinAnonymitySet: 8,
+	}
+
+	r, err := p.Compute(doc)
+	assert.NoError(err)
+	assert.Equal(0.001, r.Parameters.Mu, "Mu: 1000 ms per hop")
+	assert.Equal(uint64(5000), r.Parameters.MuMaxDelay)
+	assert.Equal(0.004, r.Parameters.LambdaM, "LambdaM: 8 * 4 / (8 * 1000)")
+	assert.Equal(uint64(1250), r.Parameters.LambdaMMaxDelay)
+	assert.Equal(doc.SendRatePerMinute, r.Parameters.SendRatePerMinute)
+	assert.Equal(doc.LambdaPMaxDelay, r.Parameters.LambdaPMaxDelay)
+	assert.NotEmpty(r.Reasons)
+
+	p.MaxLambdaM = 0.002
+	r, err = p.Compute(doc)
+	assert.NoError(err)
+	assert.Equal(0.002, r.Parameters.LambdaM, "LambdaM clamped to MaxLambdaM")
+
+	_, err = p.Compute(&pki.Document{})
+	assert.Error(err, "Compute() with no topology")
+	_, err = (&Policy{}).Compute(doc)
+	assert.Error(err, "Compute() with no TargetLatency")
+
+	// The authorities spread 9 mixes over 3 layers evenly, 3 per layer.
+	p.MaxLambdaM = 0
+	r, err = p.ComputeForNodes(3, 9, &Parameters{SendRatePerMinute: 30})
+	assert.NoError(err)
+	assert.Equal(0.001, r.Parameters.Mu)
+	assert.InDelta(8.0*3/(9*1000), r.Parameters.LambdaM, 1e-12, "LambdaM: 8 * 3 / (9 * 1000)")
+	assert.Equal(uint64(30), r.Parameters.SendRatePerMinute)
+	_, err = p.ComputeForNodes(3, 2, &Parameters{})
+	assert.Error(err, "ComputeForNodes() with an empty layer")
+}
@@ -0,0 +1,119 @@
+// client.go - Katzenpost external user database client.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package userdb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client queries an external user database.
+type Client struct {
+	// URL is the base URL of the external service.
+	URL string
+
+	// HTTPClient is the client used to query the service, which carries
+	// the TLS client certificate for mutual TLS.
+	HTTPClient *http.Client
+
+	// Key is the HMAC key shared with the service, nil if requests are not
+	// signed.
+	Key []byte
+}
+
+// Lookup looks the user up.
+func (c *Client) Lookup(user string) (*LookupResponse, error) {
+	body, err := json.Marshal(&LookupRequest{Version: Version, User: user})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.URL, "/")+LookupPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var sig string
+	if c.Key != nil {
+		sig = SignRequest(req, c.Key, body, time.Now())
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userdb: lookup failed: %v", resp.Status)
+	}
+	if c.Key != nil {
+		if err = verifyResponse(resp, c.Key, sig, b); err != nil {
+			return nil, err
+		}
+	}
+
+	r := new(LookupResponse)
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	if r.Version != Version {
+		return nil, fmt.Errorf("userdb: unsupported protocol version %v", r.Version)
+	}
+	return r, nil
+}
+
+// TLSConfig returns the TLS configuration of a client that authenticates
+// with the PEM encoded certificate certFile and key keyFile, if set, and
+// accepts servers with a certificate signed by the CA in caFile, if set,
+// instead of the system's CAs.
+func TLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := new(tls.Config)
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("userdb: no certificates in the CA file")
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,199 @@
+// gateway.go - Katzenpost external user database gateway.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package userdb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// The calls of the provider's extern backend, and their form fields.
+const (
+	callIsValid  = "isvalid"
+	callExists   = "exists"
+	callGetIDKey = "getidkey"
+
+	userField = "user"
+	keyField  = "key"
+)
+
+// CacheConfig is the configuration of the cache of a Gateway.
+type CacheConfig struct {
+	// TTL is how long a user that exists is cached, and NegativeTTL how
+	// long a user that does not exist is.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	// StaleTTL is how long after it was looked up a user is served from
+	// the cache, once expired, while the external service is unavailable.
+	StaleTTL time.Duration
+
+	// MaxEntries is the maximum number of cached users, 0 for no limit.
+	MaxEntries int
+}
+
+type cacheEntry struct {
+	resp    *LookupResponse
+	fetched time.Time
+	expires time.Time
+}
+
+// Gateway serves the calls of the provider's extern UserDB backend over
+// HTTP, from a cache of the users looked up with a Client.
+type Gateway struct {
+	sync.Mutex
+
+	c       *Client
+	cfg     CacheConfig
+	entries map[string]*cacheEntry
+	log     *logging.Logger
+
+	l net.Listener
+}
+
+// Halt stops the Gateway.
+func (g *Gateway) Halt() {
+	g.l.Close()
+}
+
+// Lookup returns the user from the cache, or looks it up with the
+// external service.  An expired entry is returned if the lookup fails,
+// within the StaleTTL.
+func (g *Gateway) Lookup(user string) (*LookupResponse, error) {
+	now := time.Now()
+	g.Lock()
+	e := g.entries[user]
+	g.Unlock()
+	if e != nil && now.Before(e.expires) {
+		return e.resp, nil
+	}
+
+	resp, err := g.c.Lookup(user)
+
+	g.Lock()
+	defer g.Unlock()
+	if err != nil {
+		if e != nil && now.Before(e.fetched.Add(g.cfg.StaleTTL)) {
+			g.log.Warningf("Failed to look up user '%v', using the cached entry: %v", user, err)
+			return e.resp, nil
+		}
+		return nil, err
+	}
+	e = &cacheEntry{resp: resp, fetched: now, expires: now.Add(g.cfg.NegativeTTL)}
+	if resp.Exists {
+		e.expires = now.Add(g.cfg.TTL)
+	}
+	if _, ok := g.entries[user]; !ok && g.cfg.MaxEntries > 0 && len(g.entries) >= g.cfg.MaxEntries {
+		g.evict(now)
+	}
+	g.entries[user] = e
+	return resp, nil
+}
+
+// evict removes the entries that can no longer be served, or an arbitrary
+// entry if there are none.
+func (g *Gateway) evict(now time.Time) {
+	for k, e := range g.entries {
+		if !now.Before(e.fetched.Add(g.cfg.StaleTTL)) && !now.Before(e.expires) {
+			delete(g.entries, k)
+		}
+	}
+	for k := range g.entries {
+		if len(g.entries) < g.cfg.MaxEntries {
+			break
+		}
+		delete(g.entries, k)
+	}
+}
+
+// ServeHTTP serves a call of the provider's extern backend.  The backend
+// fails closed on any error status.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The backend joins the ProviderURL and the call with a "/", which may
+	// double the slash, so only the last element of the path matters.
+	call := path.Base(r.URL.Path)
+	switch call {
+	case callIsValid, callExists, callGetIDKey:
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := g.Lookup(r.FormValue(userField))
+	if err != nil {
+		g.log.Errorf("Failed to look up user: %v", err)
+		http.Error(w, "lookup failed", http.StatusServiceUnavailable)
+		return
+	}
+
+	var v interface{}
+	switch call {
+	case callIsValid:
+		v = resp.Exists && keyEqual(resp.LinkKey, r.FormValue(keyField))
+	case callExists:
+		v = resp.Exists
+	case callGetIDKey:
+		k := new(ecdh.PublicKey)
+		if !resp.Exists || k.FromString(resp.IdentityKey) != nil {
+			http.Error(w, "no identity key", http.StatusNotFound)
+			return
+		}
+		v = hex.EncodeToString(k.Bytes())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{call: v})
+}
+
+func keyEqual(a, b string) bool {
+	ka, kb := new(ecdh.PublicKey), new(ecdh.PublicKey)
+	if ka.FromString(a) != nil || kb.FromString(b) != nil {
+		return false
+	}
+	return ka.Equal(kb)
+}
+
+// NewGateway starts serving the extern backend's calls on addr, looking the
+// users up with c, and caching them as configured by cfg.
+func NewGateway(c *Client, cfg *CacheConfig, addr string, log *logging.Logger) (*Gateway, error) {
+	g := &Gateway{
+		c:       c,
+		cfg:     *cfg,
+		entries: make(map[string]*cacheEntry),
+		log:     log,
+	}
+
+	var err error
+	if g.l, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	go func() {
+		log.Noticef("Serving the extern UserDB gateway on: http://%v/", g.l.Addr())
+		http.Serve(g.l, g)
+	}()
+	return g, nil
+}
@@ -0,0 +1,166 @@
+// userdb.go - Katzenpost external user database protocol.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package userdb implements a caching gateway between the provider's
+// `extern` UserDB backend and an external user database, which it queries
+// with a versioned, authenticated protocol.
+//
+// The provider's backend queries the gateway at its ProviderURL, on every
+// authentication, with the unauthenticated isvalid, exists and getidkey
+// calls.  The gateway answers them from a cache of the users looked up with
+// the external service, so that the provider does not wait on the external
+// service, and keeps serving the cached users for a while when the external
+// service is unavailable.
+//
+// Version 1 of the external service's protocol has a single call, which
+// returns everything known about a user:
+//
+//	POST <URL>/v1/lookup
+//	Content-Type: application/json
+//
+//	Request:  {"version": 1, "user": "<user name>"}
+//	Response: {"version": 1, "exists": <bool>,
+//	           "link_key": "<key>", "identity_key": "<key>"}
+//
+// The keys are X25519 public keys, in the Base64 format of the provider's
+// management interface, and identity_key is empty if the user has none.  An
+// unknown user is a 200 response with exists false, while any other status
+// is a failure of the lookup.
+//
+// Requests and responses are authenticated with mutual TLS, with HMAC-SHA256
+// signatures with a shared key, or both.  A request carries the headers:
+//
+//	X-Userdb-Timestamp: <UNIX time of the request>
+//	X-Userdb-Signature: hex(HMAC(key, "request\n" + path + "\n" +
+//	                             timestamp + "\n" + body))
+//
+// where path is the URL path of the call, and the response the header:
+//
+//	X-Userdb-Signature: hex(HMAC(key, "response\n" + request signature +
+//	                             "\n" + body))
+//
+// which binds it to the request.  Requests with a timestamp more than
+// MaxClockSkew away from the service's clock must be rejected.
+package userdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Version is the version of the protocol.
+	Version = 1
+
+	// LookupPath is the path of the lookup call, relative to the service's
+	// URL.
+	LookupPath = "/v1/lookup"
+
+	// TimestampHeader and SignatureHeader are the headers of the HMAC
+	// signatures.
+	TimestampHeader = "X-Userdb-Timestamp"
+	SignatureHeader = "X-Userdb-Signature"
+
+	// MaxClockSkew is the maximum difference between the timestamp of a
+	// request and the clock of the service.
+	MaxClockSkew = 5 * time.Minute
+
+	// maxBodySize is the maximum size of a request or response.
+	maxBodySize = 64 * 1024
+)
+
+var (
+	// ErrBadSignature is the error returned for a request or response
+	// with a missing or invalid signature.
+	ErrBadSignature = errors.New("userdb: invalid signature")
+)
+
+// LookupRequest is the request of the lookup call.
+type LookupRequest struct {
+	Version int    `json:"version"`
+	User    string `json:"user"`
+}
+
+// LookupResponse is the response of the lookup call.
+type LookupResponse struct {
+	Version     int    `json:"version"`
+	Exists      bool   `json:"exists"`
+	LinkKey     string `json:"link_key,omitempty"`
+	IdentityKey string `json:"identity_key,omitempty"`
+}
+
+func mac(key []byte, parts ...string) string {
+	m := hmac.New(sha256.New, key)
+	for i, v := range parts {
+		if i > 0 {
+			m.Write([]byte("\n"))
+		}
+		m.Write([]byte(v))
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// SignRequest sets the signature headers of the request r with the body
+// to the signature with key as of now, and returns the signature.
+func SignRequest(r *http.Request, key []byte, body []byte, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig := mac(key, "request", r.URL.Path, ts, string(body))
+	r.Header.Set(TimestampHeader, ts)
+	r.Header.Set(SignatureHeader, sig)
+	return sig
+}
+
+// VerifyRequest reads the body of the request r, and returns it if the
+// request's signature with key is valid as of now.
+func VerifyRequest(r *http.Request, key []byte, now time.Time) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	ts := r.Header.Get(TimestampHeader)
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > MaxClockSkew || d < -MaxClockSkew {
+		return nil, fmt.Errorf("userdb: request timestamp off by %v", d)
+	}
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(mac(key, "request", r.URL.Path, ts, string(body)))) {
+		return nil, ErrBadSignature
+	}
+	return body, nil
+}
+
+// SignResponse sets the signature header of the response to the request r
+// with the body to the signature with key.
+func SignResponse(w http.ResponseWriter, r *http.Request, key []byte, body []byte) {
+	w.Header().Set(SignatureHeader, mac(key, "response", r.Header.Get(SignatureHeader), string(body)))
+}
+
+func verifyResponse(resp *http.Response, key []byte, reqSig string, body []byte) error {
+	if !hmac.Equal([]byte(resp.Header.Get(SignatureHeader)), []byte(mac(key, "response", reqSig, string(body)))) {
+		return ErrBadSignature
+	}
+	return nil
+}
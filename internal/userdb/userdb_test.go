@@ -0,0 +1,218 @@
+// userdb_test.go - Katzenpost external user database tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package userdb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// standIn is a stand-in for the external user database, which serves the
+// version 1 protocol from memory.
+type standIn struct {
+	sync.Mutex
+
+	key     []byte
+	users   map[string]*LookupResponse
+	lookups int
+	down    bool
+	forge   bool
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.URL.Path != LookupPath || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if s.down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := VerifyRequest(r, s.key, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	req := new(LookupRequest)
+	if err = json.Unmarshal(body, req); err != nil || req.Version != Version {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	s.lookups++
+	resp, ok := s.users[req.User]
+	if !ok {
+		resp = &LookupResponse{Version: Version}
+	}
+	b, _ := json.Marshal(resp)
+	if s.forge {
+		SignResponse(w, r, []byte("wrong key"), b)
+	} else {
+		SignResponse(w, r, s.key, b)
+	}
+	w.Write(b)
+}
+
+func (s *standIn) setDown(down bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.down = down
+}
+
+func (s *standIn) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.lookups
+}
+
+func newKey(t *testing.T) *ecdh.PublicKey {
+	k, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey()
+}
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+
+	linkKey := newKey(t)
+	s := &standIn{
+		key:   []byte("shared key"),
+		users: map[string]*LookupResponse{"alice": {Version: Version, Exists: true, LinkKey: linkKey.String()}},
+	}
+	srv := httptest.NewTLSServer(s)
+	defer srv.Close()
+
+	// The client trusts the stand-in's certificate as its CA.
+	dir, err := ioutil.TempDir("", "userdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	assert.NoError(err, "WriteFile")
+	tlsCfg, err := TLSConfig("", "", caFile)
+	assert.NoError(err, "TLSConfig")
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+	c := &Client{URL: srv.URL + "/", HTTPClient: hc, Key: s.key}
+	resp, err := c.Lookup("alice")
+	assert.NoError(err, "Lookup")
+	assert.Equal(&LookupResponse{Version: Version, Exists: true, LinkKey: linkKey.String()}, resp)
+	resp, err = c.Lookup("bob")
+	assert.NoError(err, "Lookup: unknown user")
+	assert.False(resp.Exists)
+
+	c.Key = []byte("wrong key")
+	_, err = c.Lookup("alice")
+	assert.Error(err, "Lookup: wrong key")
+
+	// A response signed with another key is rejected.
+	c.Key = s.key
+	s.Lock()
+	s.forge = true
+	s.Unlock()
+	_, err = c.Lookup("alice")
+	assert.Equal(ErrBadSignature, err, "Lookup: forged response")
+
+	_, err = (&Client{URL: srv.URL, Key: c.Key}).Lookup("alice")
+	assert.Error(err, "Lookup: untrusted certificate")
+}
+
+func TestGateway(t *testing.T) {
+	assert := assert.New(t)
+
+	linkKey, identityKey := newKey(t), newKey(t)
+	s := &standIn{
+		key: []byte("shared key"),
+		users: map[string]*LookupResponse{
+			"alice": {Version: Version, Exists: true, LinkKey: linkKey.String(), IdentityKey: identityKey.String()},
+		},
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	logBackend, err := log.New("", "ERROR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &CacheConfig{TTL: 200 * time.Millisecond, NegativeTTL: time.Hour, StaleTTL: 400 * time.Millisecond}
+	g, err := NewGateway(&Client{URL: srv.URL, Key: s.key}, cfg, "127.0.0.1:0", logBackend.GetLogger("userdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Halt()
+
+	// The calls of the provider's extern backend, with its doubled slash.
+	call := func(name, user, key string) (int, interface{}) {
+		resp, err := http.PostForm("http://"+g.l.Addr().String()+"//"+name, url.Values{"user": {user}, "key": {key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		v := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&v)
+		return resp.StatusCode, v[name]
+	}
+
+	_, v := call("isvalid", "alice", linkKey.String())
+	assert.Equal(true, v, "isvalid")
+	_, v = call("isvalid", "alice", identityKey.String())
+	assert.Equal(false, v, "isvalid: wrong key")
+	_, v = call("exists", "alice", "")
+	assert.Equal(true, v, "exists")
+	_, v = call("getidkey", "alice", "")
+	assert.Equal(hex.EncodeToString(identityKey.Bytes()), v, "getidkey")
+	_, v = call("exists", "bob", "")
+	assert.Equal(false, v, "exists: unknown user")
+	_, v = call("exists", "bob", "")
+	assert.Equal(2, s.count(), "positive and negative lookups are cached")
+
+	// Expired entries are served while the service is down, until the
+	// StaleTTL.
+	s.setDown(true)
+	time.Sleep(cfg.TTL)
+	_, v = call("isvalid", "alice", linkKey.String())
+	assert.Equal(true, v, "isvalid: stale entry")
+	time.Sleep(cfg.StaleTTL - cfg.TTL)
+	status, _ := call("isvalid", "alice", linkKey.String())
+	assert.Equal(http.StatusServiceUnavailable, status, "isvalid: service down")
+
+	s.setDown(false)
+	_, v = call("isvalid", "alice", linkKey.String())
+	assert.Equal(true, v, "isvalid: service back")
+	assert.Equal(3, s.count())
+}
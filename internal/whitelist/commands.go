@@ -0,0 +1,253 @@
+// commands.go - Katzenpost authority whitelist management commands.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package whitelist
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+)
+
+const (
+	cmdJoinSubmit      = "JOIN_SUBMIT"
+	cmdJoinList        = "JOIN_LIST"
+	cmdJoinApprove     = "JOIN_APPROVE"
+	cmdJoinReject      = "JOIN_REJECT"
+	cmdWhitelistList   = "WHITELIST_LIST"
+	cmdWhitelistAdd    = "WHITELIST_ADD"
+	cmdWhitelistRemove = "WHITELIST_REMOVE"
+
+	defaultAddedBy = "management"
+)
+
+// RegisterCommands registers the whitelist commands with the management
+// server m.  onChange is called after the whitelist has been modified.
+//
+//	JOIN_SUBMIT <request>              Submit a join request made with JoinRequest.Sign.
+//	JOIN_LIST                          List the pending join requests.
+//	JOIN_APPROVE <key> [options]       Whitelist the node with a pending join request.
+//	JOIN_REJECT <key>                  Discard a pending join request.
+//	WHITELIST_LIST                     List the whitelisted nodes.
+//	WHITELIST_ADD <key> <role> [options]
+//	                                   Whitelist a node, where role is "mix" or
+//	                                   "provider:<identifier>".
+//	WHITELIST_REMOVE <key>             Remove a node from the whitelist.
+//
+// The options are "by=<name>", "expires=<RFC 3339 time or duration>", and
+// any remaining text is taken as the notes.
+func RegisterCommands(m *thwack.Server, s *Store, onChange func()) {
+	m.RegisterCommand(cmdJoinSubmit, func(c *thwack.Conn, l string) error {
+		arg, ok := argument(l)
+		if !ok {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		r, err := ParseJoinRequest(arg)
+		if err != nil {
+			return writeError(c, err)
+		}
+		if err = s.Submit(r); err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Join request submitted for %v.", r.IdentityKey)
+		return c.WriteReply(thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdJoinList, func(c *thwack.Conn, l string) error {
+		reqs, err := s.Pending()
+		if err != nil {
+			return writeError(c, err)
+		}
+		var lines []string
+		for _, r := range reqs {
+			lines = append(lines, formatJoinRequest(r))
+		}
+		return management.WriteLines(c, lines, thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdJoinApprove, func(c *thwack.Conn, l string) error {
+		args := strings.Fields(l)[1:]
+		if len(args) < 1 {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		k, err := parseKey(args[0])
+		if err != nil {
+			return writeError(c, err)
+		}
+		meta, err := parseOptions(args[1:], time.Now())
+		if err != nil {
+			return writeError(c, err)
+		}
+		if _, err = s.Approve(k, meta); err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Join request approved for %v.", k)
+		onChange()
+		return c.WriteReply(thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdJoinReject, func(c *thwack.Conn, l string) error {
+		k, err := keyArgument(l)
+		if err != nil {
+			return writeError(c, err)
+		}
+		if err = s.Reject(k); err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Join request rejected for %v.", k)
+		return c.WriteReply(thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdWhitelistList, func(c *thwack.Conn, l string) error {
+		entries, err := s.Entries()
+		if err != nil {
+			return writeError(c, err)
+		}
+		var lines []string
+		for _, e := range entries {
+			lines = append(lines, formatEntry(e))
+		}
+		return management.WriteLines(c, lines, thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdWhitelistAdd, func(c *thwack.Conn, l string) error {
+		args := strings.Fields(l)[1:]
+		if len(args) < 2 {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		k, err := parseKey(args[0])
+		if err != nil {
+			return writeError(c, err)
+		}
+		e, err := parseOptions(args[2:], time.Now())
+		if err != nil {
+			return writeError(c, err)
+		}
+		e.IdentityKey = k
+		switch {
+		case args[1] == "mix":
+		case strings.HasPrefix(args[1], "provider:"):
+			e.IsProvider = true
+			e.Identifier = strings.TrimPrefix(args[1], "provider:")
+		default:
+			return writeError(c, fmt.Errorf("whitelist: invalid role '%v'", args[1]))
+		}
+		if err = s.Add(e); err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Whitelisted %v.", k)
+		onChange()
+		return c.WriteReply(thwack.StatusOk)
+	})
+
+	m.RegisterCommand(cmdWhitelistRemove, func(c *thwack.Conn, l string) error {
+		k, err := keyArgument(l)
+		if err != nil {
+			return writeError(c, err)
+		}
+		if err = s.Remove(k); err != nil {
+			return writeError(c, err)
+		}
+		c.Log().Noticef("Removed %v from the whitelist.", k)
+		onChange()
+		return c.WriteReply(thwack.StatusOk)
+	})
+}
+
+func formatJoinRequest(r *JoinRequest) string {
+	return fmt.Sprintf("%v %v family=%q contact=%q addresses=%v created=%v",
+		r.IdentityKey, role(r.IsProvider, r.Identifier), r.Family, r.Contact,
+		strings.Join(r.Addresses, ","), r.Created.UTC().Format(time.RFC3339))
+}
+
+func formatEntry(e *Entry) string {
+	expires := "never"
+	if !e.Expires.IsZero() {
+		expires = e.Expires.UTC().Format(time.RFC3339)
+		if e.Expired(time.Now()) {
+			expires += " (expired)"
+		}
+	}
+	return fmt.Sprintf("%v %v family=%q contact=%q by=%q added=%v expires=%v notes=%q",
+		e.IdentityKey, role(e.IsProvider, e.Identifier), e.Family, e.Contact,
+		e.AddedBy, e.AddedAt.UTC().Format(time.RFC3339), expires, e.Notes)
+}
+
+func role(isProvider bool, identifier string) string {
+	if isProvider {
+		return "provider:" + identifier
+	}
+	return "mix"
+}
+
+// writeError sends err as the body of a failure reply, as thwack status
+// lines carry no detail.
+func writeError(c *thwack.Conn, err error) error {
+	return management.WriteLines(c, []string{err.Error()}, thwack.StatusTransactionFailed)
+}
+
+func argument(l string) (string, bool) {
+	sp := strings.Fields(l)
+	if len(sp) != 2 {
+		return "", false
+	}
+	return sp[1], true
+}
+
+func keyArgument(l string) (*eddsa.PublicKey, error) {
+	arg, ok := argument(l)
+	if !ok {
+		return nil, fmt.Errorf("whitelist: missing identity key")
+	}
+	return parseKey(arg)
+}
+
+func parseKey(s string) (*eddsa.PublicKey, error) {
+	k := new(eddsa.PublicKey)
+	if err := k.FromString(s); err != nil {
+		return nil, fmt.Errorf("whitelist: invalid identity key: %v", err)
+	}
+	return k, nil
+}
+
+// parseOptions returns an Entry with the metadata set from the command
+// options args, with relative expiry times taken from now.
+func parseOptions(args []string, now time.Time) (*Entry, error) {
+	e := &Entry{AddedBy: defaultAddedBy}
+	for len(args) > 0 {
+		v := args[0]
+		switch {
+		case strings.HasPrefix(v, "by="):
+			e.AddedBy = strings.TrimPrefix(v, "by=")
+		case strings.HasPrefix(v, "expires="):
+			v = strings.TrimPrefix(v, "expires=")
+			if d, err := time.ParseDuration(v); err == nil {
+				e.Expires = now.Add(d)
+			} else if e.Expires, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("whitelist: invalid expiry '%v'", v)
+			}
+		default:
+			e.Notes = strings.Join(args, " ")
+			return e, nil
+		}
+		args = args[1:]
+	}
+	return e, nil
+}
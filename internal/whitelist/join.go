@@ -0,0 +1,126 @@
+// join.go - Katzenpost authority join requests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package whitelist
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+const (
+	joinRequestVersion  = 0
+	joinRequestLifetime = 7 * 24 * time.Hour
+)
+
+// JoinRequest is a node's request to be added to the whitelist, signed by
+// the node's identity key.
+type JoinRequest struct {
+	// Version is the join request format version.
+	Version int
+
+	// IdentityKey is the node's identity key.
+	IdentityKey *eddsa.PublicKey
+
+	// IsProvider is true iff the node is a provider.
+	IsProvider bool
+
+	// Identifier is the node's identifier, which is required for providers.
+	Identifier string
+
+	// Addresses are the node's addresses.
+	Addresses []string
+
+	// Contact is the operator's contact information.
+	Contact string
+
+	// Family is the operator (family) name.
+	Family string
+
+	// Created is when the request was created.
+	Created time.Time
+}
+
+func (r *JoinRequest) validate() error {
+	if r.Version != joinRequestVersion {
+		return fmt.Errorf("whitelist: unsupported join request version %v", r.Version)
+	}
+	if r.IdentityKey == nil {
+		return errors.New("whitelist: join request is missing IdentityKey")
+	}
+	if r.IsProvider && r.Identifier == "" {
+		return errors.New("whitelist: provider join request is missing Identifier")
+	}
+	if !r.IsProvider && r.Identifier != "" {
+		// The authorities only take identifiers for providers.
+		return errors.New("whitelist: mix join request has an Identifier")
+	}
+	return nil
+}
+
+// Sign signs the join request with the node's identity key, and returns it
+// as a single line of Base64 suitable for submission.
+func (r *JoinRequest) Sign(identityKey *eddsa.PrivateKey) (string, error) {
+	r.Version = joinRequestVersion
+	r.IdentityKey = identityKey.PublicKey()
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	signed, err := cert.Sign(identityKey, payload, r.Created.Add(joinRequestLifetime).Unix())
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signed), nil
+}
+
+// ParseJoinRequest decodes a join request produced by Sign, and verifies
+// that it is signed by the identity key that it carries, and has not
+// expired.
+func ParseJoinRequest(s string) (*JoinRequest, error) {
+	signed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := cert.GetCertified(signed)
+	if err != nil {
+		return nil, err
+	}
+	r := new(JoinRequest)
+	if err = json.Unmarshal(payload, r); err != nil {
+		return nil, err
+	}
+	if err = r.validate(); err != nil {
+		return nil, err
+	}
+	if _, err = cert.Verify(r.IdentityKey, signed); err != nil {
+		return nil, fmt.Errorf("whitelist: join request for %v: %v", r.IdentityKey, err)
+	}
+	return r, nil
+}
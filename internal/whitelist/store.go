@@ -0,0 +1,257 @@
+// store.go - Katzenpost authority whitelist store.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package whitelist implements the authority's persistent node whitelist,
+// and the signed join requests that nodes submit to be added to it.
+package whitelist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+const (
+	entriesBucket = "entries"
+	pendingBucket = "pending"
+)
+
+var (
+	// ErrNotFound is the error returned when there is no entry or pending
+	// join request for an identity key.
+	ErrNotFound = errors.New("whitelist: not found")
+
+	// ErrAlreadyListed is the error returned when a join request is
+	// submitted for a node that is already whitelisted.
+	ErrAlreadyListed = errors.New("whitelist: node is already whitelisted")
+)
+
+// Entry is a whitelisted node.
+type Entry struct {
+	// IdentityKey is the node's identity key.
+	IdentityKey *eddsa.PublicKey
+
+	// IsProvider is true iff the node is a provider.
+	IsProvider bool
+
+	// Identifier is the provider's identifier.
+	Identifier string
+
+	// Contact and Family are from the node's join request, if any.
+	Contact string
+	Family  string
+
+	// AddedBy is who added the node.
+	AddedBy string
+
+	// AddedAt is when the node was added.
+	AddedAt time.Time
+
+	// Notes are free form notes about the node.
+	Notes string
+
+	// Expires is when the node drops out of the whitelist, if set.
+	Expires time.Time
+}
+
+// Expired returns true iff the entry has expired as of now.
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+func (e *Entry) validate() error {
+	if e.IdentityKey == nil {
+		return errors.New("whitelist: entry is missing IdentityKey")
+	}
+	if e.IsProvider && e.Identifier == "" {
+		return errors.New("whitelist: provider entry is missing Identifier")
+	}
+	if !e.IsProvider && e.Identifier != "" {
+		return errors.New("whitelist: mix entry has an Identifier")
+	}
+	return nil
+}
+
+// Store is a bolt backed store of the whitelist, and of pending join
+// requests.
+type Store struct {
+	db *bolt.DB
+}
+
+// Close closes the store.
+func (s *Store) Close() {
+	s.db.Sync()
+	s.db.Close()
+}
+
+// Submit adds the join request r to the pending requests, replacing any
+// earlier request for the same node.
+func (s *Store) Submit(r *JoinRequest) error {
+	id := r.IdentityKey.ByteArray()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(entriesBucket)).Get(id[:]) != nil {
+			return ErrAlreadyListed
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(pendingBucket)).Put(id[:], b)
+	})
+}
+
+// Pending returns the pending join requests.
+func (s *Store) Pending() ([]*JoinRequest, error) {
+	var reqs []*JoinRequest
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(pendingBucket)).ForEach(func(k, v []byte) error {
+			r := new(JoinRequest)
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			reqs = append(reqs, r)
+			return nil
+		})
+	})
+	return reqs, err
+}
+
+// Approve moves the pending join request of the node with the identity key
+// k to the whitelist, and returns the new entry, with the AddedBy, Notes
+// and Expires metadata taken from meta.
+func (s *Store) Approve(k *eddsa.PublicKey, meta *Entry) (*Entry, error) {
+	id := k.ByteArray()
+	var e *Entry
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket([]byte(pendingBucket))
+		b := pending.Get(id[:])
+		if b == nil {
+			return ErrNotFound
+		}
+		r := new(JoinRequest)
+		if err := json.Unmarshal(b, r); err != nil {
+			return err
+		}
+		e = &Entry{
+			IdentityKey: r.IdentityKey,
+			IsProvider:  r.IsProvider,
+			Identifier:  r.Identifier,
+			Contact:     r.Contact,
+			Family:      r.Family,
+			AddedBy:     meta.AddedBy,
+			AddedAt:     time.Now(),
+			Notes:       meta.Notes,
+			Expires:     meta.Expires,
+		}
+		if b, err := json.Marshal(e); err != nil {
+			return err
+		} else if err = tx.Bucket([]byte(entriesBucket)).Put(id[:], b); err != nil {
+			return err
+		}
+		return pending.Delete(id[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reject discards the pending join request of the node with the identity
+// key k.
+func (s *Store) Reject(k *eddsa.PublicKey) error {
+	id := k.ByteArray()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket([]byte(pendingBucket))
+		if pending.Get(id[:]) == nil {
+			return ErrNotFound
+		}
+		return pending.Delete(id[:])
+	})
+}
+
+// Add adds the entry e to the whitelist, replacing any existing entry for
+// the same node, and discarding any pending join request.
+func (s *Store) Add(e *Entry) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	if e.AddedAt.IsZero() {
+		e.AddedAt = time.Now()
+	}
+	id := e.IdentityKey.ByteArray()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket([]byte(entriesBucket)).Put(id[:], b); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(pendingBucket)).Delete(id[:])
+	})
+}
+
+// Remove removes the node with the identity key k from the whitelist.
+func (s *Store) Remove(k *eddsa.PublicKey) error {
+	id := k.ByteArray()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket([]byte(entriesBucket))
+		if entries.Get(id[:]) == nil {
+			return ErrNotFound
+		}
+		return entries.Delete(id[:])
+	})
+}
+
+// Entries returns the whitelisted nodes, including the expired ones.
+func (s *Store) Entries() ([]*Entry, error) {
+	var entries []*Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(entriesBucket)).ForEach(func(k, v []byte) error {
+			e := new(Entry)
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// New opens (or creates) the whitelist store backed by the bolt database f.
+func New(f string) (*Store, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("whitelist: failed to open '%v': %v", f, err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, v := range []string{entriesBucket, pendingBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
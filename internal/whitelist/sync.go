@@ -0,0 +1,165 @@
+// sync.go - Katzenpost authority whitelist synchronization.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package whitelist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+const (
+	syncVersion  = 0
+	syncLifetime = time.Hour
+
+	syncedByPrefix = "authority "
+)
+
+// ErrUnknownPeer is the error returned when synchronizing with a whitelist
+// that is not signed by one of the peer authorities.
+var ErrUnknownPeer = errors.New("whitelist: not signed by a peer authority")
+
+type syncedWhitelist struct {
+	Version int
+	Entries []*Entry
+}
+
+// SyncedBy returns the AddedBy of the entries synchronized from the peer
+// authority with the identity key k.
+func SyncedBy(k *eddsa.PublicKey) string {
+	return syncedByPrefix + k.String()
+}
+
+// IsSynced returns true iff the entry was synchronized from a peer
+// authority.
+func (e *Entry) IsSynced() bool {
+	return strings.HasPrefix(e.AddedBy, syncedByPrefix)
+}
+
+// SignedLocal returns the entries that were added to this whitelist, as
+// opposed to synchronized from a peer authority, signed with the
+// authority's identity key, for the peer authorities to synchronize with.
+func (s *Store) SignedLocal(identityKey *eddsa.PrivateKey) ([]byte, error) {
+	entries, err := s.Entries()
+	if err != nil {
+		return nil, err
+	}
+	w := &syncedWhitelist{Version: syncVersion, Entries: []*Entry{}}
+	for _, e := range entries {
+		if !e.IsSynced() {
+			w.Entries = append(w.Entries, e)
+		}
+	}
+	payload, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Sign(identityKey, payload, time.Now().Add(syncLifetime).Unix())
+}
+
+// Sync replaces the entries synchronized from a peer authority with the
+// signed whitelist produced by the peer's SignedLocal, and returns the
+// number of entries that changed.  The whitelist must be signed by one of
+// peers.  Entries that were added to this whitelist, or synchronized from
+// another peer, take precedence, and the peer's entries that are invalid
+// are skipped.
+func (s *Store) Sync(signed []byte, peers []*eddsa.PublicKey) (int, error) {
+	sigs, err := cert.GetSignatures(signed)
+	if err != nil {
+		return 0, err
+	}
+	if len(sigs) != 1 {
+		return 0, ErrUnknownPeer
+	}
+	var peer *eddsa.PublicKey
+	for _, v := range peers {
+		if bytes.Equal(v.Bytes(), sigs[0].Identity) {
+			peer = v
+		}
+	}
+	if peer == nil {
+		return 0, ErrUnknownPeer
+	}
+	payload, err := cert.Verify(peer, signed)
+	if err != nil {
+		return 0, fmt.Errorf("whitelist: whitelist of %v: %v", peer, err)
+	}
+	w := new(syncedWhitelist)
+	if err = json.Unmarshal(payload, w); err != nil {
+		return 0, err
+	}
+	if w.Version != syncVersion {
+		return 0, fmt.Errorf("whitelist: unsupported whitelist version %v", w.Version)
+	}
+
+	addedBy := SyncedBy(peer)
+	synced := make(map[[eddsa.PublicKeySize]byte]*Entry)
+	for _, e := range w.Entries {
+		if e.validate() != nil {
+			continue
+		}
+		e.AddedBy = addedBy
+		synced[e.IdentityKey.ByteArray()] = e
+	}
+	changed := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(entriesBucket))
+		var stale [][]byte
+		if err := bkt.ForEach(func(k, v []byte) error {
+			e := new(Entry)
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			id := e.IdentityKey.ByteArray()
+			if e.AddedBy != addedBy {
+				// Added locally, or synchronized from another peer.
+				delete(synced, id)
+			} else if n, ok := synced[id]; !ok {
+				stale = append(stale, append([]byte{}, k...))
+			} else if b, err := json.Marshal(n); err == nil && bytes.Equal(b, v) {
+				delete(synced, id)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		for id, e := range synced {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err = bkt.Put(id[:], b); err != nil {
+				return err
+			}
+		}
+		changed = len(stale) + len(synced)
+		return nil
+	})
+	return changed, err
+}
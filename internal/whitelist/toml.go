@@ -0,0 +1,139 @@
+// toml.go - Katzenpost authority whitelist import and export.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package whitelist
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+// tomlNode is an authority config [[Mixes]] or [[Providers]] entry, with
+// the whitelist metadata as optional extra keys.
+type tomlNode struct {
+	Identifier  string `toml:",omitempty"`
+	IdentityKey *eddsa.PublicKey
+	Contact     string     `toml:",omitempty"`
+	Family      string     `toml:",omitempty"`
+	AddedBy     string     `toml:",omitempty"`
+	AddedAt     *time.Time `toml:",omitempty"`
+	Notes       string     `toml:",omitempty"`
+	Expires     *time.Time `toml:",omitempty"`
+}
+
+type tomlWhitelist struct {
+	Mixes     []*tomlNode
+	Providers []*tomlNode
+}
+
+func (n *tomlNode) entry(isProvider bool) *Entry {
+	e := &Entry{
+		IdentityKey: n.IdentityKey,
+		IsProvider:  isProvider,
+		Identifier:  n.Identifier,
+		Contact:     n.Contact,
+		Family:      n.Family,
+		AddedBy:     n.AddedBy,
+		Notes:       n.Notes,
+	}
+	if n.AddedAt != nil {
+		e.AddedAt = *n.AddedAt
+	}
+	if n.Expires != nil {
+		e.Expires = *n.Expires
+	}
+	return e
+}
+
+func newTOMLNode(e *Entry) *tomlNode {
+	n := &tomlNode{
+		Identifier:  e.Identifier,
+		IdentityKey: e.IdentityKey,
+		Contact:     e.Contact,
+		Family:      e.Family,
+		AddedBy:     e.AddedBy,
+		Notes:       e.Notes,
+	}
+	if !e.AddedAt.IsZero() {
+		addedAt := e.AddedAt.UTC()
+		n.AddedAt = &addedAt
+	}
+	if !e.Expires.IsZero() {
+		expires := e.Expires.UTC()
+		n.Expires = &expires
+	}
+	return n
+}
+
+// Import adds the [[Mixes]] and [[Providers]] entries of the TOML file f,
+// which may be an authority config file, to the whitelist.  Every other
+// section of the file is ignored.  Entries without an AddedBy are
+// attributed to addedBy.  The number of entries imported is returned.
+func (s *Store) Import(f, addedBy string) (int, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return 0, err
+	}
+	var w tomlWhitelist
+	if _, err = toml.Decode(string(b), &w); err != nil {
+		return 0, err
+	}
+
+	var entries []*Entry
+	for _, v := range w.Mixes {
+		entries = append(entries, v.entry(false))
+	}
+	for _, v := range w.Providers {
+		entries = append(entries, v.entry(true))
+	}
+	for _, e := range entries {
+		if err = e.validate(); err != nil {
+			return 0, err
+		}
+		if e.AddedBy == "" {
+			e.AddedBy = addedBy
+		}
+	}
+	for _, e := range entries {
+		if err = s.Add(e); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Export writes the whitelist to w as TOML [[Mixes]] and [[Providers]]
+// entries, that can be imported, or pasted into an authority config file
+// once the metadata keys are removed.
+func (s *Store) Export(w io.Writer) error {
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+	var tw tomlWhitelist
+	for _, e := range entries {
+		if e.IsProvider {
+			tw.Providers = append(tw.Providers, newTOMLNode(e))
+		} else {
+			tw.Mixes = append(tw.Mixes, newTOMLNode(e))
+		}
+	}
+	return toml.NewEncoder(w).Encode(&tw)
+}
@@ -0,0 +1,259 @@
+// whitelist_test.go - Katzenpost authority whitelist tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package whitelist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	r := &JoinRequest{
+		Addresses: []string{"127.0.0.1:29483"},
+		Contact:   "ops@example.org",
+		Family:    "example",
+	}
+	s, err := r.Sign(identityKey)
+	assert.NoError(err)
+
+	parsed, err := ParseJoinRequest(s)
+	assert.NoError(err)
+	assert.True(identityKey.PublicKey().Equal(parsed.IdentityKey))
+	assert.Equal(r.Addresses, parsed.Addresses)
+	assert.Equal("example", parsed.Family)
+
+	// Substituting another identity key invalidates the signature.
+	b, err := base64.StdEncoding.DecodeString(s)
+	assert.NoError(err)
+	otherKey, err := eddsa.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	oldKey, _ := identityKey.PublicKey().MarshalText()
+	newKey, _ := otherKey.PublicKey().MarshalText()
+	b = bytes.Replace(b, oldKey, newKey, 1)
+	_, err = ParseJoinRequest(base64.StdEncoding.EncodeToString(b))
+	assert.Error(err, "ParseJoinRequest() with a substituted key")
+
+	r = &JoinRequest{IsProvider: true}
+	_, err = r.Sign(identityKey)
+	assert.Error(err, "Sign() of a provider request without an Identifier")
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "whitelist_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(filepath.Join(dir, "whitelist.db"))
+	assert.NoError(err)
+	defer s.Close()
+
+	logBackend, err := log.New("", "ERROR", false)
+	assert.NoError(err)
+	sock := filepath.Join(dir, management.SocketFile)
+	m, err := management.New(sock, "test", logBackend)
+	assert.NoError(err)
+	changed := 0
+	RegisterCommands(m, s, func() { changed++ })
+	assert.NoError(m.Start())
+	defer m.Halt()
+
+	var keys []*eddsa.PublicKey
+	for i := 0; i < 2; i++ {
+		identityKey, err := eddsa.NewKeypair(rand.Reader)
+		assert.NoError(err)
+		req, err := (&JoinRequest{Contact: "ops@example.org"}).Sign(identityKey)
+		assert.NoError(err)
+		assert.NoError(management.Run(sock, "JOIN_SUBMIT "+req, ioutil.Discard))
+		keys = append(keys, identityKey.PublicKey())
+	}
+	assert.Error(management.Run(sock, "JOIN_SUBMIT bogus", ioutil.Discard))
+
+	var out bytes.Buffer
+	assert.NoError(management.Run(sock, "JOIN_LIST", &out))
+	assert.Equal(2, strings.Count(out.String(), "\n"))
+
+	assert.NoError(management.Run(sock, "JOIN_APPROVE "+keys[0].String()+" by=alice expires=24h first mix", ioutil.Discard))
+	assert.NoError(management.Run(sock, "JOIN_REJECT "+keys[1].String(), ioutil.Discard))
+	assert.Error(management.Run(sock, "JOIN_APPROVE "+keys[1].String(), ioutil.Discard))
+	assert.Equal(1, changed)
+
+	pending, err := s.Pending()
+	assert.NoError(err)
+	assert.Len(pending, 0)
+	entries, err := s.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.True(keys[0].Equal(entries[0].IdentityKey))
+	assert.Equal("ops@example.org", entries[0].Contact)
+	assert.Equal("alice", entries[0].AddedBy)
+	assert.Equal("first mix", entries[0].Notes)
+	assert.False(entries[0].Expired(time.Now()))
+	assert.True(entries[0].Expired(time.Now().Add(25 * time.Hour)))
+
+	out.Reset()
+	assert.NoError(management.Run(sock, "WHITELIST_LIST", &out))
+	assert.Contains(out.String(), keys[0].String())
+
+	// A whitelisted node can not submit another request.
+	assert.Equal(ErrAlreadyListed, s.Submit(&JoinRequest{IdentityKey: keys[0]}))
+
+	assert.NoError(management.Run(sock, "WHITELIST_ADD "+keys[1].String()+" provider:example.org", ioutil.Discard))
+	assert.Error(management.Run(sock, "WHITELIST_ADD "+keys[1].String()+" relay", ioutil.Discard))
+	assert.NoError(management.Run(sock, "WHITELIST_REMOVE "+keys[0].String(), ioutil.Discard))
+	assert.Error(management.Run(sock, "WHITELIST_REMOVE "+keys[0].String(), ioutil.Discard))
+	assert.Equal(3, changed)
+
+	entries, err = s.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal("example.org", entries[0].Identifier)
+	assert.Equal(defaultAddedBy, entries[0].AddedBy)
+}
+
+func TestImportExport(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "whitelist_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(filepath.Join(dir, "whitelist.db"))
+	assert.NoError(err)
+	defer s.Close()
+
+	// An authority config file, with sections that are not imported.
+	const authorityCfg = `
+[Authority]
+  Addresses = [ "127.0.0.1:29483" ]
+
+[[Mixes]]
+  IdentityKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+
+[[Providers]]
+  Identifier = "provider1"
+  IdentityKey = "r2tcFrBFvZr3B4Xmon9MQyX1vuSz/whw0aJyVM2fLfE="
+  Expires = 2018-01-01T00:00:00Z
+`
+	f := filepath.Join(dir, "authority.toml")
+	assert.NoError(ioutil.WriteFile(f, []byte(authorityCfg), 0600))
+	n, err := s.Import(f, "import")
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	var out bytes.Buffer
+	assert.NoError(s.Export(&out))
+	s2, err := New(filepath.Join(dir, "whitelist2.db"))
+	assert.NoError(err)
+	defer s2.Close()
+	f = filepath.Join(dir, "export.toml")
+	assert.NoError(ioutil.WriteFile(f, out.Bytes(), 0600))
+	n, err = s2.Import(f, "other")
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	entries, err := s2.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 2)
+	for _, e := range entries {
+		assert.Equal("import", e.AddedBy, "AddedBy survives the round trip")
+		assert.Equal(e.IsProvider, e.Expired(time.Now()))
+	}
+}
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "whitelist_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := New(filepath.Join(dir, "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := New(filepath.Join(dir, "b.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	newKey := func() *eddsa.PrivateKey {
+		k, err := eddsa.NewKeypair(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	keyA, keyB := newKey(), newKey()
+	peers := []*eddsa.PublicKey{keyA.PublicKey(), keyB.PublicKey()}
+
+	// An entry approved by a is synchronized to b.
+	mix, local := newKey().PublicKey(), newKey().PublicKey()
+	assert.NoError(a.Add(&Entry{IdentityKey: mix, AddedBy: "op-a"}))
+	assert.NoError(b.Add(&Entry{IdentityKey: local, AddedBy: "op-b"}))
+	signed, err := a.SignedLocal(keyA)
+	assert.NoError(err)
+	n, err := b.Sync(signed, peers)
+	assert.NoError(err)
+	assert.Equal(1, n)
+	entries, err := b.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 2)
+	n, err = b.Sync(signed, peers)
+	assert.NoError(err)
+	assert.Equal(0, n, "Sync(): unchanged")
+
+	// Synchronized entries are not passed on, and removals propagate.
+	signed, err = b.SignedLocal(keyB)
+	assert.NoError(err)
+	n, err = a.Sync(signed, peers)
+	assert.NoError(err)
+	assert.Equal(1, n, "Sync(): synchronized entry passed on")
+	assert.NoError(a.Remove(mix))
+	signed, err = a.SignedLocal(keyA)
+	assert.NoError(err)
+	n, err = b.Sync(signed, peers)
+	assert.NoError(err)
+	assert.Equal(1, n)
+	entries, err = b.Entries()
+	assert.NoError(err)
+	if assert.Len(entries, 1) {
+		assert.True(entries[0].IdentityKey.Equal(local), "Sync(): local entry removed")
+	}
+
+	_, err = b.Sync(signed, []*eddsa.PublicKey{keyB.PublicKey()})
+	assert.Equal(ErrUnknownPeer, err, "Sync(): unknown peer")
+}
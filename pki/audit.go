@@ -0,0 +1,234 @@
+// audit.go - Katzenpost PKI document tool, `audit` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/daemons/internal/translog"
+	"github.com/katzenpost/server/config"
+)
+
+func cmdAudit(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	af.register(fs)
+	logs := fs.String("logs", "", "Comma separated base URLs of the authorities' transparency logs.")
+	stateFile := fs.String("state", "", "File that keeps the last verified tree head of each log, to check the logs' consistency across runs.")
+	epoch := fs.Uint64("epoch", currentEpoch(), "Last epoch to audit.")
+	epochs := fs.Uint64("epochs", 3, "Number of epochs to audit, ending at -epoch.")
+	fs.Parse(args)
+
+	if *logs == "" {
+		return errors.New("-logs is mandatory")
+	}
+	if *epochs == 0 || *epochs > *epoch {
+		return errors.New("invalid -epochs")
+	}
+	keys, err := af.authorityKeys()
+	if err != nil {
+		return err
+	}
+	c, err := af.newClient()
+	if err != nil {
+		return err
+	}
+	state := make(map[string]*translog.TreeHead)
+	if *stateFile != "" {
+		if b, err := ioutil.ReadFile(*stateFile); err == nil {
+			if err = json.Unmarshal(b, &state); err != nil {
+				return fmt.Errorf("invalid state file '%v': %v", *stateFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// The leaves are compared against the documents as served to us.
+	leaves := make(map[uint64][]byte)
+	for e := *epoch - *epochs + 1; e <= *epoch; e++ {
+		_, raw, err := fetchDocument(c, af.timeout, strconv.FormatUint(e, 10))
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "No document for epoch %v, not auditing it: %v\n", e, err)
+			continue
+		}
+		if leaves[e], err = translog.DocumentLeaf(raw); err != nil {
+			return err
+		}
+	}
+
+	var logClients []*translog.Client
+	for _, v := range strings.Split(*logs, ",") {
+		logClients = append(logClients, &translog.Client{
+			URL:        strings.TrimSpace(v),
+			HTTPClient: &http.Client{Timeout: af.timeout},
+		})
+	}
+	problems := writeAudit(os.Stdout, logClients, keys, state, leaves)
+
+	if *stateFile != "" {
+		b, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(*stateFile, b, 0600); err != nil {
+			return err
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%v problem(s) found", problems)
+	}
+	return nil
+}
+
+// writeAudit audits the transparency logs against the authority keys, the
+// tree heads previously verified in state, which is updated, and the leaf
+// hashes of the documents served to us for each epoch, and returns the
+// number of problems found.
+func writeAudit(w io.Writer, logs []*translog.Client, keys []*eddsa.PublicKey, state map[string]*translog.TreeHead, leaves map[uint64][]byte) int {
+	var epochs []uint64
+	for epoch := range leaves {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+
+	problems := 0
+	check := func(err error, format string, args ...interface{}) bool {
+		status, msg := "ok  ", fmt.Sprintf(format, args...)
+		if err != nil {
+			status, msg = "FAIL", msg+": "+err.Error()
+			problems++
+		}
+		fmt.Fprintf(w, "  [%s] %s\n", status, msg)
+		return err == nil
+	}
+
+	// The leaf hash that each log holds for each epoch, to detect a split
+	// view between the authorities.
+	logged := make(map[uint64]map[string]bool)
+	for _, c := range logs {
+		fmt.Fprintf(w, "Log %v:\n", c.URL)
+		raw, err := c.SignedHead()
+		if !check(err, "Fetched the tree head") {
+			continue
+		}
+		th, signer, err := translog.VerifyTreeHead(raw, keys)
+		if !check(err, "Tree head signed by an authority") {
+			continue
+		}
+		fmt.Fprintf(w, "  Signer: %v\n", signer)
+		fmt.Fprintf(w, "  Size:   %v\n", th.Size)
+		fmt.Fprintf(w, "  Root:   %v\n", base64.StdEncoding.EncodeToString(th.Root))
+
+		consistent := true
+		if prev := state[signer.String()]; prev != nil {
+			var p *translog.ConsistencyProof
+			if prev.Size > th.Size {
+				err = fmt.Errorf("the log shrank from %v leaves", prev.Size)
+			} else if p, err = c.Consistency(prev.Size, th.Size); err == nil {
+				err = p.Verify(prev, th)
+			}
+			consistent = check(err, "Consistent with the tree head of size %v from %v", prev.Size, prev.Timestamp.UTC().Format(time.RFC3339))
+		}
+		if consistent {
+			state[signer.String()] = th
+		}
+
+		for _, epoch := range epochs {
+			p, err := c.Inclusion(epoch, th.Size)
+			if err == nil {
+				err = p.Verify(th)
+			}
+			if !check(err, "Epoch %v: included in the log", epoch) {
+				continue
+			}
+			if !bytes.Equal(p.LeafHash, leaves[epoch]) {
+				err = errors.New("split view")
+			}
+			check(err, "Epoch %v: the logged document is the one served to us", epoch)
+			if logged[epoch] == nil {
+				logged[epoch] = make(map[string]bool)
+			}
+			logged[epoch][string(p.LeafHash)] = true
+		}
+	}
+
+	if len(logs) > 1 {
+		fmt.Fprintf(w, "Across the logs:\n")
+		for _, epoch := range epochs {
+			var err error
+			if n := len(logged[epoch]); n > 1 {
+				err = fmt.Errorf("split view, %v distinct documents", n)
+			}
+			check(err, "Epoch %v: every log holds the same document", epoch)
+		}
+	}
+	return problems
+}
+
+// authorityKeys returns the identity keys of the configured authorities.
+func (a *authorityFlags) authorityKeys() ([]*eddsa.PublicKey, error) {
+	if a.cfgFile == "" {
+		if a.publicKey == "" {
+			return nil, errors.New("either -f or -key must be specified")
+		}
+		k := new(eddsa.PublicKey)
+		if err := k.FromString(a.publicKey); err != nil {
+			return nil, fmt.Errorf("invalid authority public key: %v", err)
+		}
+		return []*eddsa.PublicKey{k}, nil
+	}
+
+	pkiCfg, err := loadPKIConfig(a.cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case pkiCfg.Nonvoting != nil:
+		k := new(eddsa.PublicKey)
+		if err := k.FromString(pkiCfg.Nonvoting.PublicKey); err != nil {
+			return nil, fmt.Errorf("invalid authority public key: %v", err)
+		}
+		return []*eddsa.PublicKey{k}, nil
+	case pkiCfg.Voting != nil:
+		peers, err := config.AuthorityPeersFromPeers(pkiCfg.Voting.Peers)
+		if err != nil {
+			return nil, err
+		}
+		var keys []*eddsa.PublicKey
+		for _, v := range peers {
+			keys = append(keys, v.IdentityPublicKey)
+		}
+		return keys, nil
+	default:
+		return nil, fmt.Errorf("no authority configured in '%v'", a.cfgFile)
+	}
+}
@@ -0,0 +1,196 @@
+// check.go - Katzenpost PKI document tool, `check` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/config"
+)
+
+// rejectionReasons are the reasons an authority rejects a descriptor
+// upload, by the post_descriptor_status error code that it returns, which
+// the server logs as "Failed to post to PKI".
+var rejectionReasons = []struct {
+	code, reason string
+}{
+	{"Forbidden", "the identity key is not in the authority's [[Mixes]] or [[Providers]], or the descriptor is not signed by the uploading node"},
+	{"Invalid", "the descriptor is malformed, has a bad signature, or is for an epoch too far from the authority's clock"},
+	{"Conflict", "a different descriptor was already accepted for the epoch, or it was uploaded after the document was published"},
+}
+
+func cmdCheck(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	af.register(fs)
+	epoch := fs.Uint64("epoch", currentEpoch(), "First epoch to check, the next epoch is also checked.")
+	fs.Parse(args)
+	if af.cfgFile == "" {
+		return errors.New("-f must point at the node's server config file")
+	}
+
+	cfg, err := config.LoadFile(af.cfgFile)
+	if err != nil {
+		return err
+	}
+	identityKey, linkKey, err := loadNodeKeys(cfg)
+	if err != nil {
+		return err
+	}
+	c, err := af.newClient()
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, e := range []uint64{*epoch, *epoch + 1} {
+		doc, _, err := fetchDocument(c, af.timeout, strconv.FormatUint(e, 10))
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "Epoch %v: no document: %v\n", e, err)
+			continue
+		}
+		problems += writeNodeCheck(os.Stdout, doc, cfg, identityKey, linkKey)
+	}
+	if problems > 0 {
+		return fmt.Errorf("%v problem(s) found", problems)
+	}
+	return nil
+}
+
+// writeNodeCheck compares the node's entry in the document with its local
+// config and keys, and returns the number of problems found.
+func writeNodeCheck(w io.Writer, doc *pki.Document, cfg *config.Config, identityKey *eddsa.PublicKey, linkKey *ecdh.PublicKey) int {
+	fmt.Fprintf(w, "Epoch %v:\n", doc.Epoch)
+
+	problems := 0
+	check := func(ok bool, format string, args ...interface{}) {
+		status := "ok  "
+		if !ok {
+			status = "FAIL"
+			problems++
+		}
+		fmt.Fprintf(w, "  [%s] %s\n", status, fmt.Sprintf(format, args...))
+	}
+
+	// The Sphinx geometry is compiled in, and is not a network parameter,
+	// as neither the authority [Parameters] nor the document carry it, so
+	// all this can check is that the topology fits this build's hops.
+	hops := len(doc.Topology) + 2
+	check(hops <= constants.NrHops, "Topology: %v layers, %v hops with the providers (this build: %v)", len(doc.Topology), hops, constants.NrHops)
+
+	var desc *pki.MixDescriptor
+	role := "not listed"
+	for _, v := range doc.Providers {
+		if v.IdentityKey.Equal(identityKey) {
+			desc, role = v, "provider"
+		}
+	}
+	for layer, nodes := range doc.Topology {
+		for _, v := range nodes {
+			if v.IdentityKey.Equal(identityKey) {
+				desc, role = v, fmt.Sprintf("mix, layer %d", layer)
+			}
+		}
+	}
+	check(desc != nil, "Identity key %v: %v", identityKey, role)
+	if desc == nil {
+		fmt.Fprintf(w, "  The authorities did not accept a descriptor for this epoch.  Check the\n")
+		fmt.Fprintf(w, "  server log for \"Failed to post to PKI\", which carries the code, and\n")
+		fmt.Fprintf(w, "  the authority's \"-ctl REJECTION_LIST\", which carries the reason:\n")
+		for _, v := range rejectionReasons {
+			fmt.Fprintf(w, "    %-10s %s\n", v.code+":", v.reason)
+		}
+		return problems
+	}
+
+	check(desc.Name == cfg.Server.Identifier, "Name: %v (configured: %v)", desc.Name, cfg.Server.Identifier)
+	check((desc.Layer == pki.LayerProvider) == cfg.Server.IsProvider, "Role: IsProvider = %v", cfg.Server.IsProvider)
+	check(desc.LinkKey.Equal(linkKey), "LinkKey: %v (local: %v)", desc.LinkKey, linkKey)
+	_, ok := desc.MixKeys[doc.Epoch]
+	check(ok, "MixKeys: key for epoch %v present", doc.Epoch)
+
+	published := make(map[string]bool)
+	for _, addrs := range desc.Addresses {
+		for _, v := range addrs {
+			published[v] = true
+		}
+	}
+	for _, v := range configuredAddresses(cfg) {
+		check(published[v], "Address %v published", v)
+	}
+	return problems
+}
+
+// configuredAddresses returns the addresses the node is configured to
+// advertise, in a stable order.
+func configuredAddresses(cfg *config.Config) []string {
+	var addrs []string
+	if !cfg.Server.OnlyAdvertiseAltAddresses {
+		addrs = append(addrs, cfg.Server.Addresses...)
+	}
+	for _, v := range cfg.Server.AltAddresses {
+		addrs = append(addrs, v...)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// loadNodeKeys loads the node's public identity key and link key from its
+// DataDir, without generating any keys that are missing.
+func loadNodeKeys(cfg *config.Config) (*eddsa.PublicKey, *ecdh.PublicKey, error) {
+	identityKey := new(eddsa.PublicKey)
+	if cfg.Debug.IdentityKey != nil {
+		identityKey = cfg.Debug.IdentityKey.PublicKey()
+	} else {
+		f := filepath.Join(cfg.Server.DataDir, "identity.public.pem")
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, nil, fmt.Errorf("failed to decode PEM file '%v'", f)
+		}
+		if err = identityKey.FromBytes(blk.Bytes); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	linkKey, err := ecdh.Load(filepath.Join(cfg.Server.DataDir, "link.private.pem"), "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer linkKey.Reset()
+	pubKey := new(ecdh.PublicKey)
+	if err = pubKey.FromBytes(linkKey.PublicKey().Bytes()); err != nil {
+		return nil, nil, err
+	}
+	return identityKey, pubKey, nil
+}
@@ -0,0 +1,154 @@
+// diff.go - Katzenpost PKI document tool, `diff` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/katzenpost/core/pki"
+)
+
+func cmdDiff(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	af.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [arguments] <epoch|file> <epoch|file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("two documents are required")
+	}
+
+	c, err := af.newClient()
+	if err != nil {
+		return err
+	}
+	a, _, err := fetchDocument(c, af.timeout, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, _, err := fetchDocument(c, af.timeout, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	writeDocumentDiff(os.Stdout, a, b)
+	return nil
+}
+
+// writeDocumentDiff writes the differences between the documents a and b,
+// one per line, prefixed by `-` for removals, `+` for additions, and `~`
+// for modifications.
+func writeDocumentDiff(w io.Writer, a, b *pki.Document) {
+	fmt.Fprintf(w, "--- epoch %v\n+++ epoch %v\n", a.Epoch, b.Epoch)
+
+	bParams := documentParameters(b)
+	for i, p := range documentParameters(a) {
+		if p.value != bParams[i].value {
+			fmt.Fprintf(w, "~ %v: %v -> %v\n", p.name, p.value, bParams[i].value)
+		}
+	}
+	if len(a.Topology) != len(b.Topology) {
+		fmt.Fprintf(w, "~ Layers: %v -> %v\n", len(a.Topology), len(b.Topology))
+	}
+
+	aNodes, bNodes := documentNodes(a), documentNodes(b)
+	for _, id := range sortedNodeIDs(aNodes, bNodes) {
+		aDesc, inA := aNodes[id]
+		bDesc, inB := bNodes[id]
+		switch {
+		case !inB:
+			fmt.Fprintf(w, "- %v (%v) %v\n", aDesc.Name, id, layerToString(aDesc.Layer))
+		case !inA:
+			fmt.Fprintf(w, "+ %v (%v) %v\n", bDesc.Name, id, layerToString(bDesc.Layer))
+		default:
+			writeDescriptorDiff(w, id, aDesc, bDesc)
+		}
+	}
+}
+
+func writeDescriptorDiff(w io.Writer, id string, a, b *pki.MixDescriptor) {
+	prefix := fmt.Sprintf("~ %v (%v)", b.Name, id)
+	if a.Name != b.Name {
+		fmt.Fprintf(w, "%v Name: %v -> %v\n", prefix, a.Name, b.Name)
+	}
+	if a.Layer != b.Layer {
+		fmt.Fprintf(w, "%v Layer: %v -> %v\n", prefix, layerToString(a.Layer), layerToString(b.Layer))
+	}
+	if !a.LinkKey.Equal(b.LinkKey) {
+		fmt.Fprintf(w, "%v LinkKey: %v -> %v\n", prefix, a.LinkKey, b.LinkKey)
+	}
+	for e, k := range a.MixKeys {
+		// Mix keys for the epochs covered by both descriptors must never
+		// change, anything else is the expected key rotation.
+		if bk, ok := b.MixKeys[e]; ok && !k.Equal(bk) {
+			fmt.Fprintf(w, "%v MixKeys[%v]: %v -> %v\n", prefix, e, k, bk)
+		}
+	}
+	if !reflect.DeepEqual(a.Addresses, b.Addresses) {
+		fmt.Fprintf(w, "%v Addresses: %v -> %v\n", prefix, a.Addresses, b.Addresses)
+	}
+	if !reflect.DeepEqual(a.Kaetzchen, b.Kaetzchen) {
+		fmt.Fprintf(w, "%v Kaetzchen: %v -> %v\n", prefix, a.Kaetzchen, b.Kaetzchen)
+	}
+}
+
+// documentNodes returns all of the document's descriptors, keyed by
+// identity key.
+func documentNodes(doc *pki.Document) map[string]*pki.MixDescriptor {
+	m := make(map[string]*pki.MixDescriptor)
+	for _, nodes := range doc.Topology {
+		for _, desc := range nodes {
+			m[desc.IdentityKey.String()] = desc
+		}
+	}
+	for _, desc := range doc.Providers {
+		m[desc.IdentityKey.String()] = desc
+	}
+	return m
+}
+
+func sortedNodeIDs(maps ...map[string]*pki.MixDescriptor) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, m := range maps {
+		for id := range m {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func layerToString(l uint8) string {
+	if l == pki.LayerProvider {
+		return "provider"
+	}
+	return fmt.Sprintf("layer %d", l)
+}
@@ -0,0 +1,205 @@
+// get.go - Katzenpost PKI document tool, `get` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/pki"
+)
+
+func cmdGet(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	af.register(fs)
+	epoch := fs.Uint64("epoch", currentEpoch(), "Epoch of the document to fetch.")
+	asJSON := fs.Bool("json", false, "Print the document as JSON.")
+	outFile := fs.String("o", "", "Save the raw signed document to this file.")
+	capa := fs.String("capability", "", "Only print the parameters that each provider of this Kaetzchen capability publishes.")
+	fs.Parse(args)
+
+	c, err := af.newClient()
+	if err != nil {
+		return err
+	}
+	doc, raw, err := fetchDocument(c, af.timeout, strconv.FormatUint(*epoch, 10))
+	if err != nil {
+		return err
+	}
+	if *outFile != "" {
+		if err = ioutil.WriteFile(*outFile, raw, 0644); err != nil {
+			return err
+		}
+	}
+	if *capa != "" {
+		services := kaetzchenParameters(doc, *capa)
+		if len(services) == 0 {
+			return fmt.Errorf("no provider offers '%v'", *capa)
+		}
+		if *asJSON {
+			b, err := json.MarshalIndent(services, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", b)
+			return nil
+		}
+		writeKaetzchenText(os.Stdout, services)
+		return nil
+	}
+	if *asJSON {
+		return writeDocumentJSON(os.Stdout, doc)
+	}
+	writeDocumentText(os.Stdout, doc)
+	return nil
+}
+
+// kaetzchenParameters returns the parameters of the Kaetzchen capability
+// by provider name, as published in each provider's descriptor.
+func kaetzchenParameters(doc *pki.Document, capa string) map[string]map[string]interface{} {
+	services := make(map[string]map[string]interface{})
+	for _, desc := range doc.Providers {
+		if params, ok := desc.Kaetzchen[capa]; ok {
+			services[desc.Name] = params
+		}
+	}
+	return services
+}
+
+func writeKaetzchenText(w io.Writer, services map[string]map[string]interface{}) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%v\n", name)
+		keys := make([]string, 0, len(services[name]))
+		for k := range services[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %v: %v\n", k, services[name][k])
+		}
+	}
+}
+
+func writeDocumentJSON(w io.Writer, doc *pki.Document) error {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func writeDocumentText(w io.Writer, doc *pki.Document) {
+	fmt.Fprintf(w, "Epoch: %v\n", doc.Epoch)
+	fmt.Fprintf(w, "SharedRandomValue: %v\n", base64.StdEncoding.EncodeToString(doc.SharedRandomValue))
+	fmt.Fprintf(w, "Parameters:\n")
+	for _, p := range documentParameters(doc) {
+		fmt.Fprintf(w, "  %-18s %v\n", p.name+":", p.value)
+	}
+	fmt.Fprintf(w, "Topology:\n")
+	for layer, nodes := range doc.Topology {
+		fmt.Fprintf(w, "  Layer %d:\n", layer)
+		for _, desc := range nodes {
+			writeDescriptorText(w, desc, "    ")
+		}
+	}
+	fmt.Fprintf(w, "Providers:\n")
+	for _, desc := range doc.Providers {
+		writeDescriptorText(w, desc, "  ")
+	}
+}
+
+func writeDescriptorText(w io.Writer, desc *pki.MixDescriptor, indent string) {
+	fmt.Fprintf(w, "%s%v\n", indent, desc.Name)
+	indent += "  "
+	fmt.Fprintf(w, "%sIdentityKey: %v\n", indent, desc.IdentityKey)
+	fmt.Fprintf(w, "%sLinkKey: %v\n", indent, desc.LinkKey)
+	fmt.Fprintf(w, "%sMixKeys:\n", indent)
+	for _, e := range sortedEpochs(desc.MixKeys) {
+		fmt.Fprintf(w, "%s  %v: %v\n", indent, e, desc.MixKeys[e])
+	}
+	fmt.Fprintf(w, "%sAddresses:\n", indent)
+	for _, t := range sortedTransports(desc.Addresses) {
+		fmt.Fprintf(w, "%s  %v: %v\n", indent, t, desc.Addresses[t])
+	}
+	if len(desc.Kaetzchen) > 0 {
+		fmt.Fprintf(w, "%sKaetzchen:\n", indent)
+		capas := make([]string, 0, len(desc.Kaetzchen))
+		for capa := range desc.Kaetzchen {
+			capas = append(capas, capa)
+		}
+		sort.Strings(capas)
+		for _, capa := range capas {
+			fmt.Fprintf(w, "%s  %v: %v\n", indent, capa, desc.Kaetzchen[capa])
+		}
+	}
+}
+
+type parameter struct {
+	name  string
+	value interface{}
+}
+
+// documentParameters returns the network parameters carried in the
+// document, in a stable order.
+func documentParameters(doc *pki.Document) []parameter {
+	return []parameter{
+		{"SendRatePerMinute", doc.SendRatePerMinute},
+		{"Mu", doc.Mu},
+		{"MuMaxDelay", doc.MuMaxDelay},
+		{"LambdaP", doc.LambdaP},
+		{"LambdaPMaxDelay", doc.LambdaPMaxDelay},
+		{"LambdaL", doc.LambdaL},
+		{"LambdaLMaxDelay", doc.LambdaLMaxDelay},
+		{"LambdaD", doc.LambdaD},
+		{"LambdaDMaxDelay", doc.LambdaDMaxDelay},
+		{"LambdaM", doc.LambdaM},
+		{"LambdaMMaxDelay", doc.LambdaMMaxDelay},
+	}
+}
+
+func sortedEpochs(m map[uint64]*ecdh.PublicKey) []uint64 {
+	epochs := make([]uint64, 0, len(m))
+	for e := range m {
+		epochs = append(epochs, e)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs
+}
+
+func sortedTransports(m map[pki.Transport][]string) []pki.Transport {
+	transports := make([]pki.Transport, 0, len(m))
+	for t := range m {
+		transports = append(transports, t)
+	}
+	sort.Slice(transports, func(i, j int) bool { return transports[i] < transports[j] })
+	return transports
+}
@@ -0,0 +1,123 @@
+// keyaudit.go - Katzenpost PKI tool key directory monitor.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/daemons/internal/keydir"
+	"github.com/katzenpost/daemons/internal/translog"
+)
+
+func cmdKeyAudit(args []string) error {
+	fs := flag.NewFlagSet("keyaudit", flag.ExitOnError)
+	dirURL := fs.String("url", "", "Base URL of the provider's key directory.")
+	key := fs.String("key", "", "Public key of the key directory, as published in the PKI document.")
+	stateFile := fs.String("state", "", "File that keeps the verified directory between runs.")
+	users := fs.String("users", "", "Comma separated users to watch, by default every user.")
+	timeout := fs.Duration("timeout", defaultTimeout, "Network timeout.")
+	fs.Parse(args)
+
+	if *dirURL == "" || *key == "" || *stateFile == "" {
+		return errors.New("-url, -key and -state are mandatory")
+	}
+	k := new(eddsa.PublicKey)
+	if err := k.FromString(*key); err != nil {
+		return fmt.Errorf("invalid key directory public key: %v", err)
+	}
+	state := new(keydir.MonitorState)
+	if b, err := ioutil.ReadFile(*stateFile); err == nil {
+		if err = json.Unmarshal(b, state); err != nil {
+			return fmt.Errorf("invalid state file '%v': %v", *stateFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var watched map[string]bool
+	if *users != "" {
+		watched = make(map[string]bool)
+		for _, v := range strings.Split(*users, ",") {
+			watched[strings.TrimSpace(v)] = true
+		}
+	}
+
+	c := &keydir.Client{URL: *dirURL, HTTPClient: &http.Client{Timeout: *timeout}}
+	prev := state.Head
+	changes, err := keydir.Monitor(c, k, state)
+	if err != nil {
+		return fmt.Errorf("the key directory failed the audit: %v", err)
+	}
+	alerts := writeKeyAudit(os.Stdout, prev, state, changes, watched)
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(*stateFile, b, 0600); err != nil {
+		return err
+	}
+	if alerts > 0 {
+		return fmt.Errorf("%v key change(s) of watched users", alerts)
+	}
+	return nil
+}
+
+// writeKeyAudit writes the directory's tree head, and the entries added
+// since the tree head prev, and returns the number of key changes of the
+// watched users, or of every user if watched is nil.  A user's first key
+// is not a change.
+func writeKeyAudit(w io.Writer, prev *translog.TreeHead, state *keydir.MonitorState, changes []*keydir.Change, watched map[string]bool) int {
+	th := state.Head
+	fmt.Fprintf(w, "Size: %v\n", th.Size)
+	fmt.Fprintf(w, "Root: %v\n", base64.StdEncoding.EncodeToString(th.Root))
+	if prev != nil {
+		fmt.Fprintf(w, "Consistent with the tree head of size %v from %v\n", prev.Size, prev.Timestamp.UTC().Format(time.RFC3339))
+	}
+
+	alerts := 0
+	for _, c := range changes {
+		if watched != nil && !watched[c.User] {
+			continue
+		}
+		ts := time.Unix(c.Timestamp, 0).UTC().Format(time.RFC3339)
+		switch {
+		case c.First:
+			fmt.Fprintf(w, "  %v %v: new key %v\n", ts, c.User, c.IdentityKey)
+		case c.Previous == "":
+			fmt.Fprintf(w, "  %v %v: KEY ADDED after removal, %v\n", ts, c.User, c.IdentityKey)
+			alerts++
+		case c.IdentityKey == "":
+			fmt.Fprintf(w, "  %v %v: KEY REMOVED, was %v\n", ts, c.User, c.Previous)
+			alerts++
+		default:
+			fmt.Fprintf(w, "  %v %v: KEY CHANGED from %v to %v\n", ts, c.User, c.Previous, c.IdentityKey)
+			alerts++
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,258 @@
+// main.go - Katzenpost PKI document tool.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	nClient "github.com/katzenpost/authority/nonvoting/client"
+	vClient "github.com/katzenpost/authority/voting/client"
+	aConfig "github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/server/config"
+)
+
+const defaultTimeout = 30 * time.Second
+
+type command struct {
+	name  string
+	usage string
+	fn    func(args []string) error
+}
+
+var commands = []*command{
+	{"get", "Fetch, verify and print the document for an epoch.", cmdGet},
+	{"diff", "Compare the documents for two epochs.", cmdDiff},
+	{"tune", "Compute the parameters for the next epoch from a policy.", cmdTune},
+	{"topology", "Simulate a layer assignment policy on a whitelist.", cmdTopology},
+	{"check", "Check a node's own entry in the current and next documents.", cmdCheck},
+	{"srv", "Verify the shared random value of a voting authority document.", cmdSRV},
+	{"audit", "Audit the authorities' document transparency logs.", cmdAudit},
+	{"keyaudit", "Monitor a provider's key directory for key changes.", cmdKeyAudit},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the command's arguments.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(-1)
+	}
+
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.fn(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	usage()
+	os.Exit(-1)
+}
+
+// authorityFlags are the flags common to every command that needs to talk
+// to, or verify documents signed by, the directory authorities.
+type authorityFlags struct {
+	cfgFile   string
+	authority string
+	publicKey string
+	timeout   time.Duration
+	verbose   bool
+}
+
+func (a *authorityFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&a.cfgFile, "f", "", "Path to a server config file with a [PKI] section.")
+	fs.StringVar(&a.authority, "authority", "", "Address of the authority to query.")
+	fs.StringVar(&a.publicKey, "key", "", "Non-voting authority public key in Base16 or Base64 format.")
+	fs.DurationVar(&a.timeout, "timeout", defaultTimeout, "Network timeout.")
+	fs.BoolVar(&a.verbose, "v", false, "Enable debug logging to stdout.")
+}
+
+// newClient returns a pki.Client that verifies documents against the
+// configured authority keys.  If a config file is provided, the [PKI]
+// section is used, and -authority restricts queries to the authority with
+// the matching address.  Otherwise a non-voting authority is assumed, and
+// both -authority and -key are mandatory.
+func (a *authorityFlags) newClient() (pki.Client, error) {
+	// The log backend's disable option does not tolerate writes, so discard
+	// the output instead.
+	logFile := os.DevNull
+	if a.verbose {
+		logFile = ""
+	}
+	logBackend, err := log.New(logFile, "DEBUG", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.cfgFile == "" {
+		if a.authority == "" || a.publicKey == "" {
+			return nil, errors.New("either -f, or both -authority and -key must be specified")
+		}
+		pubKey := new(eddsa.PublicKey)
+		if err := pubKey.FromString(a.publicKey); err != nil {
+			return nil, fmt.Errorf("invalid authority public key: %v", err)
+		}
+		return nClient.New(&nClient.Config{
+			LogBackend: logBackend,
+			Address:    a.authority,
+			PublicKey:  pubKey,
+		})
+	}
+
+	pkiCfg, err := loadPKIConfig(a.cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case pkiCfg.Nonvoting != nil:
+		addr := pkiCfg.Nonvoting.Address
+		if a.authority != "" {
+			addr = a.authority
+		}
+		pubKey := new(eddsa.PublicKey)
+		if err := pubKey.FromString(pkiCfg.Nonvoting.PublicKey); err != nil {
+			return nil, fmt.Errorf("invalid authority public key: %v", err)
+		}
+		return nClient.New(&nClient.Config{
+			LogBackend: logBackend,
+			Address:    addr,
+			PublicKey:  pubKey,
+		})
+	case pkiCfg.Voting != nil:
+		peers, err := config.AuthorityPeersFromPeers(pkiCfg.Voting.Peers)
+		if err != nil {
+			return nil, err
+		}
+		c, err := vClient.New(&vClient.Config{
+			LogBackend:  logBackend,
+			Authorities: peers,
+		})
+		if err != nil || a.authority == "" {
+			return c, err
+		}
+
+		// Only query the requested authority, but continue to verify the
+		// signatures against the entire configured peer set.
+		var peer *aConfig.AuthorityPeer
+		for _, v := range peers {
+			for _, addr := range v.Addresses {
+				if addr == a.authority {
+					peer = v
+				}
+			}
+		}
+		if peer == nil {
+			return nil, fmt.Errorf("authority '%v' is not a configured peer", a.authority)
+		}
+		pc, err := vClient.New(&vClient.Config{
+			LogBackend:  logBackend,
+			Authorities: []*aConfig.AuthorityPeer{peer},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &pinnedClient{Client: c, peer: pc}, nil
+	default:
+		return nil, fmt.Errorf("no authority configured in '%v'", a.cfgFile)
+	}
+}
+
+// pinnedClient fetches documents from a single voting authority, and
+// verifies them against the threshold of the full authority set.
+type pinnedClient struct {
+	pki.Client
+
+	peer pki.Client
+}
+
+func (c *pinnedClient) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	_, raw, err := c.peer.Get(ctx, epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := c.Client.Deserialize(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, raw, nil
+}
+
+// loadPKIConfig loads just the [PKI] section of a server config file.
+func loadPKIConfig(f string) (*config.PKI, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		PKI *config.PKI
+	}
+	if _, err = toml.Decode(string(b), &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.PKI == nil {
+		return nil, fmt.Errorf("no [PKI] section in '%v'", f)
+	}
+	return cfg.PKI, nil
+}
+
+// fetchDocument returns the verified document and its raw signed form,
+// where src is either an epoch number or the path to a raw document
+// previously saved with `get -o`.
+func fetchDocument(c pki.Client, timeout time.Duration, src string) (*pki.Document, []byte, error) {
+	if epoch, err := strconv.ParseUint(src, 10, 64); err == nil {
+		ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+		defer cancelFn()
+		return c.Get(ctx, epoch)
+	}
+
+	raw, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := c.Deserialize(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("'%v' failed verification: %v", src, err)
+	}
+	return doc, raw, nil
+}
+
+func currentEpoch() uint64 {
+	epoch, _, _ := epochtime.Now()
+	return epoch
+}
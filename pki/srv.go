@@ -0,0 +1,115 @@
+// srv.go - Katzenpost PKI document tool, `srv` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/daemons/internal/sharedrandom"
+)
+
+func cmdSRV(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("srv", flag.ExitOnError)
+	af.register(fs)
+	epoch := fs.Uint64("epoch", currentEpoch(), "Epoch of the document to verify.")
+	transcriptFile := fs.String("transcript", "", "Commit-and-reveal transcript (JSON) to recompute the shared random value from.  The authorities do not publish one, so it must be collected from the authority operators.")
+	fs.Parse(args)
+
+	c, err := af.newClient()
+	if err != nil {
+		return err
+	}
+	doc, raw, err := fetchDocument(c, af.timeout, strconv.FormatUint(*epoch, 10))
+	if err != nil {
+		return err
+	}
+	var prev []byte
+	if prevDoc, _, err := fetchDocument(c, af.timeout, strconv.FormatUint(*epoch-1, 10)); err == nil {
+		prev = prevDoc.SharedRandomValue
+	} else {
+		fmt.Fprintf(os.Stdout, "No document for epoch %v, recomputing with the all zero previous value the authorities use without one: %v\n", *epoch-1, err)
+	}
+
+	var t *sharedrandom.Transcript
+	if *transcriptFile != "" {
+		if t, err = sharedrandom.LoadTranscript(*transcriptFile); err != nil {
+			return err
+		}
+	}
+	if problems := writeSRVCheck(os.Stdout, doc, raw, prev, t); problems > 0 {
+		return fmt.Errorf("%v problem(s) found", problems)
+	}
+	return nil
+}
+
+// writeSRVCheck checks the shared random value of the document doc, signed
+// as raw, and returns the number of problems found.  Only the length can be
+// checked without the transcript t.  With it, the value is recomputed from
+// the reveals and the previous epoch's value prev, which is what chains the
+// value to prev.
+func writeSRVCheck(w io.Writer, doc *pki.Document, raw, prev []byte, t *sharedrandom.Transcript) int {
+	problems := 0
+	check := func(ok bool, format string, args ...interface{}) {
+		status := "ok  "
+		if !ok {
+			status = "FAIL"
+			problems++
+		}
+		fmt.Fprintf(w, "  [%s] %s\n", status, fmt.Sprintf(format, args...))
+	}
+
+	fmt.Fprintf(w, "Epoch %v:\n", doc.Epoch)
+	fmt.Fprintf(w, "  SharedRandomValue: %v\n", base64.StdEncoding.EncodeToString(doc.SharedRandomValue))
+	check(len(doc.SharedRandomValue) == sharedrandom.ValueLength, "Length: %v bytes", len(doc.SharedRandomValue))
+	if prev != nil {
+		fmt.Fprintf(w, "  Previous:          %v\n", base64.StdEncoding.EncodeToString(prev))
+	}
+	if t == nil {
+		fmt.Fprintf(w, "  No transcript, the value and its chaining to the previous value can not be verified.\n")
+		return problems
+	}
+
+	check(t.Epoch == doc.Epoch, "Transcript epoch: %v", t.Epoch)
+	signers := make(map[[32]byte]bool)
+	if sigs, err := cert.GetSignatures(raw); err == nil {
+		for _, v := range sigs {
+			var id [32]byte
+			copy(id[:], v.Identity)
+			signers[id] = true
+		}
+	}
+	srv, excluded := t.Compute(prev)
+	for _, e := range t.Entries {
+		if err, ok := excluded[e]; ok {
+			fmt.Fprintf(w, "  [----] %v: excluded: %v\n", e.IdentityKey, err)
+			continue
+		}
+		check(signers[e.IdentityKey.ByteArray()], "%v: contributed, and signed the document", e.IdentityKey)
+	}
+	check(bytes.Equal(srv, doc.SharedRandomValue), "Recomputed from %v of %v contributions and the previous value: %v",
+		len(t.Entries)-len(excluded), len(t.Entries), base64.StdEncoding.EncodeToString(srv))
+	return problems
+}
@@ -0,0 +1,216 @@
+// topology.go - Katzenpost PKI document tool, `topology` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/daemons/internal/topology"
+)
+
+func cmdTopology(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("topology", flag.ExitOnError)
+	af.register(fs)
+	whitelistFile := fs.String("whitelist", "", "Path to an authority config file with the [[Mixes]] whitelist.")
+	policyFile := fs.String("policy", "", "Path to the layer assignment policy file.")
+	prevSrc := fs.String("prev", "", "Epoch or raw document file to use as the previous topology.")
+	seedStr := fs.String("seed", "", "Seed in Base16, defaults to the previous document's shared random value.")
+	epochs := fs.Int("epochs", 1, "Number of successive epochs to simulate.")
+	churn := fs.Float64("churn", 0, "Fraction of the mixes that are absent in each simulated epoch.")
+	fs.Parse(args)
+	if *whitelistFile == "" || *policyFile == "" {
+		return errors.New("-whitelist and -policy must be specified")
+	}
+	if *churn < 0 || *churn >= 1 {
+		return fmt.Errorf("-churn %v is not in [0, 1)", *churn)
+	}
+
+	policy, err := topology.LoadPolicy(*policyFile)
+	if err != nil {
+		return err
+	}
+	mixes, err := loadWhitelist(*whitelistFile)
+	if err != nil {
+		return err
+	}
+
+	var prev [][]topology.NodeID
+	var seed []byte
+	if *prevSrc != "" {
+		c, err := af.newClient()
+		if err != nil {
+			return err
+		}
+		doc, _, err := fetchDocument(c, af.timeout, *prevSrc)
+		if err != nil {
+			return err
+		}
+		prev = documentTopology(doc)
+		seed = doc.SharedRandomValue
+
+		// The whitelist has no addresses, so take them from the document
+		// for any subnet families.
+		addrs := make(map[topology.NodeID][]string)
+		for _, desc := range flattenTopology(doc) {
+			id := topology.NodeID(desc.IdentityKey.ByteArray())
+			for _, v := range desc.Addresses {
+				addrs[id] = append(addrs[id], v...)
+			}
+		}
+		for _, n := range mixes {
+			n.Addresses = addrs[n.ID]
+		}
+	}
+	if *seedStr != "" {
+		if seed, err = hex.DecodeString(*seedStr); err != nil {
+			return fmt.Errorf("invalid seed: %v", err)
+		}
+	}
+
+	for i := 0; i < *epochs; i++ {
+		present := mixes
+		if *churn > 0 {
+			present = absentFilter(mixes, seed, *churn)
+		}
+		t, err := policy.Assign(present, prev, seed)
+		fmt.Fprintf(os.Stdout, "Epoch +%d: %d of %d mixes present", i, len(present), len(mixes))
+		if prev != nil {
+			fmt.Fprintf(os.Stdout, ", %d moved", movedNodes(prev, t))
+		}
+		fmt.Fprintf(os.Stdout, "\n")
+		writeTopology(os.Stdout, t, policy, mixes)
+		if err != nil {
+			return err
+		}
+
+		prev = t
+		h := sha256.Sum256(seed)
+		seed = h[:]
+	}
+	return nil
+}
+
+// loadWhitelist loads the identity keys of the [[Mixes]] entries of an
+// authority config file.
+func loadWhitelist(f string) ([]*topology.Node, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Mixes []*struct {
+			IdentityKey *eddsa.PublicKey
+		}
+	}
+	if _, err = toml.Decode(string(b), &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Mixes) == 0 {
+		return nil, fmt.Errorf("no [[Mixes]] in '%v'", f)
+	}
+	nodes := make([]*topology.Node, 0, len(cfg.Mixes))
+	for _, v := range cfg.Mixes {
+		if v.IdentityKey == nil {
+			return nil, fmt.Errorf("[[Mixes]] entry without an IdentityKey in '%v'", f)
+		}
+		nodes = append(nodes, &topology.Node{ID: v.IdentityKey.ByteArray()})
+	}
+	return nodes, nil
+}
+
+func flattenTopology(doc *pki.Document) []*pki.MixDescriptor {
+	var descs []*pki.MixDescriptor
+	for _, nodes := range doc.Topology {
+		descs = append(descs, nodes...)
+	}
+	return descs
+}
+
+func documentTopology(doc *pki.Document) [][]topology.NodeID {
+	t := make([][]topology.NodeID, len(doc.Topology))
+	for layer, nodes := range doc.Topology {
+		for _, desc := range nodes {
+			t[layer] = append(t[layer], desc.IdentityKey.ByteArray())
+		}
+	}
+	return t
+}
+
+// absentFilter deterministically drops the given fraction of the nodes.
+func absentFilter(nodes []*topology.Node, seed []byte, fraction float64) []*topology.Node {
+	ret := make([]*topology.Node, 0, len(nodes))
+	for _, n := range nodes {
+		h := sha256.New()
+		h.Write([]byte("absent"))
+		h.Write(seed)
+		h.Write(n.ID[:])
+		v := binary.BigEndian.Uint64(h.Sum(nil))
+		if float64(v)/(1<<64) >= fraction {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+func movedNodes(prev, next [][]topology.NodeID) int {
+	prevLayer := make(map[topology.NodeID]int)
+	for layer, nodes := range prev {
+		for _, id := range nodes {
+			prevLayer[id] = layer
+		}
+	}
+	n := 0
+	for layer, nodes := range next {
+		for _, id := range nodes {
+			if l, ok := prevLayer[id]; ok && l != layer {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func writeTopology(w io.Writer, t [][]topology.NodeID, policy *topology.Policy, nodes []*topology.Node) {
+	nodeMap := make(map[topology.NodeID]*topology.Node)
+	for _, n := range nodes {
+		nodeMap[n.ID] = n
+	}
+	for layer, ids := range t {
+		fmt.Fprintf(w, "  Layer %d (%d mixes):\n", layer, len(ids))
+		for _, id := range ids {
+			var pk eddsa.PublicKey
+			pk.FromBytes(id[:])
+			if f := policy.FamilyOf(nodeMap[id]); f != "" {
+				fmt.Fprintf(w, "    %v (family: %v)\n", &pk, f)
+			} else {
+				fmt.Fprintf(w, "    %v\n", &pk)
+			}
+		}
+	}
+}
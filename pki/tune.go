@@ -0,0 +1,105 @@
+// tune.go - Katzenpost PKI document tool, `tune` command.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/daemons/internal/tuning"
+)
+
+func cmdTune(args []string) error {
+	var af authorityFlags
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	af.register(fs)
+	epoch := fs.Uint64("epoch", currentEpoch(), "Epoch of the document to tune from.")
+	policyFile := fs.String("policy", "", "Path to the tuning policy file.")
+	outFile := fs.String("o", "", "Write the computed [Parameters] section to this file.")
+	fs.Parse(args)
+	if *policyFile == "" {
+		return errors.New("-policy must be specified")
+	}
+
+	policy, err := tuning.LoadPolicy(*policyFile)
+	if err != nil {
+		return err
+	}
+	c, err := af.newClient()
+	if err != nil {
+		return err
+	}
+	doc, _, err := fetchDocument(c, af.timeout, strconv.FormatUint(*epoch, 10))
+	if err != nil {
+		return err
+	}
+	r, err := policy.Compute(doc)
+	if err != nil {
+		return err
+	}
+
+	writeTuningResult(os.Stdout, doc, r)
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return toml.NewEncoder(f).Encode(&struct {
+			Parameters *tuning.Parameters
+		}{&r.Parameters})
+	}
+	return nil
+}
+
+func writeTuningResult(w io.Writer, doc *pki.Document, r *tuning.Result) {
+	p := &r.Parameters
+	next := &pki.Document{
+		Epoch:             doc.Epoch + 1,
+		SendRatePerMinute: p.SendRatePerMinute,
+		Mu:                p.Mu,
+		MuMaxDelay:        p.MuMaxDelay,
+		LambdaP:           p.LambdaP,
+		LambdaPMaxDelay:   p.LambdaPMaxDelay,
+		LambdaL:           p.LambdaL,
+		LambdaLMaxDelay:   p.LambdaLMaxDelay,
+		LambdaD:           p.LambdaD,
+		LambdaDMaxDelay:   p.LambdaDMaxDelay,
+		LambdaM:           p.LambdaM,
+		LambdaMMaxDelay:   p.LambdaMMaxDelay,
+	}
+
+	fmt.Fprintf(w, "Parameters (epoch %v -> tuned):\n", doc.Epoch)
+	nextParams := documentParameters(next)
+	for i, cur := range documentParameters(doc) {
+		mark := " "
+		if cur.value != nextParams[i].value {
+			mark = "~"
+		}
+		fmt.Fprintf(w, "%s %-18s %v -> %v\n", mark, cur.name+":", cur.value, nextParams[i].value)
+	}
+	fmt.Fprintf(w, "Reasoning:\n")
+	for _, v := range r.Reasons {
+		fmt.Fprintf(w, "  %v\n", v)
+	}
+}
@@ -0,0 +1,84 @@
+// main.go - Katzenpost Kaetzchen socket plugin bridge.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The bridge is a CBOR Kaetzchen plugin that forwards the provider's
+// requests to a long running Kaetzchen service over the framed protocol of
+// the plugin/socket package, so that the service can be deployed and
+// restarted independently of the provider.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/daemons/plugin/socket"
+	"github.com/katzenpost/server/cborplugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// bridge is the plugin.Handler that forwards requests to the service.
+type bridge struct {
+	*socket.Pool
+
+	log *logging.Logger
+}
+
+func (b *bridge) Parameters() cborplugin.Parameters {
+	// The provider only asks once, when it starts the plugin.
+	params, err := b.FetchParameters()
+	if err != nil {
+		b.log.Warningf("Failed to fetch the service's parameters, publishing none: %v", err)
+		return nil
+	}
+	return params
+}
+
+func main() {
+	cfg := new(socket.Config)
+	flag.StringVar(&cfg.Address, "address", "", "Service address, \"unix:/path/to/socket\" or \"tcp:127.0.0.1:1234\".")
+	flag.IntVar(&cfg.MaxConns, "max-conns", 2, "Maximum number of connections to the service.")
+	flag.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "Connection and request timeout.")
+	flag.DurationVar(&cfg.HealthInterval, "health-interval", 30*time.Second, "Interval between health checks, 0 disables them.")
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged, as the provider does not read the plugin's output.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	if cfg.Address == "" {
+		fmt.Fprintf(os.Stderr, "-address is mandatory\n")
+		os.Exit(-1)
+	}
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("bridge")
+
+	p, err := socket.NewPool(cfg, logBackend.GetLogger("bridge/pool"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+	defer p.Halt()
+
+	if err = plugin.Serve(&bridge{Pool: p, log: logger}, logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,56 @@
+// main.go - Katzenpost echo Kaetzchen plugin.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The echo plugin is the reference CBOR Kaetzchen plugin, which replies
+// to every request with its payload.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/server/cborplugin"
+)
+
+type echo struct{}
+
+func (e *echo) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	return req.Payload, nil
+}
+
+func (e *echo) Parameters() cborplugin.Parameters {
+	return nil
+}
+
+func main() {
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("echo")
+
+	if err = plugin.Serve(new(echo), logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
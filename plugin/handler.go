@@ -0,0 +1,107 @@
+// handler.go - Katzenpost Kaetzchen plugin handlers.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/ugorji/go/codec"
+)
+
+// ErrTimeout is the error returned for a request that a Handler wrapped
+// with WithTimeout did not handle in time.
+var ErrTimeout = errors.New("plugin: request timed out")
+
+// TypedHandler is a Handler for requests and replies that are CBOR encoded
+// values, rather than raw payloads.
+type TypedHandler struct {
+	// NewRequest returns a pointer to a new value to decode a request
+	// into.
+	NewRequest func() interface{}
+
+	// Handle returns the reply to the decoded request, or nil for no
+	// reply.  hasSURB is false when the client can not receive a reply.
+	Handle func(req interface{}, hasSURB bool) (interface{}, error)
+
+	// Params are the parameters to publish in the provider's descriptor.
+	Params cborplugin.Parameters
+}
+
+// OnRequest decodes the request, and encodes the reply of Handle.
+func (h *TypedHandler) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	v := h.NewRequest()
+	if err := codec.NewDecoderBytes(req.Payload, new(codec.CborHandle)).Decode(v); err != nil {
+		return nil, err
+	}
+	resp, err := h.Handle(v, req.HasSURB)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	var b []byte
+	if err = codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(resp); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Parameters returns h.Params.
+func (h *TypedHandler) Parameters() cborplugin.Parameters {
+	return h.Params
+}
+
+type timeoutHandler struct {
+	Handler
+
+	timeout time.Duration
+}
+
+func (h *timeoutHandler) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	type result struct {
+		payload []byte
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		// Serve can not recover a panic in this goroutine.
+		defer func() {
+			if p := recover(); p != nil {
+				ch <- result{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		payload, err := h.Handler.OnRequest(req)
+		ch <- result{payload, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.payload, r.err
+	case <-time.After(h.timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// WithTimeout returns a Handler that fails the requests that h does not
+// handle within timeout, as the provider waits for every reply.  The
+// request keeps running in the background, so a Handler that hangs for
+// good still leaks, and the plugin should rather be run by the
+// supervisor, which restarts it.
+func WithTimeout(h Handler, timeout time.Duration) Handler {
+	return &timeoutHandler{Handler: h, timeout: timeout}
+}
@@ -0,0 +1,186 @@
+// main.go - Katzenpost key directory Kaetzchen plugin.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The key directory plugin is an auditable keyserver CBOR Kaetzchen.  It
+// looks up the identity keys of the provider's users over the provider's
+// management socket, and records every key it serves in an append-only
+// Merkle tree directory (see internal/keydir).  Each reply carries an
+// inclusion proof of the key's entry, under a tree head signed by the
+// directory's key, which it publishes in the PKI document.  The proof only
+// shows that the key is in the directory, not that it is the user's latest
+// entry: a stale key is only detected by the monitors that replay the
+// directory over HTTP (keydir.Monitor, run by `pki keyaudit`), and see
+// every change of a user's key.  Requests and replies are CBOR encoded:
+//
+//	Request:  {Version: 0, User}
+//	Response: {Version: 0, StatusCode, User, PublicKey, Proof}
+//
+// The database can only be opened by one process, so the plugin must be
+// configured with a MaxConcurrency of 1.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/daemons/internal/keydir"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/plugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	keydirVersion = 0
+
+	statusOk          = 0
+	statusSyntaxError = 1
+	statusNoIdentity  = 2
+	statusError       = 3
+
+	cmdUserIdentity = "USER_IDENTITY"
+)
+
+type keydirRequest struct {
+	Version int
+	User    string
+}
+
+type keydirResponse struct {
+	Version    int
+	StatusCode int
+	User       string
+	PublicKey  string
+	Proof      *keydir.LookupProof
+}
+
+type keyDirectory struct {
+	dir        *keydir.Directory
+	mgmtSocket string
+	log        *logging.Logger
+}
+
+func (k *keyDirectory) handle(v interface{}, hasSURB bool) (interface{}, error) {
+	if !hasSURB {
+		return nil, nil
+	}
+	req := v.(*keydirRequest)
+	resp := &keydirResponse{Version: keydirVersion, StatusCode: statusSyntaxError}
+	if req.Version != keydirVersion || !validUser(req.User) {
+		return resp, nil
+	}
+	resp.User = req.User
+
+	// The provider fails the command both for missing users and for users
+	// without an identity key, which are recorded alike.
+	key, err := management.Query(k.mgmtSocket, cmdUserIdentity+" "+req.User)
+	if _, ok := err.(*textproto.Error); ok {
+		key, err = "", nil
+	}
+	if err != nil {
+		k.log.Errorf("Failed to query the provider: %v", err)
+		resp.StatusCode = statusError
+		return resp, nil
+	}
+	key = strings.TrimSpace(key)
+
+	if resp.Proof, err = k.dir.Update(req.User, key); err != nil {
+		k.log.Errorf("Failed to update the directory: %v", err)
+		resp.StatusCode = statusError
+		return resp, nil
+	}
+	if key == "" {
+		resp.StatusCode = statusNoIdentity
+	} else {
+		resp.StatusCode, resp.PublicKey = statusOk, key
+	}
+	return resp, nil
+}
+
+// validUser returns true if user can be passed to the provider's management
+// interface as an argument.
+func validUser(user string) bool {
+	return user != "" && strings.IndexFunc(user, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+func main() {
+	dbFile := flag.String("db", "", "Path to the directory database, usually keydir.db in the provider's DataDir.")
+	keyFile := flag.String("key", "", "Path to the directory's signing key, which is generated if missing.")
+	mgmtSocket := flag.String("management-socket", "", "Path to the provider's management socket.")
+	httpAddr := flag.String("http-address", "", "Address to serve the directory to monitors on, empty disables it.")
+	monitorURL := flag.String("url", "", "Public URL of the -http-address server, to publish in the PKI document.")
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	if *dbFile == "" || *keyFile == "" || *mgmtSocket == "" {
+		fmt.Fprintf(os.Stderr, "-db, -key and -management-socket are mandatory\n")
+		os.Exit(-1)
+	}
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("keydirectory")
+
+	signingKey, err := eddsa.Load(*keyFile, "", rand.Reader)
+	if err != nil {
+		logger.Errorf("Failed to load the signing key: %v", err)
+		os.Exit(-1)
+	}
+	d, err := keydir.New(*dbFile, signingKey)
+	if err != nil {
+		logger.Errorf("Failed to open the directory: %v", err)
+		os.Exit(-1)
+	}
+	defer d.Close()
+
+	if *httpAddr != "" {
+		s, err := keydir.NewServer(d, *httpAddr, logger)
+		if err != nil {
+			logger.Errorf("Failed to serve the directory: %v", err)
+			os.Exit(-1)
+		}
+		defer s.Halt()
+	}
+
+	params := map[string]string{
+		"version": strconv.Itoa(keydirVersion),
+		"key":     signingKey.PublicKey().String(),
+	}
+	if *monitorURL != "" {
+		params["url"] = *monitorURL
+	}
+	k := &keyDirectory{dir: d, mgmtSocket: *mgmtSocket, log: logger}
+	h := &plugin.TypedHandler{
+		NewRequest: func() interface{} { return new(keydirRequest) },
+		Handle:     k.handle,
+		Params:     params,
+	}
+	if err = plugin.Serve(h, logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
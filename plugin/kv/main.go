@@ -0,0 +1,202 @@
+// main.go - Katzenpost key-value store Kaetzchen plugin.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The kv plugin is a reference CBOR Kaetzchen plugin, a rate limited
+// key-value store backed by a bolt database.  Requests and replies are
+// CBOR encoded:
+//
+//	Request:  {Version: 0, Op: "get" | "put" | "delete", Key, Value}
+//	Response: {Version: 0, StatusCode, Value}
+//
+// The database can only be opened by one process, so the plugin must be
+// configured with a MaxConcurrency of 1.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/katzenpost/daemons/plugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	kvVersion = 0
+
+	kvStatusOk          = 0
+	kvStatusSyntaxError = 1
+	kvStatusNotFound    = 2
+	kvStatusRateLimited = 3
+	kvStatusError       = 4
+
+	opGet    = "get"
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+var kvBucket = []byte("kv")
+
+type kvRequest struct {
+	Version int
+	Op      string
+	Key     []byte
+	Value   []byte
+}
+
+type kvResponse struct {
+	Version    int
+	StatusCode int
+	Value      []byte
+}
+
+// limiter is a token bucket, which allows burst requests at once, and
+// rate requests per second on average.
+type limiter struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+type kv struct {
+	db      *bolt.DB
+	limiter *limiter
+	log     *logging.Logger
+}
+
+func (k *kv) handle(v interface{}, hasSURB bool) (interface{}, error) {
+	req := v.(*kvRequest)
+	resp := &kvResponse{Version: kvVersion, StatusCode: kvStatusSyntaxError}
+	switch {
+	case !k.limiter.allow():
+		k.log.Debugf("Rate limited %v request.", req.Op)
+		resp.StatusCode = kvStatusRateLimited
+	case req.Version != kvVersion || len(req.Key) == 0:
+	case req.Op == opGet:
+		err := k.db.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket(kvBucket).Get(req.Key); v != nil {
+				resp.Value = append([]byte{}, v...)
+				resp.StatusCode = kvStatusOk
+			} else {
+				resp.StatusCode = kvStatusNotFound
+			}
+			return nil
+		})
+		if err != nil {
+			k.log.Errorf("Failed to get: %v", err)
+			resp.StatusCode = kvStatusError
+		}
+	case req.Op == opPut, req.Op == opDelete:
+		err := k.db.Update(func(tx *bolt.Tx) error {
+			if req.Op == opPut {
+				return tx.Bucket(kvBucket).Put(req.Key, req.Value)
+			}
+			return tx.Bucket(kvBucket).Delete(req.Key)
+		})
+		if err != nil {
+			k.log.Errorf("Failed to %v: %v", req.Op, err)
+			resp.StatusCode = kvStatusError
+		} else {
+			resp.StatusCode = kvStatusOk
+		}
+	}
+
+	if !hasSURB {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func main() {
+	dbFile := flag.String("db", "", "Path to the database.")
+	rate := flag.Float64("rate", 10, "Average number of requests per second.")
+	burst := flag.Int("burst", 20, "Maximum number of requests at once.")
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	if *dbFile == "" {
+		fmt.Fprintf(os.Stderr, "-db is mandatory\n")
+		os.Exit(-1)
+	}
+	if *rate <= 0 || *burst < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -rate or -burst\n")
+		os.Exit(-1)
+	}
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("kv")
+
+	// Fail, rather than wait, if another instance has the database open.
+	db, err := bolt.Open(*dbFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(kvBucket)
+			return err
+		})
+	}
+	if err != nil {
+		logger.Errorf("Failed to open the database: %v", err)
+		os.Exit(-1)
+	}
+	defer db.Close()
+
+	k := &kv{db: db, limiter: newLimiter(*rate, *burst), log: logger}
+	h := &plugin.TypedHandler{
+		NewRequest: func() interface{} { return new(kvRequest) },
+		Handle:     k.handle,
+		Params: map[string]string{
+			"version": strconv.Itoa(kvVersion),
+			"rate":    strconv.FormatFloat(*rate, 'g', -1, 64),
+			"burst":   strconv.Itoa(*burst),
+		},
+	}
+	if err = plugin.Serve(h, logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,214 @@
+// limits.go - Katzenpost Kaetzchen plugin request limits.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/server/cborplugin"
+)
+
+const (
+	// DropNewest is the drop policy that fails a new request when the
+	// queue is full.
+	DropNewest = "newest"
+
+	// DropOldest is the drop policy that fails the request that has waited
+	// the longest when the queue is full, to make room for a new one.
+	DropOldest = "oldest"
+)
+
+var (
+	// ErrOverQuota is the error for a request over the quota of the epoch.
+	ErrOverQuota = errors.New("plugin: request quota of the epoch exceeded")
+
+	// ErrQueueFull is the error for a request dropped from a full queue.
+	ErrQueueFull = errors.New("plugin: request queue full")
+
+	epochNow = func() uint64 {
+		epoch, _, _ := epochtime.Now()
+		return epoch
+	}
+)
+
+// LimitConfig is the configuration of a Limiter.
+type LimitConfig struct {
+	// MaxRequestsPerEpoch is the maximum number of requests accepted per
+	// epoch, 0 for no limit.
+	MaxRequestsPerEpoch uint64
+
+	// MaxConcurrency is the maximum number of requests handled at once,
+	// 1 if 0.  The others wait in the queue.
+	MaxConcurrency int
+
+	// MaxQueueDepth is the maximum number of requests waiting to be
+	// handled, 0 for no limit.
+	MaxQueueDepth int
+
+	// DropPolicy is DropNewest, the default, or DropOldest.
+	DropPolicy string
+
+	// OverloadReply returns the reply to a request that fails with
+	// ErrOverQuota or ErrQueueFull, usually an error response in the
+	// service's own format, so that the client learns about it through the
+	// SURB.  With no OverloadReply, or a nil reply, the provider drops the
+	// request.
+	OverloadReply func(req *cborplugin.Request, err error) []byte
+}
+
+// Stats are the counters of a Limiter.
+type Stats struct {
+	// Epoch is the current epoch, and Requests the number of requests
+	// accepted during it.
+	Epoch    uint64
+	Requests uint64
+
+	// Handled, OverQuota and Dropped count the requests handled, refused
+	// over the quota and dropped from the queue.
+	Handled   uint64
+	OverQuota uint64
+	Dropped   uint64
+
+	// Queued is the number of requests waiting, and MaxQueued the highest
+	// it has been.
+	Queued    int
+	MaxQueued int
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("epoch=%v epoch_requests=%v handled=%v over_quota=%v dropped=%v queued=%v max_queued=%v",
+		s.Epoch, s.Requests, s.Handled, s.OverQuota, s.Dropped, s.Queued, s.MaxQueued)
+}
+
+// Limiter is a Handler that applies a LimitConfig to the requests of
+// another Handler.  The provider runs MaxConcurrency processes of a plugin,
+// and only sends one request at a time to each, so a Limiter in a plugin
+// process never queues, and its quota is a share of the capability's.  A
+// Limiter shared by every request of the capability, such as that of a
+// supervisor serving the bridges of all the provider's plugin processes
+// over a socket, applies the limits to the capability as a whole.
+type Limiter struct {
+	sync.Mutex
+	Handler
+
+	cfg     LimitConfig
+	running int
+	queue   []chan error
+	stats   Stats
+}
+
+// OnRequest handles the request with the Limiter's Handler, if the limits
+// allow it.
+func (l *Limiter) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	if err := l.admit(); err != nil {
+		if l.cfg.OverloadReply != nil && req.HasSURB {
+			if b := l.cfg.OverloadReply(req, err); b != nil {
+				return b, nil
+			}
+		}
+		return nil, err
+	}
+	defer l.done()
+	return l.Handler.OnRequest(req)
+}
+
+// Stats returns the Limiter's counters.
+func (l *Limiter) Stats() Stats {
+	l.Lock()
+	defer l.Unlock()
+	l.rollEpoch()
+	s := l.stats
+	s.Queued = len(l.queue)
+	return s
+}
+
+func (l *Limiter) rollEpoch() {
+	if epoch := epochNow(); epoch != l.stats.Epoch {
+		l.stats.Epoch, l.stats.Requests = epoch, 0
+	}
+}
+
+// admit returns once the request may be handled, or the error it fails
+// with.
+func (l *Limiter) admit() error {
+	l.Lock()
+	l.rollEpoch()
+	if l.cfg.MaxRequestsPerEpoch > 0 && l.stats.Requests >= l.cfg.MaxRequestsPerEpoch {
+		l.stats.OverQuota++
+		l.Unlock()
+		return ErrOverQuota
+	}
+	l.stats.Requests++
+	if l.running < l.cfg.MaxConcurrency {
+		l.running++
+		l.Unlock()
+		return nil
+	}
+
+	if l.cfg.MaxQueueDepth > 0 && len(l.queue) >= l.cfg.MaxQueueDepth {
+		l.stats.Dropped++
+		if l.cfg.DropPolicy != DropOldest {
+			l.Unlock()
+			return ErrQueueFull
+		}
+		l.queue[0] <- ErrQueueFull
+		l.queue = l.queue[1:]
+	}
+	ch := make(chan error, 1)
+	l.queue = append(l.queue, ch)
+	if len(l.queue) > l.stats.MaxQueued {
+		l.stats.MaxQueued = len(l.queue)
+	}
+	l.Unlock()
+	return <-ch
+}
+
+// done hands the slot of a handled request to the next one in the queue.
+func (l *Limiter) done() {
+	l.Lock()
+	defer l.Unlock()
+	l.stats.Handled++
+	if len(l.queue) > 0 {
+		l.queue[0] <- nil
+		l.queue = l.queue[1:]
+		return
+	}
+	l.running--
+}
+
+// WithLimits returns a Limiter that applies cfg to the requests of h.
+func WithLimits(h Handler, cfg *LimitConfig) (*Limiter, error) {
+	l := &Limiter{Handler: h, cfg: *cfg}
+	if l.cfg.MaxConcurrency == 0 {
+		l.cfg.MaxConcurrency = 1
+	}
+	switch l.cfg.DropPolicy {
+	case "":
+		l.cfg.DropPolicy = DropNewest
+	case DropNewest, DropOldest:
+	default:
+		return nil, fmt.Errorf("plugin: invalid drop policy '%v'", l.cfg.DropPolicy)
+	}
+	if l.cfg.MaxConcurrency < 0 || l.cfg.MaxQueueDepth < 0 {
+		return nil, errors.New("plugin: invalid concurrency or queue depth")
+	}
+	l.stats.Epoch = epochNow()
+	return l, nil
+}
@@ -0,0 +1,117 @@
+// limits_test.go - Katzenpost Kaetzchen plugin request limits tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingHandler replies to a request once it is released.
+type blockingHandler struct {
+	startedCh chan uint64
+	releaseCh chan interface{}
+}
+
+func (h *blockingHandler) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	h.startedCh <- req.ID
+	<-h.releaseCh
+	return req.Payload, nil
+}
+
+func (h *blockingHandler) Parameters() cborplugin.Parameters {
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	epoch := uint64(1)
+	defer func(fn func() uint64) { epochNow = fn }(epochNow)
+	epochNow = func() uint64 { return epoch }
+
+	type result struct {
+		id      uint64
+		payload []byte
+		err     error
+	}
+	for _, policy := range []string{DropNewest, DropOldest} {
+		h := &blockingHandler{startedCh: make(chan uint64, 10), releaseCh: make(chan interface{})}
+		l, err := WithLimits(h, &LimitConfig{
+			MaxRequestsPerEpoch: 3,
+			MaxQueueDepth:       1,
+			DropPolicy:          policy,
+			OverloadReply: func(req *cborplugin.Request, err error) []byte {
+				if err == ErrOverQuota {
+					return []byte("over quota")
+				}
+				return nil
+			},
+		})
+		assert.NoError(err, "WithLimits")
+
+		resultCh := make(chan result, 10)
+		request := func(id uint64) {
+			go func() {
+				b, err := l.OnRequest(&cborplugin.Request{ID: id, Payload: []byte("ok"), HasSURB: true})
+				resultCh <- result{id, b, err}
+			}()
+		}
+
+		// 1 is handled, 2 waits, and 3 finds the queue full.
+		request(1)
+		assert.Equal(uint64(1), <-h.startedCh, policy)
+		request(2)
+		for l.Stats().Queued == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		request(3)
+		r := <-resultCh
+		assert.Equal(ErrQueueFull, r.err, policy)
+		if policy == DropNewest {
+			assert.Equal(uint64(3), r.id, policy)
+		} else {
+			assert.Equal(uint64(2), r.id, policy)
+		}
+
+		// The quota of 3 requests is used up, including the dropped one, so
+		// the 4th is refused with the overload reply.
+		request(4)
+		r = <-resultCh
+		assert.Equal(result{4, []byte("over quota"), nil}, r, policy)
+
+		close(h.releaseCh)
+		for i := 0; i < 2; i++ {
+			r = <-resultCh
+			assert.NoError(r.err, policy)
+		}
+		s := l.Stats()
+		assert.Equal(Stats{Epoch: epoch, Requests: 3, Handled: 2, OverQuota: 1, Dropped: 1, MaxQueued: 1}, s, policy)
+
+		// The quota is per epoch.
+		epoch++
+		_, err = l.OnRequest(&cborplugin.Request{ID: 5})
+		assert.NoError(err, policy)
+		epoch++
+	}
+
+	_, err := WithLimits(&blockingHandler{}, &LimitConfig{DropPolicy: "random"})
+	assert.Error(err, "WithLimits: invalid drop policy")
+}
@@ -0,0 +1,193 @@
+// main.go - Katzenpost meeting place Kaetzchen plugin.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The meeting place plugin is a CBOR Kaetzchen rendezvous service, for
+// asynchronous exchanges such as PANDA style contact exchange, without
+// user accounts.  A client deposits a short lived blob under a random 32
+// byte ID, and a peer that knows the ID fetches it with a SURB.  Blobs
+// are size capped, can not be overwritten until they expire, and expire
+// after the TTL.  Requests and replies are CBOR encoded:
+//
+//	Request:  {Version: 0, Command: "put" | "get", ID, Payload}
+//	Response: {Version: 0, StatusCode, Payload}
+//
+// The database can only be opened by one process, so the plugin must be
+// configured with a MaxConcurrency of 1.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/daemons/plugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	meetingPlaceVersion = 0
+
+	statusOk          = 0
+	statusSyntaxError = 1
+	statusNotFound    = 2
+	statusExists      = 3
+	statusFull        = 4
+	statusTooLarge    = 5
+	statusError       = 6
+
+	commandPut = "put"
+	commandGet = "get"
+)
+
+type meetingPlaceRequest struct {
+	Version int
+	Command string
+	ID      []byte
+	Payload []byte
+}
+
+type meetingPlaceResponse struct {
+	Version    int
+	StatusCode int
+	Payload    []byte
+}
+
+type meetingPlace struct {
+	worker.Worker
+
+	store         *store
+	log           *logging.Logger
+	sweepInterval time.Duration
+}
+
+func (m *meetingPlace) handle(v interface{}, hasSURB bool) (interface{}, error) {
+	req := v.(*meetingPlaceRequest)
+	resp := &meetingPlaceResponse{Version: meetingPlaceVersion, StatusCode: statusSyntaxError}
+	if req.Version != meetingPlaceVersion {
+		return m.reply(resp, hasSURB)
+	}
+
+	var err error
+	switch req.Command {
+	case commandPut:
+		err = m.store.put(req.ID, req.Payload, time.Now())
+	case commandGet:
+		if !hasSURB {
+			// The blob could not be returned.
+			return nil, nil
+		}
+		resp.Payload, err = m.store.get(req.ID, time.Now())
+	default:
+		return m.reply(resp, hasSURB)
+	}
+	switch err {
+	case nil:
+		resp.StatusCode = statusOk
+	case errInvalid:
+		resp.StatusCode = statusSyntaxError
+	case errNotFound:
+		resp.StatusCode = statusNotFound
+	case errExists:
+		resp.StatusCode = statusExists
+	case errFull:
+		resp.StatusCode = statusFull
+	case errTooLarge:
+		resp.StatusCode = statusTooLarge
+	default:
+		m.log.Errorf("Failed to %v: %v", req.Command, err)
+		resp.StatusCode = statusError
+	}
+	return m.reply(resp, hasSURB)
+}
+
+func (m *meetingPlace) reply(resp *meetingPlaceResponse, hasSURB bool) (interface{}, error) {
+	if !hasSURB {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func (m *meetingPlace) sweeper() {
+	defer m.log.Debugf("Halting sweeper.")
+
+	for {
+		if n, err := m.store.sweep(time.Now()); err != nil {
+			m.log.Errorf("Failed to sweep expired blobs: %v", err)
+		} else if n > 0 {
+			m.log.Debugf("Swept %v expired blobs.", n)
+		}
+
+		select {
+		case <-m.HaltCh():
+			return
+		case <-time.After(m.sweepInterval):
+		}
+	}
+}
+
+func main() {
+	dbFile := flag.String("db", "", "Path to the database, usually meetingplace.db in the provider's DataDir.")
+	ttl := flag.Duration("ttl", 24*time.Hour, "Time after which a blob expires.")
+	maxSize := flag.Int("max-size", 4096, "Maximum blob size in bytes.")
+	maxEntries := flag.Int("max-entries", 100000, "Maximum number of blobs.")
+	sweepInterval := flag.Duration("sweep-interval", 10*time.Minute, "Interval between sweeps of the expired blobs.")
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	if *dbFile == "" {
+		fmt.Fprintf(os.Stderr, "-db is mandatory\n")
+		os.Exit(-1)
+	}
+	if *ttl <= 0 || *maxSize < 1 || *maxEntries < 1 || *sweepInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -ttl, -max-size, -max-entries or -sweep-interval\n")
+		os.Exit(-1)
+	}
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("meetingplace")
+
+	s, err := newStore(*dbFile, *ttl, *maxSize, *maxEntries)
+	if err != nil {
+		logger.Errorf("Failed to open the database: %v", err)
+		os.Exit(-1)
+	}
+	defer s.db.Close()
+
+	m := &meetingPlace{store: s, log: logger, sweepInterval: *sweepInterval}
+	m.Go(m.sweeper)
+	defer m.Halt()
+
+	h := &plugin.TypedHandler{
+		NewRequest: func() interface{} { return new(meetingPlaceRequest) },
+		Handle:     m.handle,
+		Params: map[string]string{
+			"version":  strconv.Itoa(meetingPlaceVersion),
+			"ttl":      ttl.String(),
+			"max_size": strconv.Itoa(*maxSize),
+		},
+	}
+	if err = plugin.Serve(h, logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
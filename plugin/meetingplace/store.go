@@ -0,0 +1,157 @@
+// store.go - Katzenpost meeting place Kaetzchen plugin store.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	// idLength is the length of a blob ID, which the client picks at
+	// random.
+	idLength = 32
+
+	expiryLength = 8
+)
+
+var (
+	blobsBucket  = []byte("blobs")
+	expiryBucket = []byte("expiry")
+
+	errExists   = errors.New("meetingplace: ID already in use")
+	errNotFound = errors.New("meetingplace: no such ID")
+	errFull     = errors.New("meetingplace: store full")
+	errTooLarge = errors.New("meetingplace: blob too large")
+	errInvalid  = errors.New("meetingplace: invalid ID")
+)
+
+// store is a bolt database of blobs by ID, that expire ttl after they are
+// deposited.  The blobs bucket maps an ID to the expiry time and the blob,
+// and its sequence counts them.  The expiry bucket indexes the IDs by
+// expiry time, for sweep.
+type store struct {
+	db *bolt.DB
+
+	ttl        time.Duration
+	maxSize    int
+	maxEntries int
+}
+
+func expiryKey(expiry int64, id []byte) []byte {
+	k := make([]byte, expiryLength, expiryLength+len(id))
+	binary.BigEndian.PutUint64(k, uint64(expiry))
+	return append(k, id...)
+}
+
+// put deposits blob under id, which must not be in use.
+func (s *store) put(id, blob []byte, now time.Time) error {
+	if len(id) != idLength {
+		return errInvalid
+	}
+	if len(blob) > s.maxSize {
+		return errTooLarge
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(blobsBucket)
+		if v := bkt.Get(id); v != nil && int64(binary.BigEndian.Uint64(v)) > now.Unix() {
+			return errExists
+		} else if v == nil {
+			if bkt.Sequence() >= uint64(s.maxEntries) {
+				return errFull
+			}
+			if err := bkt.SetSequence(bkt.Sequence() + 1); err != nil {
+				return err
+			}
+		}
+
+		expiry := now.Add(s.ttl).Unix()
+		v := make([]byte, expiryLength, expiryLength+len(blob))
+		binary.BigEndian.PutUint64(v, uint64(expiry))
+		if err := bkt.Put(id, append(v, blob...)); err != nil {
+			return err
+		}
+		return tx.Bucket(expiryBucket).Put(expiryKey(expiry, id), nil)
+	})
+}
+
+// get returns the blob deposited under id, unless it has expired.
+func (s *store) get(id []byte, now time.Time) ([]byte, error) {
+	var blob []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(blobsBucket).Get(id)
+		if v == nil || int64(binary.BigEndian.Uint64(v)) <= now.Unix() {
+			return errNotFound
+		}
+		blob = append([]byte{}, v[expiryLength:]...)
+		return nil
+	})
+	return blob, err
+}
+
+// sweep deletes the expired blobs, and returns how many there were.
+func (s *store) sweep(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		blobs, index := tx.Bucket(blobsBucket), tx.Bucket(expiryBucket)
+		end := expiryKey(now.Unix()+1, nil)
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+			id := k[expiryLength:]
+			// A blob deposited again under an expired ID has a new expiry.
+			if v := blobs.Get(id); v != nil && bytes.Equal(v[:expiryLength], k[:expiryLength]) {
+				if err := blobs.Delete(id); err != nil {
+					return err
+				}
+				if err := blobs.SetSequence(blobs.Sequence() - 1); err != nil {
+					return err
+				}
+				n++
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func newStore(path string, ttl time.Duration, maxSize, maxEntries int) (*store, error) {
+	// Fail, rather than wait, if another instance has the database open.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{blobsBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db, ttl: ttl, maxSize: maxSize, maxEntries: maxEntries}, nil
+}
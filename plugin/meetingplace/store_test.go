@@ -0,0 +1,77 @@
+// store_test.go - Katzenpost meeting place Kaetzchen plugin store tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "meetingplace_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := newStore(filepath.Join(dir, "meetingplace.db"), time.Hour, 16, 2)
+	assert.NoError(err)
+	defer s.db.Close()
+
+	now := time.Now()
+	a, b, c := bytes.Repeat([]byte{'a'}, idLength), bytes.Repeat([]byte{'b'}, idLength), bytes.Repeat([]byte{'c'}, idLength)
+
+	assert.Equal(errInvalid, s.put([]byte("short"), []byte("blob"), now), "put: short ID")
+	assert.Equal(errTooLarge, s.put(a, make([]byte, 17), now), "put: too large")
+	assert.NoError(s.put(a, []byte("blob a"), now), "put")
+	assert.Equal(errExists, s.put(a, []byte("other"), now), "put: overwrite")
+	blob, err := s.get(a, now)
+	assert.NoError(err, "get")
+	assert.Equal([]byte("blob a"), blob, "get")
+	_, err = s.get(b, now)
+	assert.Equal(errNotFound, err, "get: missing")
+
+	assert.NoError(s.put(b, []byte("blob b"), now.Add(30*time.Minute)), "put")
+	assert.Equal(errFull, s.put(c, []byte("blob c"), now), "put: full")
+
+	// a expires, and its ID can be reused before it is swept.
+	later := now.Add(time.Hour + time.Second)
+	_, err = s.get(a, later)
+	assert.Equal(errNotFound, err, "get: expired")
+	assert.NoError(s.put(a, []byte("new a"), later), "put: expired ID")
+	n, err := s.sweep(later)
+	assert.NoError(err, "sweep")
+	assert.Equal(0, n, "sweep: reused ID")
+	blob, err = s.get(a, later)
+	assert.NoError(err, "get: reused ID")
+	assert.Equal([]byte("new a"), blob, "get: reused ID")
+
+	// Both expire, and sweeping them frees their entries.
+	end := later.Add(2 * time.Hour)
+	n, err = s.sweep(end)
+	assert.NoError(err, "sweep")
+	assert.Equal(2, n, "sweep")
+	assert.NoError(s.put(c, []byte("blob c"), end), "put: after sweep")
+	_, err = s.get(b, end)
+	assert.Equal(errNotFound, err, "get: swept")
+}
@@ -0,0 +1,188 @@
+// plugin.go - Katzenpost Kaetzchen plugin support.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package plugin implements the plugin side of the provider's CBOR
+// Kaetzchen plugin protocol, for the programs configured as the Command of
+// a [[Provider.CBORPluginKaetzchen]].
+//
+// The provider starts the program, reads the path of a unix domain socket
+// from the first line of its stdout, and then makes HTTP POST requests
+// over that socket:
+//
+//	/parameters  returns the CBOR encoded cborplugin.Parameters to publish
+//	             in the provider's descriptor.
+//	/request     takes a CBOR encoded cborplugin.Request, and returns a
+//	             CBOR encoded cborplugin.Response, whose empty Payload
+//	             means that there is no reply.
+//
+// The provider sends SIGHUP to the program when it shuts down, and Serve
+// then waits for the requests in progress before it returns.  A Handler
+// that panics fails the request, rather than the plugin.
+//
+// A plugin is configured with command line flags, which the provider
+// passes as "-key value" for each value of the plugin's Config table, so
+// boolean flags can not be used.  See the echo, kv and tester plugins for
+// examples.
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"syscall"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// ParametersPath is the HTTP path that the provider fetches the
+	// plugin's parameters from.
+	ParametersPath = "/parameters"
+
+	// RequestPath is the HTTP path that the provider posts requests to.
+	RequestPath = "/request"
+
+	socketFile      = "plugin.sock"
+	shutdownTimeout = 10 * time.Second
+)
+
+// Handler handles the requests for a Kaetzchen plugin.
+type Handler interface {
+	// OnRequest returns the reply to the request, or nil for no reply.
+	OnRequest(*cborplugin.Request) ([]byte, error)
+
+	// Parameters returns the parameters to publish in the provider's
+	// descriptor, which the authorities carry into the consensus, such as
+	// the supported versions, rate limits or public keys of the service.
+	// It is only called once, when the provider starts, and the provider
+	// replaces the "endpoint" parameter with the configured Endpoint.
+	Parameters() cborplugin.Parameters
+}
+
+type server struct {
+	handler Handler
+	log     *logging.Logger
+}
+
+func (s *server) serveParameters(w http.ResponseWriter, r *http.Request) {
+	params := s.handler.Parameters()
+	if params == nil {
+		params = make(cborplugin.Parameters)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	codec.NewEncoder(w, new(codec.CborHandle)).Encode(params)
+}
+
+func (s *server) serveRequest(w http.ResponseWriter, r *http.Request) {
+	req := new(cborplugin.Request)
+	if err := codec.NewDecoder(r.Body, new(codec.CborHandle)).Decode(req); err != nil {
+		s.log.Debugf("Failed to decode request: %v", err)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	payload, err := s.onRequest(req)
+	if err != nil {
+		// The provider drops the request, as it fails to decode the error.
+		s.log.Debugf("Failed to handle request %v: %v", req.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	codec.NewEncoder(w, new(codec.CborHandle)).Encode(&cborplugin.Response{Payload: payload})
+}
+
+// onRequest calls the Handler, and returns an error instead of crashing
+// the plugin if it panics.
+func (s *server) onRequest(req *cborplugin.Request) (payload []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("Request %v panicked: %v\n%s", req.ID, r, debug.Stack())
+			payload, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handler.OnRequest(req)
+}
+
+// Serve serves the provider's requests with the Handler h, until the
+// provider, or anything else, sends SIGHUP, SIGINT or SIGTERM.
+func Serve(h Handler, log *logging.Logger) error {
+	dir, err := ioutil.TempDir("", "kaetzchen")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, socketFile)
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return err
+	}
+
+	s := &server{handler: h, log: log}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ParametersPath, s.serveParameters)
+	mux.HandleFunc(RequestPath, s.serveRequest)
+
+	srv := &http.Server{Handler: mux}
+	haltCh := make(chan interface{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Noticef("Received %v, shutting down.", sig)
+
+		// Let the requests in progress finish, so that their replies are
+		// not lost.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warningf("Failed to finish the requests in progress: %v", err)
+			srv.Close()
+		}
+		close(haltCh)
+	}()
+
+	// The provider reads the socket path from the first line of stdout.
+	if _, err = os.Stdout.WriteString(p + "\n"); err != nil {
+		l.Close()
+		return err
+	}
+	log.Noticef("Serving requests on: %v", p)
+	if err = srv.Serve(l); err == http.ErrServerClosed {
+		<-haltCh
+		return nil
+	}
+	return err
+}
+
+// NewLogBackend returns a log backend that logs to file at level, or
+// nowhere if file is empty, as the provider does not read the plugin's
+// output.
+func NewLogBackend(file, level string) (*log.Backend, error) {
+	if file == "" {
+		file = os.DevNull
+	}
+	return log.New(file, level, false)
+}
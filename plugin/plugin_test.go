@@ -0,0 +1,232 @@
+// plugin_test.go - Katzenpost Kaetzchen plugin tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plugin_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+// startPlugin builds the reference plugin name, and starts it with the
+// provider's plugin client.
+func startPlugin(t *testing.T, dir, name string, args ...string) *cborplugin.Client {
+	if testing.Short() {
+		t.Skip("builds the reference plugins")
+	}
+	p := filepath.Join(dir, name)
+	if out, err := exec.Command("go", "build", "-o", p, "github.com/katzenpost/daemons/plugin/"+name).CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+
+	logBackend, err := log.New("", "ERROR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cborplugin.New(logBackend.GetLogger(name))
+	if err = c.Start(p, args); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return c
+}
+
+func TestEcho(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "plugin_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c := startPlugin(t, dir, "echo")
+	defer c.Halt()
+
+	assert.Empty(*c.GetParameters(), "GetParameters")
+	reply, err := c.OnRequest(&cborplugin.Request{ID: 1, Payload: []byte("hello"), HasSURB: true})
+	assert.NoError(err, "OnRequest")
+	assert.Equal([]byte("hello"), reply, "OnRequest")
+}
+
+type kvRequest struct {
+	Version int
+	Op      string
+	Key     []byte
+	Value   []byte
+}
+
+type kvResponse struct {
+	Version    int
+	StatusCode int
+	Value      []byte
+}
+
+func TestKV(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "plugin_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c := startPlugin(t, dir, "kv", "-db", filepath.Join(dir, "kv.db"), "-rate", "0.01", "-burst", "5")
+	defer c.Halt()
+
+	assert.Equal("5", (*c.GetParameters())["burst"], "GetParameters")
+
+	id := uint64(0)
+	do := func(op, key, value string) *kvResponse {
+		var b []byte
+		err := codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(&kvRequest{Op: op, Key: []byte(key), Value: []byte(value)})
+		assert.NoError(err, "Encode")
+		id++
+		reply, err := c.OnRequest(&cborplugin.Request{ID: id, Payload: b, HasSURB: true})
+		assert.NoError(err, "OnRequest")
+		resp := new(kvResponse)
+		err = codec.NewDecoderBytes(reply, new(codec.CborHandle)).Decode(resp)
+		assert.NoError(err, "Decode")
+		return resp
+	}
+
+	assert.Equal(0, do("put", "k", "v").StatusCode, "put")
+	resp := do("get", "k", "")
+	assert.Equal(0, resp.StatusCode, "get")
+	assert.Equal([]byte("v"), resp.Value, "get")
+	assert.Equal(0, do("delete", "k", "").StatusCode, "delete")
+	assert.Equal(2, do("get", "k", "").StatusCode, "get deleted")
+	assert.Equal(1, do("frob", "k", "").StatusCode, "invalid op")
+	assert.Equal(3, do("get", "k", "").StatusCode, "rate limited")
+}
+
+func TestTester(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "plugin_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c := startPlugin(t, dir, "tester", "-timeout", "500ms")
+
+	request := func(payload string) ([]byte, error) {
+		return c.OnRequest(&cborplugin.Request{ID: 1, Payload: []byte(payload), HasSURB: true})
+	}
+
+	// A panic fails the request, and the plugin keeps serving.
+	_, err = request("panic")
+	assert.Error(err, "panic")
+	reply, err := request("ping")
+	assert.NoError(err, "after panic")
+	assert.Equal([]byte("ping"), reply, "after panic")
+
+	start := time.Now()
+	_, err = request("sleep 1h")
+	assert.Error(err, "timeout")
+	assert.True(time.Since(start) < time.Minute, "timeout")
+
+	// A request in progress finishes when the plugin is halted.
+	replyCh := make(chan []byte)
+	go func() {
+		reply, _ := request("sleep 200ms")
+		replyCh <- reply
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Halt()
+	assert.Equal([]byte("slept 200ms"), <-replyCh, "graceful shutdown")
+}
+
+type registrationRequest struct {
+	Version     int
+	User        string
+	LinkKey     string
+	IdentityKey string
+	Invitation  string
+}
+
+type registrationResponse struct {
+	Version    int
+	StatusCode int
+}
+
+func TestRegistration(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "plugin_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// The provider's management socket, that only knows how to add users.
+	logBackend, err := log.New("", "ERROR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgmtSocket := filepath.Join(dir, "management_sock")
+	m, err := management.New(mgmtSocket, "test", logBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addedCh := make(chan string, 1)
+	m.RegisterCommand("ADD_USER", func(c *thwack.Conn, l string) error {
+		addedCh <- l
+		return c.WriteReply(thwack.StatusOk)
+	})
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Halt()
+
+	socket := filepath.Join(dir, "registration_sock")
+	c := startPlugin(t, dir, "registration", "-management-socket", mgmtSocket, "-invitations-db", filepath.Join(dir, "invitations.db"), "-socket", socket)
+	defer c.Halt()
+	assert.Equal("true", (*c.GetParameters())["invitations"], "GetParameters")
+
+	out, err := exec.Command(filepath.Join(dir, "registration"), "-socket", socket, "-ctl", "INVITATION_MINT").Output()
+	if err != nil {
+		t.Fatalf("INVITATION_MINT: %v", err)
+	}
+	code := strings.TrimSpace(string(out))
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(invitation string) int {
+		var b []byte
+		err := codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(&registrationRequest{User: "alice", LinkKey: linkKey.PublicKey().String(), Invitation: invitation})
+		assert.NoError(err, "Encode")
+		reply, err := c.OnRequest(&cborplugin.Request{ID: 1, Payload: b, HasSURB: true})
+		assert.NoError(err, "OnRequest")
+		resp := new(registrationResponse)
+		err = codec.NewDecoderBytes(reply, new(codec.CborHandle)).Decode(resp)
+		assert.NoError(err, "Decode")
+		return resp.StatusCode
+	}
+
+	assert.Equal(2, register("AAAA"), "invalid invitation")
+	assert.Equal(0, register(code), "registration")
+	assert.Equal("ADD_USER alice "+linkKey.PublicKey().String(), <-addedCh)
+	assert.Equal(2, register(code), "used invitation")
+}
@@ -0,0 +1,214 @@
+// main.go - Katzenpost registration Kaetzchen plugin.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The registration plugin is a CBOR Kaetzchen that registers users with the
+// provider, so that they can sign up over the mixnet without revealing
+// their address to the provider, as registering over HTTP does.  The
+// request is sent through any provider the client can already connect to,
+// and the reply comes back through the SURB.  Requests and replies are
+// CBOR encoded:
+//
+//	Request:  {Version: 0, User, LinkKey, IdentityKey, Invitation}
+//	Response: {Version: 0, StatusCode}
+//
+// The keys are in the format of the provider's management interface, and
+// IdentityKey is optional.  Users are added over the provider's management
+// socket.  With -invitations-db, registering requires an invitation code,
+// minted with the INVITATION_MINT command of the plugin's own management
+// socket, which `registration -socket <path> -ctl <command>` sends.  Without
+// it, anyone can register, within the -max-requests-per-epoch quota.
+//
+// The database can only be opened by one process, so the plugin must be
+// configured with a MaxConcurrency of 1.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/internal/registration"
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	registrationVersion = 0
+
+	statusOk                = 0
+	statusSyntaxError       = 1
+	statusInvalidInvitation = 2
+	statusRejected          = 3
+	statusOverloaded        = 4
+	statusError             = 5
+
+	// auditSource is the source of the registrations in the audit log, as
+	// their origin is unknown by design.
+	auditSource = "mixnet"
+)
+
+type registrationRequest struct {
+	Version     int
+	User        string
+	LinkKey     string
+	IdentityKey string
+	Invitation  string
+}
+
+type registrationResponse struct {
+	Version    int
+	StatusCode int
+}
+
+type registrar struct {
+	r   *registration.Registrar
+	log *logging.Logger
+}
+
+func (r *registrar) handle(v interface{}, hasSURB bool) (interface{}, error) {
+	req := v.(*registrationRequest)
+	resp := &registrationResponse{Version: registrationVersion, StatusCode: statusSyntaxError}
+	if req.Version != registrationVersion {
+		return resp, nil
+	}
+	regReq := &registration.Request{
+		User:       req.User,
+		LinkKey:    new(ecdh.PublicKey),
+		Invitation: req.Invitation,
+	}
+	if err := regReq.LinkKey.FromString(req.LinkKey); err != nil {
+		return resp, nil
+	}
+	if req.IdentityKey != "" {
+		regReq.IdentityKey = new(ecdh.PublicKey)
+		if err := regReq.IdentityKey.FromString(req.IdentityKey); err != nil {
+			return resp, nil
+		}
+	}
+
+	switch err := r.r.Register(regReq, auditSource); err {
+	case nil:
+		r.log.Noticef("Registered user: %v", req.User)
+		resp.StatusCode = statusOk
+	case registration.ErrInvalidRequest:
+	case registration.ErrInvalidInvitation:
+		resp.StatusCode = statusInvalidInvitation
+	case registration.ErrRejected:
+		resp.StatusCode = statusRejected
+	default:
+		r.log.Errorf("Failed to register user: %v", err)
+		resp.StatusCode = statusError
+	}
+	if !hasSURB {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func main() {
+	mgmtSocket := flag.String("management-socket", "", "Path to the provider's management socket.")
+	invitationsDB := flag.String("invitations-db", "", "Path to the invitation database, empty lets anyone register.")
+	socket := flag.String("socket", "", "Path to the plugin's management socket, for the invitation commands.")
+	ctlCmd := flag.String("ctl", "", "Send a command to the running plugin's -socket and exit.")
+	auditFile := flag.String("audit-log", "", "Log the registration attempts to this file, without the users' keys.")
+	maxRequests := flag.Uint64("max-requests-per-epoch", 0, "Maximum number of registration attempts per epoch, 0 for no limit.")
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	if *ctlCmd != "" {
+		if err := management.Run(*socket, *ctlCmd, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *mgmtSocket == "" {
+		fmt.Fprintf(os.Stderr, "-management-socket is mandatory\n")
+		os.Exit(-1)
+	}
+	if *invitationsDB != "" && *socket == "" {
+		fmt.Fprintf(os.Stderr, "-invitations-db requires -socket\n")
+		os.Exit(-1)
+	}
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("registration")
+
+	var invitations *registration.Invitations
+	if *invitationsDB != "" {
+		if invitations, err = registration.NewInvitations(*invitationsDB); err != nil {
+			logger.Errorf("Failed to open the invitations: %v", err)
+			os.Exit(-1)
+		}
+		defer invitations.Close()
+
+		var m *thwack.Server
+		if m, err = management.New(*socket, "Registration plugin", logBackend); err == nil {
+			registration.RegisterCommands(m, invitations)
+			err = m.Start()
+		}
+		if err != nil {
+			logger.Errorf("Failed to start the management socket: %v", err)
+			os.Exit(-1)
+		}
+		defer m.Halt()
+	}
+	var audit *registration.AuditLog
+	if *auditFile != "" {
+		if audit, err = registration.OpenAuditLog(*auditFile); err != nil {
+			logger.Errorf("Failed to open the audit log: %v", err)
+			os.Exit(-1)
+		}
+		defer audit.Close()
+	}
+
+	r := &registrar{
+		r:   registration.NewRegistrar(*mgmtSocket, invitations, audit),
+		log: logger,
+	}
+	h := &plugin.TypedHandler{
+		NewRequest: func() interface{} { return new(registrationRequest) },
+		Handle:     r.handle,
+		Params: map[string]string{
+			"version":     strconv.Itoa(registrationVersion),
+			"invitations": strconv.FormatBool(invitations != nil),
+		},
+	}
+	var overloaded []byte
+	codec.NewEncoderBytes(&overloaded, new(codec.CborHandle)).Encode(&registrationResponse{Version: registrationVersion, StatusCode: statusOverloaded})
+	l, err := plugin.WithLimits(h, &plugin.LimitConfig{
+		MaxRequestsPerEpoch: *maxRequests,
+		OverloadReply:       func(*cborplugin.Request, error) []byte { return overloaded },
+	})
+	if err != nil {
+		logger.Errorf("Invalid limits: %v", err)
+		os.Exit(-1)
+	}
+	if err = plugin.Serve(l, logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,250 @@
+// pool.go - Katzenpost Kaetzchen socket plugin connection pool.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/cborplugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	defaultMaxConns = 2
+	defaultTimeout  = 10 * time.Second
+)
+
+var (
+	errHalted      = errors.New("socket: pool halted")
+	errUnavailable = errors.New("socket: service unavailable")
+)
+
+// Config is the configuration of a Pool.
+type Config struct {
+	// Address is the service's address, "unix:/path/to/socket" or
+	// "tcp:127.0.0.1:1234".
+	Address string
+
+	// MaxConns is the maximum number of connections to the service.
+	MaxConns int
+
+	// Timeout bounds connecting to the service, and each request.
+	Timeout time.Duration
+
+	// HealthInterval is the interval between health checks, 0 disables
+	// them.  While the last health check failed, requests fail without
+	// being sent to the service.
+	HealthInterval time.Duration
+}
+
+// Pool is a pool of connections to a Kaetzchen service.  Connections are
+// established as needed, and a connection that fails is discarded, so the
+// service can be restarted at any time.
+type Pool struct {
+	sync.Mutex
+	worker.Worker
+
+	network string
+	address string
+	cfg     Config
+	log     *logging.Logger
+
+	tokens  chan struct{}
+	idle    []net.Conn
+	healthy bool
+}
+
+// Halt stops the health checks, and closes the idle connections.
+func (p *Pool) Halt() {
+	p.Worker.Halt()
+
+	p.Lock()
+	defer p.Unlock()
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+}
+
+// OnRequest sends the request to the service, and returns its reply.
+func (p *Pool) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	resp, err := p.roundTrip(&Frame{
+		Type:    TypeRequest,
+		ID:      req.ID,
+		Payload: req.Payload,
+		HasSURB: req.HasSURB,
+	}, TypeResponse)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ID != req.ID {
+		return nil, fmt.Errorf("socket: response for request %v, not %v", resp.ID, req.ID)
+	}
+	return resp.Payload, nil
+}
+
+// FetchParameters returns the parameters that the service publishes in
+// the provider's descriptor.
+func (p *Pool) FetchParameters() (cborplugin.Parameters, error) {
+	resp, err := p.roundTrip(&Frame{Type: TypeParameters}, TypeParameters)
+	if err != nil {
+		return nil, err
+	}
+	return cborplugin.Parameters(resp.Parameters), nil
+}
+
+// Ping checks that the service answers.
+func (p *Pool) Ping() error {
+	_, err := p.do(&Frame{Type: TypePing}, TypePing)
+	return err
+}
+
+func (p *Pool) roundTrip(f *Frame, replyType uint8) (*Frame, error) {
+	p.Lock()
+	healthy := p.healthy
+	p.Unlock()
+	if !healthy {
+		return nil, errUnavailable
+	}
+	return p.do(f, replyType)
+}
+
+func (p *Pool) do(f *Frame, replyType uint8) (*Frame, error) {
+	select {
+	case p.tokens <- struct{}{}:
+	case <-p.HaltCh():
+		return nil, errHalted
+	}
+	defer func() { <-p.tokens }()
+
+	for {
+		c, reused, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(p.cfg.Timeout))
+		var resp *Frame
+		sent := false
+		if err = WriteFrame(c, f); err == nil {
+			sent = true
+			resp, err = ReadFrame(c)
+		}
+		if err != nil {
+			c.Close()
+			// A pooled connection that the service closed while it was
+			// idle fails without the request being processed, so retry it
+			// on a new connection.
+			if reused && (!sent || err == io.EOF) {
+				continue
+			}
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		p.put(c)
+
+		if resp.Error != "" {
+			return nil, fmt.Errorf("socket: service error: %v", resp.Error)
+		}
+		if resp.Type != replyType {
+			return nil, fmt.Errorf("socket: unexpected reply type %v", resp.Type)
+		}
+		return resp, nil
+	}
+}
+
+func (p *Pool) get() (net.Conn, bool, error) {
+	p.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.Unlock()
+		return c, true, nil
+	}
+	p.Unlock()
+
+	c, err := net.DialTimeout(p.network, p.address, p.cfg.Timeout)
+	return c, false, err
+}
+
+func (p *Pool) put(c net.Conn) {
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case <-p.HaltCh():
+		c.Close()
+	default:
+		p.idle = append(p.idle, c)
+	}
+}
+
+func (p *Pool) worker() {
+	t := time.NewTicker(p.cfg.HealthInterval)
+	defer t.Stop()
+
+	for {
+		err := p.Ping()
+		p.Lock()
+		wasHealthy := p.healthy
+		p.healthy = err == nil
+		p.Unlock()
+		switch {
+		case err != nil && wasHealthy:
+			p.log.Warningf("Service %v is unavailable: %v", p.cfg.Address, err)
+		case err == nil && !wasHealthy:
+			p.log.Noticef("Service %v is available.", p.cfg.Address)
+		}
+
+		select {
+		case <-p.HaltCh():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// NewPool returns a new Pool of connections to the service configured in
+// cfg.
+func NewPool(cfg *Config, log *logging.Logger) (*Pool, error) {
+	network, address, err := SplitAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pool{
+		network: network,
+		address: address,
+		cfg:     *cfg,
+		log:     log,
+		healthy: true,
+	}
+	if p.cfg.MaxConns <= 0 {
+		p.cfg.MaxConns = defaultMaxConns
+	}
+	if p.cfg.Timeout <= 0 {
+		p.cfg.Timeout = defaultTimeout
+	}
+	p.tokens = make(chan struct{}, p.cfg.MaxConns)
+	if p.cfg.HealthInterval > 0 {
+		p.Go(p.worker)
+	}
+	return p, nil
+}
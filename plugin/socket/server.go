@@ -0,0 +1,77 @@
+// server.go - Katzenpost Kaetzchen socket plugin service side.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/server/cborplugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// Serve accepts connections on l, and serves the requests on them with the
+// Handler h, until l is closed.
+func Serve(l net.Listener, h plugin.Handler, log *logging.Logger) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(c, h, log)
+	}
+}
+
+func serveConn(c net.Conn, h plugin.Handler, log *logging.Logger) {
+	defer c.Close()
+	for {
+		f, err := ReadFrame(c)
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("Failed to read frame: %v", err)
+			}
+			return
+		}
+		if err = WriteFrame(c, handleFrame(f, h)); err != nil {
+			log.Debugf("Failed to write frame: %v", err)
+			return
+		}
+	}
+}
+
+func handleFrame(f *Frame, h plugin.Handler) *Frame {
+	switch f.Type {
+	case TypeRequest:
+		payload, err := h.OnRequest(&cborplugin.Request{
+			ID:      f.ID,
+			Payload: f.Payload,
+			HasSURB: f.HasSURB,
+		})
+		if err != nil {
+			return &Frame{Type: TypeResponse, ID: f.ID, Error: err.Error()}
+		}
+		return &Frame{Type: TypeResponse, ID: f.ID, Payload: payload}
+	case TypeParameters:
+		return &Frame{Type: TypeParameters, Parameters: h.Parameters()}
+	case TypePing:
+		return &Frame{Type: TypePing}
+	default:
+		return &Frame{Type: f.Type, Error: fmt.Sprintf("unknown frame type %v", f.Type)}
+	}
+}
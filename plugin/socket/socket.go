@@ -0,0 +1,121 @@
+// socket.go - Katzenpost Kaetzchen socket plugin protocol.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package socket implements the framed protocol between the provider, by
+// way of the socket plugin bridge, and Kaetzchen services that run as long
+// lived processes reached over a unix domain socket or a TCP address.
+//
+// Each frame is a 4 byte big endian length, followed by that many bytes of
+// a CBOR encoded Frame.  The client sends one frame, and waits for the
+// service's reply frame before it sends the next one on the same
+// connection.  Clients open several connections for concurrent requests.
+//
+//	TypeRequest     ID, Payload, HasSURB: a Kaetzchen request.  Replied to
+//	                with a TypeResponse with the same ID, and the reply in
+//	                Payload, or no Payload for no reply.
+//	TypeParameters  Replied to with a TypeParameters with the parameters to
+//	                publish in the provider's descriptor in Parameters.
+//	TypePing        Replied to with a TypePing, as a health check.
+//
+// Any reply may instead set Error, in which case the request is dropped.
+// Frames are at most MaxFrameLength bytes long.
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// MaxFrameLength is the maximum length of a frame, excluding the length
+// prefix.
+const MaxFrameLength = 1 << 20
+
+// The frame types.
+const (
+	TypeRequest    = 1
+	TypeResponse   = 2
+	TypeParameters = 3
+	TypePing       = 4
+)
+
+var errFrameTooLarge = errors.New("socket: frame too large")
+
+// Frame is a protocol message.
+type Frame struct {
+	Type       uint8
+	ID         uint64            `codec:",omitempty"`
+	Payload    []byte            `codec:",omitempty"`
+	HasSURB    bool              `codec:",omitempty"`
+	Parameters map[string]string `codec:",omitempty"`
+	Error      string            `codec:",omitempty"`
+}
+
+// WriteFrame writes the frame f to w.
+func WriteFrame(w io.Writer, f *Frame) error {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(f); err != nil {
+		return err
+	}
+	if len(b) > MaxFrameLength {
+		return errFrameTooLarge
+	}
+	buf := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	_, err := w.Write(append(buf, b...))
+	return err
+}
+
+// ReadFrame reads a frame from r.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > MaxFrameLength {
+		return nil, errFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	f := new(Frame)
+	if err := codec.NewDecoderBytes(b, new(codec.CborHandle)).Decode(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SplitAddress splits an address of the form "unix:/path/to/socket" or
+// "tcp:127.0.0.1:1234" into a network and an address for net.Dial and
+// net.Listen.
+func SplitAddress(s string) (string, string, error) {
+	sp := strings.SplitN(s, ":", 2)
+	if len(sp) != 2 || sp[1] == "" {
+		return "", "", fmt.Errorf("socket: invalid address '%v'", s)
+	}
+	switch sp[0] {
+	case "unix", "tcp":
+		return sp[0], sp[1], nil
+	default:
+		return "", "", fmt.Errorf("socket: invalid network '%v'", sp[0])
+	}
+}
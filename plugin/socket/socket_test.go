@@ -0,0 +1,207 @@
+// socket_test.go - Katzenpost Kaetzchen socket plugin protocol tests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package socket
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoHandler struct{}
+
+func (h *echoHandler) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	if string(req.Payload) == "fail" {
+		return nil, errors.New("failed")
+	}
+	return req.Payload, nil
+}
+
+func (h *echoHandler) Parameters() cborplugin.Parameters {
+	return cborplugin.Parameters{"version": "1"}
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "socket_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	logBackend, err := log.New("", "ERROR", false)
+	assert.NoError(err)
+
+	// listen starts the service, and returns a function that stops it, and
+	// closes its connections.
+	p := filepath.Join(dir, "service.sock")
+	listen := func() func() {
+		l, err := net.Listen("unix", p)
+		assert.NoError(err)
+		var mu sync.Mutex
+		var conns []net.Conn
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				conns = append(conns, c)
+				mu.Unlock()
+				go serveConn(c, &echoHandler{}, logBackend.GetLogger("service"))
+			}
+		}()
+		return func() {
+			l.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			for _, c := range conns {
+				c.Close()
+			}
+		}
+	}
+	stop := listen()
+
+	pool, err := NewPool(&Config{Address: "unix:" + p, Timeout: time.Second}, logBackend.GetLogger("pool"))
+	assert.NoError(err)
+	defer pool.Halt()
+
+	params, err := pool.FetchParameters()
+	assert.NoError(err)
+	assert.Equal("1", params["version"])
+	resp, err := pool.OnRequest(&cborplugin.Request{ID: 1, Payload: []byte("hello"), HasSURB: true})
+	assert.NoError(err)
+	assert.Equal([]byte("hello"), resp)
+	_, err = pool.OnRequest(&cborplugin.Request{ID: 2, Payload: []byte("fail")})
+	assert.Error(err)
+
+	// The service goes away, and comes back.
+	stop()
+	_, err = pool.OnRequest(&cborplugin.Request{ID: 3, Payload: []byte("down")})
+	assert.Error(err)
+	stop = listen()
+	defer stop()
+	resp, err = pool.OnRequest(&cborplugin.Request{ID: 4, Payload: []byte("up")})
+	assert.NoError(err)
+	assert.Equal([]byte("up"), resp)
+}
+
+// blockingHandler replies to a request once it is released.
+type blockingHandler struct {
+	startedCh chan uint64
+	releaseCh chan interface{}
+}
+
+func (h *blockingHandler) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	h.startedCh <- req.ID
+	<-h.releaseCh
+	return req.Payload, nil
+}
+
+func (h *blockingHandler) Parameters() cborplugin.Parameters {
+	return nil
+}
+
+func TestServeLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "socket_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	logBackend, err := log.New("", "ERROR", false)
+	assert.NoError(err)
+
+	// A Limiter served over the socket applies to the requests of every
+	// client, as those of the bridges of all the provider's plugin
+	// processes.
+	h := &blockingHandler{startedCh: make(chan uint64, 10), releaseCh: make(chan interface{})}
+	lim, err := plugin.WithLimits(h, &plugin.LimitConfig{
+		MaxConcurrency: 1,
+		MaxQueueDepth:  1,
+		OverloadReply:  func(*cborplugin.Request, error) []byte { return []byte("overloaded") },
+	})
+	assert.NoError(err)
+	p := filepath.Join(dir, "service.sock")
+	l, err := net.Listen("unix", p)
+	assert.NoError(err)
+	defer l.Close()
+	go Serve(l, lim, logBackend.GetLogger("service"))
+
+	var pools []*Pool
+	for i := 0; i < 2; i++ {
+		pool, err := NewPool(&Config{Address: "unix:" + p, Timeout: 5 * time.Second}, logBackend.GetLogger("pool"))
+		assert.NoError(err)
+		defer pool.Halt()
+		pools = append(pools, pool)
+	}
+	type result struct {
+		payload []byte
+		err     error
+	}
+	resultCh := make(chan result, 2)
+	request := func(pool *Pool, id uint64) {
+		go func() {
+			b, err := pool.OnRequest(&cborplugin.Request{ID: id, Payload: []byte("ok"), HasSURB: true})
+			resultCh <- result{b, err}
+		}()
+	}
+
+	// 1 is handled, 2 waits, and 3 finds the queue full, and gets the
+	// overload reply.
+	request(pools[0], 1)
+	assert.Equal(uint64(1), <-h.startedCh)
+	request(pools[1], 2)
+	for lim.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err := pools[1].OnRequest(&cborplugin.Request{ID: 3, Payload: []byte("ok"), HasSURB: true})
+	assert.NoError(err)
+	assert.Equal([]byte("overloaded"), resp)
+
+	close(h.releaseCh)
+	for i := 0; i < 2; i++ {
+		r := <-resultCh
+		assert.NoError(r.err)
+		assert.Equal([]byte("ok"), r.payload)
+	}
+	s := lim.Stats()
+	assert.Equal(uint64(2), s.Handled)
+	assert.Equal(uint64(1), s.Dropped)
+	assert.Equal(1, s.MaxQueued)
+}
+
+func TestSplitAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	network, address, err := SplitAddress("tcp:127.0.0.1:1234")
+	assert.NoError(err)
+	assert.Equal("tcp", network)
+	assert.Equal("127.0.0.1:1234", address)
+	_, _, err = SplitAddress("udp:127.0.0.1:1234")
+	assert.Error(err)
+	_, _, err = SplitAddress("unix:")
+	assert.Error(err)
+}
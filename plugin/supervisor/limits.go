@@ -0,0 +1,100 @@
+// limits.go - Katzenpost Kaetzchen plugin supervisor resource limits.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// execEnv is the environment variable that makes the supervisor apply the
+// limits in it to itself, and execute the plugin given as its arguments.
+const execEnv = "KATZENPOST_SUPERVISOR_EXEC"
+
+// limits are the resource limits of the plugin process, 0 for no limit.
+type limits struct {
+	memory uint64
+	cpu    time.Duration
+	files  uint64
+}
+
+// command returns the command that runs the plugin, by way of the
+// supervisor executable, which applies the limits to itself in the new
+// process, as os/exec has no way to, before it executes the plugin.
+func (l *limits) command(command string, args []string, sandbox bool) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	attr, err := sysProcAttr(sandbox)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self, append([]string{command}, args...)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d,%d,%d,%v", execEnv, l.memory, uint64(l.cpu/time.Second), l.files, sandbox))
+	cmd.SysProcAttr = attr
+	return cmd, nil
+}
+
+// execPlugin applies the limits in the execEnv value spec, and executes
+// the plugin in os.Args.  It only returns on failure.
+func execPlugin(spec string) error {
+	var memory, cpu, files uint64
+	var sandbox bool
+	if _, err := fmt.Sscanf(strings.Replace(spec, ",", " ", -1), "%d %d %d %t", &memory, &cpu, &files, &sandbox); err != nil {
+		return fmt.Errorf("invalid %v: %v", execEnv, err)
+	}
+	for _, v := range []struct {
+		resource int
+		limit    uint64
+	}{
+		{syscall.RLIMIT_AS, memory},
+		{syscall.RLIMIT_CPU, cpu},
+		{syscall.RLIMIT_NOFILE, files},
+	} {
+		if v.limit == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(v.resource, &syscall.Rlimit{Cur: v.limit, Max: v.limit}); err != nil {
+			return fmt.Errorf("failed to set resource limit %v: %v", v.resource, err)
+		}
+	}
+	if sandbox {
+		if err := restrictSelf(); err != nil {
+			return err
+		}
+	}
+
+	if len(os.Args) < 2 {
+		return fmt.Errorf("no plugin command")
+	}
+	path, err := exec.LookPath(os.Args[1])
+	if err != nil {
+		return err
+	}
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, execEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	return syscall.Exec(path, os.Args[1:], env)
+}
@@ -0,0 +1,218 @@
+// main.go - Katzenpost Kaetzchen plugin supervisor.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The supervisor is a CBOR Kaetzchen plugin that runs another plugin, and
+// forwards the provider's requests to it.  It restarts the plugin with
+// exponential backoff when it exits, or when a request times out, applies
+// resource limits and an optional sandbox to it, logs its output tagged
+// with the capability, and reports its status on a management socket.
+//
+// It also applies request limits (see plugin.Limiter), whose counters are
+// part of the status.  Run by the provider, the supervisor is one of the
+// MaxConcurrency plugin processes of the capability, and is only sent one
+// request at a time, so the quota is a share of the capability's, and
+// requests never queue.  With -listen, the supervisor instead runs on its
+// own, and serves the bridge plugins (see plugin/bridge) of all the
+// provider's plugin processes over a socket, so the quota, the queue, and
+// the counters are those of the capability.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/daemons/plugin/socket"
+	"github.com/katzenpost/server/cborplugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const cmdStatus = "STATUS"
+
+func main() {
+	if spec := os.Getenv(execEnv); spec != "" {
+		// This is the plugin process, before it executes the plugin.
+		err := execPlugin(spec)
+		fmt.Fprintf(os.Stderr, "Failed to execute the plugin: %v\n", err)
+		os.Exit(-1)
+	}
+
+	cfg := new(config)
+	flag.StringVar(&cfg.command, "command", "", "Path to the plugin to supervise.")
+	args := flag.String("args", "", "Space separated arguments of the plugin.")
+	flag.StringVar(&cfg.capability, "capability", "", "Capability of the plugin, which tags its log, by default the command's name.")
+	flag.DurationVar(&cfg.requestTimeout, "request-timeout", 30*time.Second, "Request timeout, after which the plugin is restarted.")
+	flag.DurationVar(&cfg.minBackoff, "min-backoff", time.Second, "Delay before the first restart of the plugin.")
+	flag.DurationVar(&cfg.maxBackoff, "max-backoff", 5*time.Minute, "Maximum delay between restarts, and the uptime after which the plugin counts as recovered.")
+	flag.IntVar(&cfg.maxFailures, "max-failures", 0, "Consecutive failures after which the plugin is not restarted, 0 for no limit.")
+	flag.Uint64Var(&cfg.limits.memory, "max-memory", 0, "Address space limit of the plugin in bytes, 0 for no limit.")
+	flag.DurationVar(&cfg.limits.cpu, "max-cpu", 0, "CPU time limit of each plugin process, 0 for no limit.")
+	flag.Uint64Var(&cfg.limits.files, "max-files", 0, "Open file limit of the plugin, 0 for no limit.")
+	// The provider passes every flag with a value, which boolean flags do
+	// not take.
+	sandbox := flag.String("sandbox", "false", "Run the plugin in new namespaces, without network access, under a seccomp filter (Linux only).")
+	limitCfg := new(plugin.LimitConfig)
+	flag.Uint64Var(&limitCfg.MaxRequestsPerEpoch, "max-requests-per-epoch", 0, "Maximum number of requests per epoch, to the capability with -listen, otherwise to this plugin process, of the capability's MaxConcurrency, 0 for no limit.")
+	flag.IntVar(&limitCfg.MaxConcurrency, "max-concurrency", 1, "Maximum number of requests sent to the plugin at once, with -listen.")
+	flag.IntVar(&limitCfg.MaxQueueDepth, "max-queue", 0, "Maximum number of requests waiting for the plugin with -listen, 0 for no limit.")
+	flag.StringVar(&limitCfg.DropPolicy, "drop-policy", plugin.DropNewest, "Request dropped when the queue is full, \"newest\" or \"oldest\".")
+	listen := flag.String("listen", "", "Serve the bridge plugins over a socket at this address, \"unix:/path/to/socket\" or \"tcp:127.0.0.1:1234\", instead of the provider.")
+	overloadReply := flag.String("overload-reply", "", "Base64 encoded reply to send to the SURB of a request refused by the limits, in the plugin's error format, empty to drop it.")
+	logFile := flag.String("log-file", "", "Log file, usually the server's, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	statusDir := flag.String("status-dir", "", "Directory to create the management socket in, empty disables it.")
+	printStatus := flag.String("status", "", "Print the status of every supervisor with a management socket in this directory and exit.")
+	flag.Parse()
+
+	if *printStatus != "" {
+		if err := writeStatus(*printStatus); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+	if cfg.command == "" {
+		fmt.Fprintf(os.Stderr, "-command is mandatory\n")
+		os.Exit(-1)
+	}
+	cfg.args = strings.Fields(*args)
+	if cfg.capability == "" {
+		cfg.capability = filepath.Base(cfg.command)
+	}
+	var err error
+	if cfg.sandbox, err = strconv.ParseBool(*sandbox); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -sandbox: %v\n", err)
+		os.Exit(-1)
+	}
+	if *overloadReply != "" {
+		b, err := base64.StdEncoding.DecodeString(*overloadReply)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -overload-reply: %v\n", err)
+			os.Exit(-1)
+		}
+		limitCfg.OverloadReply = func(*cborplugin.Request, error) []byte { return b }
+	}
+	if cfg.minBackoff <= 0 || cfg.maxBackoff < cfg.minBackoff {
+		fmt.Fprintf(os.Stderr, "Invalid -min-backoff or -max-backoff\n")
+		os.Exit(-1)
+	}
+
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("supervisor/" + cfg.capability)
+
+	s := newSupervisor(cfg, logger, logBackend.GetLogger(cfg.capability))
+	defer s.Halt()
+	l, err := plugin.WithLimits(s, limitCfg)
+	if err != nil {
+		logger.Errorf("Invalid limits: %v", err)
+		os.Exit(-1)
+	}
+
+	if *statusDir != "" {
+		// Every instance of the plugin has a supervisor, so the socket is
+		// named after the process.
+		p := filepath.Join(*statusDir, fmt.Sprintf("%v.%v.sock", cfg.capability, os.Getpid()))
+		m, err := management.New(p, "Kaetzchen plugin supervisor", logBackend)
+		if err == nil {
+			m.RegisterCommand(cmdStatus, func(c *thwack.Conn, _ string) error {
+				stats := l.Stats()
+				return management.WriteLines(c, []string{s.status() + " " + stats.String()}, thwack.StatusOk)
+			})
+			err = m.Start()
+		}
+		if err != nil {
+			logger.Errorf("Failed to start the management socket: %v", err)
+			os.Exit(-1)
+		}
+		defer m.Halt()
+	}
+
+	if *listen != "" {
+		err = serveSocket(*listen, l, logger)
+	} else {
+		err = plugin.Serve(l, logger)
+	}
+	if err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
+
+// serveSocket serves the requests of the bridge plugins on the socket at
+// addr with h, till SIGINT or SIGTERM.
+func serveSocket(addr string, h plugin.Handler, log *logging.Logger) error {
+	network, address, err := socket.SplitAddress(addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if _, err = os.Stat(address); !os.IsNotExist(err) {
+			if err = os.Remove(address); err != nil {
+				return fmt.Errorf("failed to delete stale socket '%v': %v", address, err)
+			}
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	haltCh := make(chan interface{})
+	go func() {
+		<-ch
+		close(haltCh)
+		l.Close()
+	}()
+	log.Noticef("Serving the bridge plugins on: %v", addr)
+	err = socket.Serve(l, h, log)
+	select {
+	case <-haltCh:
+		return nil
+	default:
+		return err
+	}
+}
+
+// writeStatus writes the status of every supervisor with a management
+// socket in dir to stdout.
+func writeStatus(dir string) error {
+	socks, err := filepath.Glob(filepath.Join(dir, "*.sock"))
+	if err != nil {
+		return err
+	}
+	for _, p := range socks {
+		if err := management.Run(p, cmdStatus, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stdout, "%v: unreachable: %v\n", filepath.Base(p), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// sandbox_linux.go - Katzenpost Kaetzchen plugin supervisor sandbox.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysProcAttr returns the attributes of the plugin process, which is
+// killed if the supervisor dies.  The sandbox puts the plugin in new user,
+// mount, PID, IPC, UTS and network namespaces, so that it has no network
+// access, and can not see or signal any other process, and restrictSelf
+// then applies a seccomp filter to it.  A user namespace, with the
+// supervisor's uid and gid mapped to themselves, is what allows an
+// unprivileged supervisor to create the others.
+func sysProcAttr(sandbox bool) (*syscall.SysProcAttr, error) {
+	attr := &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	if sandbox {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+	return attr, nil
+}
+
+// restrictSelf keeps the sandboxed plugin from gaining privileges, through
+// set-uid executables or file capabilities, and applies the seccomp filter
+// to it.  Both only apply to the calling thread, so it stays locked to the
+// goroutine that executes the plugin.
+func restrictSelf() error {
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+	return installSeccompFilter()
+}
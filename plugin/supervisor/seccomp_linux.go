@@ -0,0 +1,129 @@
+// seccomp_linux.go - Katzenpost Kaetzchen plugin supervisor seccomp filter.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompRetKill  = 0x00000000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	// seccompDataNr and seccompDataArch are the offsets of the fields of
+	// struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// x32SyscallBit is set in the numbers of the x32 ABI system calls,
+	// which the filter refuses rather than match each twice.
+	x32SyscallBit = 0x40000000
+)
+
+// auditArch is the AUDIT_ARCH value of each supported GOARCH.
+var auditArch = map[string]uint32{
+	"386":   0x40000003,
+	"amd64": 0xc000003e,
+	"arm":   0x40000028,
+	"arm64": 0xc00000b7,
+}
+
+// deniedSyscalls are the system calls that the sandboxed plugin fails
+// with EPERM.  None is of use to a plugin, and they are those that could
+// reach other processes, change the namespaces and mounts, or expose the
+// more fragile parts of the kernel.
+var deniedSyscalls = []uintptr{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_BPF,
+	unix.SYS_CHROOT,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_MOUNT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_SYSLOG,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+}
+
+// seccompFilter returns the BPF program that denies the deniedSyscalls,
+// and kills the process on a system call of another architecture.
+func seccompFilter() ([]unix.SockFilter, error) {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("no seccomp filter for %v", runtime.GOARCH)
+	}
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	errno := seccompRetErrno | uint32(syscall.EPERM)
+
+	filter := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetKill),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, errno),
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, errno))
+	}
+	return append(filter, stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow)), nil
+}
+
+// installSeccompFilter applies the seccomp filter to the calling thread,
+// which must have no_new_privs set, and which the plugin inherits on exec.
+func installSeccompFilter() error {
+	filter, err := seccompFilter()
+	if err != nil {
+		return err
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err = unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("failed to set the seccomp filter: %v", err)
+	}
+	return nil
+}
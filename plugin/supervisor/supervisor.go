@@ -0,0 +1,345 @@
+// supervisor.go - Katzenpost Kaetzchen plugin supervisor.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const stopTimeout = 5 * time.Second
+
+type state int
+
+const (
+	stateStarting state = iota
+	stateRunning
+	stateRestarting
+	stateFailed
+)
+
+func (s state) String() string {
+	switch s {
+	case stateStarting:
+		return "starting"
+	case stateRunning:
+		return "running"
+	case stateRestarting:
+		return "restarting"
+	case stateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("[unknown state: %d]", s)
+	}
+}
+
+type config struct {
+	command    string
+	args       []string
+	capability string
+
+	requestTimeout time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	maxFailures    int
+
+	limits  limits
+	sandbox bool
+}
+
+// child is a running plugin process.
+type child struct {
+	cmd        *exec.Cmd
+	httpClient *http.Client
+
+	doneCh chan interface{}
+	err    error
+}
+
+func (c *child) post(path string, body []byte, v interface{}) error {
+	resp, err := c.httpClient.Post("http://unix"+path, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("plugin replied: %v", resp.Status)
+	}
+	return codec.NewDecoder(resp.Body, new(codec.CborHandle)).Decode(v)
+}
+
+// stop asks the plugin to exit as the provider does, and kills it if it
+// does not.
+func (c *child) stop() {
+	c.cmd.Process.Signal(syscall.SIGHUP)
+	select {
+	case <-c.doneCh:
+	case <-time.After(stopTimeout):
+		c.cmd.Process.Kill()
+		<-c.doneCh
+	}
+}
+
+// supervisor runs a plugin process, restarts it when it exits or hangs,
+// and forwards the provider's requests to it.
+type supervisor struct {
+	sync.Mutex
+	worker.Worker
+
+	cfg      *config
+	log      *logging.Logger
+	childLog *logging.Logger
+
+	state    state
+	child    *child
+	restarts int
+	since    time.Time
+	lastErr  error
+	params   cborplugin.Parameters
+
+	readyOnce sync.Once
+	readyCh   chan interface{}
+}
+
+// OnRequest forwards the request to the plugin.  A request that times out
+// is taken to mean that the plugin hangs, and it is restarted.
+func (s *supervisor) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	s.Lock()
+	c, st := s.child, s.state
+	s.Unlock()
+	if c == nil {
+		return nil, fmt.Errorf("plugin is %v", st)
+	}
+
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := new(cborplugin.Response)
+	if err := c.post(plugin.RequestPath, b, resp); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			s.log.Warningf("Request %v timed out after %v, restarting the plugin.", req.ID, s.cfg.requestTimeout)
+			c.cmd.Process.Kill()
+		}
+		return nil, err
+	}
+	return resp.Payload, nil
+}
+
+// Parameters returns the parameters of the plugin, once the first attempt
+// to start it is over.
+func (s *supervisor) Parameters() cborplugin.Parameters {
+	<-s.readyCh
+
+	s.Lock()
+	defer s.Unlock()
+	return s.params
+}
+
+// status returns a one line summary of the supervisor's state.
+func (s *supervisor) status() string {
+	s.Lock()
+	defer s.Unlock()
+
+	st := fmt.Sprintf("%v state=%v supervisor=%v", s.cfg.capability, s.state, os.Getpid())
+	if s.child != nil {
+		st += fmt.Sprintf(" pid=%v", s.child.cmd.Process.Pid)
+	}
+	st += fmt.Sprintf(" restarts=%v since=%v", s.restarts, s.since.UTC().Format(time.RFC3339))
+	if s.lastErr != nil {
+		st += fmt.Sprintf(" last_error=%q", s.lastErr.Error())
+	}
+	return st
+}
+
+func (s *supervisor) setState(st state, c *child, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.state, s.child, s.since = st, c, time.Now()
+	if err != nil {
+		s.lastErr = err
+	}
+	if st == stateRestarting {
+		s.restarts++
+	}
+}
+
+func (s *supervisor) worker() {
+	defer s.log.Debugf("Halting worker.")
+
+	backoff := s.cfg.minBackoff
+	failures := 0
+	for {
+		c, err := s.start()
+		if err == nil {
+			s.setState(stateRunning, c, nil)
+			s.readyOnce.Do(func() { close(s.readyCh) })
+			s.log.Noticef("Plugin started, pid %v.", c.cmd.Process.Pid)
+
+			started := time.Now()
+			select {
+			case <-s.HaltCh():
+				c.stop()
+				return
+			case <-c.doneCh:
+			}
+			err = c.err
+			if err == nil {
+				err = errors.New("plugin exited")
+			}
+			if time.Since(started) > s.cfg.maxBackoff {
+				// The plugin ran for long enough to count as having
+				// recovered.
+				backoff, failures = s.cfg.minBackoff, 0
+			}
+		}
+
+		failures++
+		if s.cfg.maxFailures > 0 && failures >= s.cfg.maxFailures {
+			s.setState(stateFailed, nil, err)
+			s.readyOnce.Do(func() { close(s.readyCh) })
+			s.log.Errorf("Plugin failed %v times in a row, giving up: %v", failures, err)
+			<-s.HaltCh()
+			return
+		}
+		s.setState(stateRestarting, nil, err)
+		s.readyOnce.Do(func() { close(s.readyCh) })
+		s.log.Warningf("Plugin failed: %v, restarting in %v.", err, backoff)
+
+		select {
+		case <-s.HaltCh():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.cfg.maxBackoff {
+			backoff = s.cfg.maxBackoff
+		}
+	}
+}
+
+// start launches the plugin, and fetches its parameters.
+func (s *supervisor) start() (*child, error) {
+	cmd, err := s.cfg.limits.command(s.cfg.command, s.cfg.args, s.cfg.sandbox)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	c := &child{cmd: cmd, doneCh: make(chan interface{})}
+	pathCh := make(chan string, 1)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// The first line is the plugin's socket path, the rest is logged.
+		sc := bufio.NewScanner(stdout)
+		if sc.Scan() {
+			pathCh <- sc.Text()
+		}
+		close(pathCh)
+		s.logLines(stdout, sc, s.childLog.Infof)
+	}()
+	go func() {
+		defer wg.Done()
+		s.logLines(stderr, bufio.NewScanner(stderr), s.childLog.Warningf)
+	}()
+	go func() {
+		// Wait must not be called before the output is read.
+		wg.Wait()
+		c.err = cmd.Wait()
+		close(c.doneCh)
+	}()
+
+	var p string
+	select {
+	case p = <-pathCh:
+	case <-time.After(s.cfg.requestTimeout):
+	}
+	if p == "" {
+		c.stop()
+		return nil, fmt.Errorf("plugin did not report its socket: %v", c.err)
+	}
+	c.httpClient = &http.Client{
+		Timeout: s.cfg.requestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", p)
+			},
+		},
+	}
+
+	params := make(cborplugin.Parameters)
+	if err = c.post(plugin.ParametersPath, nil, &params); err != nil {
+		c.stop()
+		return nil, fmt.Errorf("failed to fetch the plugin's parameters: %v", err)
+	}
+	s.Lock()
+	s.params = params
+	s.Unlock()
+	return c, nil
+}
+
+// logLines logs the lines of the plugin's output r, read with sc.
+func (s *supervisor) logLines(r io.Reader, sc *bufio.Scanner, fn func(string, ...interface{})) {
+	for sc.Scan() {
+		fn("%s", sc.Text())
+	}
+	// A line too long for the scanner stops it, so drain the rest, as the
+	// plugin must never block on its output.
+	io.Copy(ioutil.Discard, r)
+}
+
+func newSupervisor(cfg *config, log, childLog *logging.Logger) *supervisor {
+	s := &supervisor{
+		cfg:      cfg,
+		log:      log,
+		childLog: childLog,
+		state:    stateStarting,
+		since:    time.Now(),
+		readyCh:  make(chan interface{}),
+	}
+	s.Go(s.worker)
+	return s
+}
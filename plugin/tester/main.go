@@ -0,0 +1,96 @@
+// main.go - Katzenpost panic and timeout tester Kaetzchen plugin.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// The tester plugin is a reference CBOR Kaetzchen plugin, which misbehaves
+// on request, to test how the provider and the supervisor cope.  The
+// payload is a command:
+//
+//	panic            the request handler panics.
+//	sleep <duration> the request handler sleeps, e.g. "sleep 1m".
+//	exit             the plugin exits with status 1.
+//
+// Any other payload is echoed.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/daemons/plugin"
+	"github.com/katzenpost/server/cborplugin"
+	"gopkg.in/op/go-logging.v1"
+)
+
+type tester struct {
+	log *logging.Logger
+}
+
+func (t *tester) OnRequest(req *cborplugin.Request) ([]byte, error) {
+	cmd := strings.Fields(string(bytes.TrimRight(req.Payload, "\x00")))
+	if len(cmd) == 0 {
+		return req.Payload, nil
+	}
+	switch cmd[0] {
+	case "panic":
+		panic(fmt.Sprintf("request %v asked to panic", req.ID))
+	case "sleep":
+		if len(cmd) != 2 {
+			return nil, fmt.Errorf("usage: sleep <duration>")
+		}
+		d, err := time.ParseDuration(cmd[1])
+		if err != nil {
+			return nil, err
+		}
+		t.log.Debugf("Request %v sleeping for %v.", req.ID, d)
+		time.Sleep(d)
+		return []byte("slept " + d.String()), nil
+	case "exit":
+		t.log.Noticef("Request %v asked to exit.", req.ID)
+		os.Exit(1)
+	}
+	return req.Payload, nil
+}
+
+func (t *tester) Parameters() cborplugin.Parameters {
+	return nil
+}
+
+func main() {
+	timeout := flag.Duration("timeout", 0, "Request timeout, 0 for none.")
+	logFile := flag.String("log-file", "", "Log file, by default nothing is logged.")
+	logLevel := flag.String("log-level", "NOTICE", "Log level.")
+	flag.Parse()
+
+	logBackend, err := plugin.NewLogBackend(*logFile, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+	logger := logBackend.GetLogger("tester")
+
+	var h plugin.Handler = &tester{log: logger}
+	if *timeout > 0 {
+		h = plugin.WithTimeout(h, *timeout)
+	}
+	if err = plugin.Serve(h, logger); err != nil {
+		logger.Errorf("Failed to serve: %v", err)
+		os.Exit(-1)
+	}
+}
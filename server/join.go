@@ -0,0 +1,80 @@
+// join.go - Katzenpost server join requests.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/daemons/internal/whitelist"
+	"github.com/katzenpost/server/config"
+)
+
+// writeJoinRequest writes a join request for the node, signed with its
+// identity key, to the file f, or to stdout if f is "-".  The identity key
+// is generated if it does not exist yet, as the server would.
+func writeJoinRequest(cfg *config.Config, f, contact, family string) error {
+	var identityKey *eddsa.PrivateKey
+	if cfg.Debug.IdentityKey != nil {
+		identityKey = new(eddsa.PrivateKey)
+		if err := identityKey.FromBytes(cfg.Debug.IdentityKey.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(cfg.Server.DataDir, 0700); err != nil {
+			return err
+		}
+		var err error
+		privFile := filepath.Join(cfg.Server.DataDir, "identity.private.pem")
+		pubFile := filepath.Join(cfg.Server.DataDir, "identity.public.pem")
+		if identityKey, err = eddsa.Load(privFile, pubFile, rand.Reader); err != nil {
+			return err
+		}
+	}
+	defer identityKey.Reset()
+
+	r := &whitelist.JoinRequest{
+		IsProvider: cfg.Server.IsProvider,
+		Contact:    contact,
+		Family:     family,
+	}
+	if cfg.Server.IsProvider {
+		r.Identifier = cfg.Server.Identifier
+	}
+	if !cfg.Server.OnlyAdvertiseAltAddresses {
+		r.Addresses = append(r.Addresses, cfg.Server.Addresses...)
+	}
+	for _, v := range cfg.Server.AltAddresses {
+		r.Addresses = append(r.Addresses, v...)
+	}
+	sort.Strings(r.Addresses)
+
+	s, err := r.Sign(identityKey)
+	if err != nil {
+		return err
+	}
+	if f == "-" {
+		_, err = fmt.Fprintln(os.Stdout, s)
+		return err
+	}
+	return ioutil.WriteFile(f, []byte(s+"\n"), 0600)
+}
@@ -21,9 +21,14 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/internal/registration"
 	"github.com/katzenpost/server"
 	"github.com/katzenpost/server/config"
 )
@@ -31,6 +36,28 @@ import (
 func main() {
 	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
 	genOnly := flag.Bool("g", false, "Generate the keys and exit immediately.")
+	joinRequest := flag.String("join-request", "", "Write a signed authority join request to this file (\"-\" for stdout) and exit.")
+	joinContact := flag.String("join-contact", "", "Operator contact information for -join-request.")
+	joinFamily := flag.String("join-family", "", "Operator (family) name for -join-request.")
+	regAddrs := flag.String("registration-address", "", "Comma separated addresses to serve user registrations on, empty disables the service.")
+	regInvitations := flag.Bool("registration-invitations", false, "Require an invitation code to register.")
+	regCert := flag.String("registration-tls-cert", "", "PEM encoded TLS certificate of the registration service, empty disables TLS.")
+	regKey := flag.String("registration-tls-key", "", "PEM encoded TLS key of the registration service.")
+	regRate := flag.Float64("registration-rate", 10, "Registration attempts allowed per client address and hour, 0 for no limit.")
+	regBurst := flag.Int("registration-burst", 3, "Registration attempts allowed at once per client address.")
+	regAudit := flag.String("registration-audit-log", "", "Log the registration attempts to this file, without the users' keys.")
+	regCtl := flag.String("registration-ctl", "", "Send a command to the running registration service's management socket and exit.")
+	udbFlags := new(userDBFlags)
+	flag.StringVar(&udbFlags.url, "userdb-url", "", "Base URL of the external user database, which enables the gateway of the extern UserDB backend.")
+	flag.StringVar(&udbFlags.keyFile, "userdb-hmac-key", "", "File with the HMAC key shared with the external user database, empty disables request signing.")
+	flag.StringVar(&udbFlags.certFile, "userdb-tls-cert", "", "PEM encoded TLS client certificate for the external user database.")
+	flag.StringVar(&udbFlags.tlsKeyFile, "userdb-tls-key", "", "PEM encoded TLS client key for the external user database.")
+	flag.StringVar(&udbFlags.caFile, "userdb-tls-ca", "", "PEM encoded CA certificate of the external user database, by default the system's CAs.")
+	flag.DurationVar(&udbFlags.timeout, "userdb-timeout", 5*time.Second, "Timeout of the external user database lookups.")
+	flag.DurationVar(&udbFlags.ttl, "userdb-ttl", time.Minute, "How long users that exist are cached.")
+	flag.DurationVar(&udbFlags.negativeTTL, "userdb-negative-ttl", 10*time.Second, "How long users that do not exist are cached.")
+	flag.DurationVar(&udbFlags.staleTTL, "userdb-stale-ttl", time.Hour, "How long cached users are served while the external user database is unavailable.")
+	flag.IntVar(&udbFlags.maxEntries, "userdb-max-entries", 100000, "Maximum number of cached users, 0 for no limit.")
 	flag.Parse()
 
 	// Set the umask to something "paranoid".
@@ -51,6 +78,20 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
 		os.Exit(-1)
 	}
+	if *joinRequest != "" {
+		if err = writeJoinRequest(cfg, *joinRequest, *joinContact, *joinFamily); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write join request: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+	if *regCtl != "" {
+		if err = management.Run(filepath.Join(cfg.Server.DataDir, registrationSocketFile), *regCtl, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
 	if *genOnly && !cfg.Debug.GenerateOnly {
 		cfg.Debug.GenerateOnly = true
 	}
@@ -62,6 +103,17 @@ func main() {
 	rotateCh := make(chan os.Signal)
 	signal.Notify(rotateCh, syscall.SIGHUP)
 
+	// Start the extern UserDB gateway first, as the provider authenticates
+	// its users with it.
+	var udb *userDBGateway
+	if udbFlags.url != "" && !cfg.Debug.GenerateOnly {
+		if udb, err = newUserDBGateway(cfg, udbFlags); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start the UserDB gateway: %v\n", err)
+			os.Exit(-1)
+		}
+		defer udb.halt()
+	}
+
 	// Start up the server.
 	svr, err := server.New(cfg)
 	if err != nil {
@@ -73,6 +125,25 @@ func main() {
 	}
 	defer svr.Shutdown()
 
+	// Start the registration service, once the server's management socket
+	// is up.
+	var reg *registrationService
+	if *regAddrs != "" {
+		sCfg := &registration.ServerConfig{
+			Addresses: strings.Split(*regAddrs, ","),
+			CertFile:  *regCert,
+			KeyFile:   *regKey,
+			Rate:      *regRate,
+			Burst:     *regBurst,
+		}
+		if reg, err = newRegistrationService(cfg, sCfg, *regInvitations, *regAudit); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start the registration service: %v\n", err)
+			svr.Shutdown()
+			os.Exit(-1)
+		}
+		defer reg.halt()
+	}
+
 	// Halt the server gracefully on SIGINT/SIGTERM.
 	go func() {
 		<-haltCh
@@ -83,6 +154,12 @@ func main() {
 	go func() {
 		<-rotateCh
 		svr.RotateLog()
+		if reg != nil {
+			reg.rotateLog()
+		}
+		if udb != nil {
+			udb.rotateLog()
+		}
 	}()
 
 	// Wait for the server to explode or be terminated.
@@ -0,0 +1,124 @@
+// registration.go - Katzenpost server user registration service.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/daemons/internal/management"
+	"github.com/katzenpost/daemons/internal/registration"
+	"github.com/katzenpost/server/config"
+)
+
+const (
+	invitationsFile = "invitations.db"
+
+	// registrationSocketFile is the name of the registration service's
+	// management socket in the DataDir, as the server's own management
+	// socket can not be extended.
+	registrationSocketFile = "registration_sock"
+)
+
+type registrationService struct {
+	logBackend  *log.Backend
+	invitations *registration.Invitations
+	audit       *registration.AuditLog
+	mgmt        *thwack.Server
+	server      *registration.Server
+}
+
+func (r *registrationService) halt() {
+	if r.server != nil {
+		r.server.Halt()
+	}
+	if r.mgmt != nil {
+		r.mgmt.Halt()
+	}
+	if r.invitations != nil {
+		r.invitations.Close()
+	}
+	if r.audit != nil {
+		r.audit.Close()
+	}
+}
+
+func (r *registrationService) rotateLog() {
+	r.logBackend.Rotate()
+}
+
+// newRegistrationService serves user registrations as configured by sCfg,
+// adding the users through the provider's management socket.  With
+// invitations, registering requires an invitation code, minted with the
+// INVITATION_MINT command of the registration management socket.
+func newRegistrationService(cfg *config.Config, sCfg *registration.ServerConfig, invitations bool, auditFile string) (*registrationService, error) {
+	if !cfg.Server.IsProvider || !cfg.Management.Enable {
+		return nil, errors.New("the registration service requires a provider with the management interface enabled")
+	}
+	if cfg.Provider.EnableUserRegistrationHTTP {
+		return nil, errors.New("the registration service replaces Provider.EnableUserRegistrationHTTP, which must be disabled")
+	}
+
+	var err error
+	r := new(registrationService)
+	if r.logBackend, err = newLogBackend(cfg); err != nil {
+		return nil, err
+	}
+	if invitations {
+		if r.invitations, err = registration.NewInvitations(filepath.Join(cfg.Server.DataDir, invitationsFile)); err != nil {
+			return nil, err
+		}
+		if r.mgmt, err = management.New(filepath.Join(cfg.Server.DataDir, registrationSocketFile), "Registration", r.logBackend); err != nil {
+			r.halt()
+			return nil, err
+		}
+		registration.RegisterCommands(r.mgmt, r.invitations)
+		if err = r.mgmt.Start(); err != nil {
+			r.mgmt = nil
+			r.halt()
+			return nil, err
+		}
+	}
+	if auditFile != "" {
+		if !filepath.IsAbs(auditFile) {
+			auditFile = filepath.Join(cfg.Server.DataDir, auditFile)
+		}
+		if r.audit, err = registration.OpenAuditLog(auditFile); err != nil {
+			r.halt()
+			return nil, err
+		}
+	}
+
+	registrar := registration.NewRegistrar(cfg.Management.Path, r.invitations, r.audit)
+	if r.server, err = registration.NewServer(registrar, sCfg, r.logBackend.GetLogger("registration")); err != nil {
+		r.halt()
+		return nil, err
+	}
+	return r, nil
+}
+
+// newLogBackend returns a log backend for the daemon's own subsystems,
+// logging to the same destination as the server.
+func newLogBackend(cfg *config.Config) (*log.Backend, error) {
+	p := cfg.Logging.File
+	if !cfg.Logging.Disable && p != "" && !filepath.IsAbs(p) {
+		p = filepath.Join(cfg.Server.DataDir, p)
+	}
+	return log.New(p, cfg.Logging.Level, cfg.Logging.Disable)
+}
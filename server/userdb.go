@@ -0,0 +1,104 @@
+// userdb.go - Katzenpost server external user database gateway.
+// Copyright (C) 2018  Yawning Angel, David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/daemons/internal/userdb"
+	"github.com/katzenpost/server/config"
+)
+
+// userDBFlags are the flags of the extern UserDB gateway.
+type userDBFlags struct {
+	url         string
+	keyFile     string
+	certFile    string
+	tlsKeyFile  string
+	caFile      string
+	timeout     time.Duration
+	ttl         time.Duration
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+	maxEntries  int
+}
+
+type userDBGateway struct {
+	logBackend *log.Backend
+	gateway    *userdb.Gateway
+}
+
+func (u *userDBGateway) halt() {
+	u.gateway.Halt()
+}
+
+func (u *userDBGateway) rotateLog() {
+	u.logBackend.Rotate()
+}
+
+// newUserDBGateway serves the provider's extern UserDB backend on the
+// address of its ProviderURL, from a cache of the users looked up with the
+// external service at f.url.
+func newUserDBGateway(cfg *config.Config, f *userDBFlags) (*userDBGateway, error) {
+	if !cfg.Server.IsProvider || cfg.Provider.UserDB == nil || cfg.Provider.UserDB.Backend != config.BackendExtern {
+		return nil, errors.New("the UserDB gateway requires a provider with the extern UserDB backend")
+	}
+	u, err := url.Parse(cfg.Provider.UserDB.Extern.ProviderURL)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("invalid ProviderURL for the UserDB gateway: '%v'", cfg.Provider.UserDB.Extern.ProviderURL)
+	}
+
+	c := &userdb.Client{URL: f.url}
+	if f.keyFile != "" {
+		if c.Key, err = ioutil.ReadFile(f.keyFile); err != nil {
+			return nil, err
+		}
+		if c.Key = bytes.TrimSpace(c.Key); len(c.Key) == 0 {
+			return nil, errors.New("empty UserDB HMAC key")
+		}
+	}
+	tlsCfg, err := userdb.TLSConfig(f.certFile, f.tlsKeyFile, f.caFile)
+	if err != nil {
+		return nil, err
+	}
+	c.HTTPClient = &http.Client{
+		Timeout:   f.timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+
+	g := new(userDBGateway)
+	if g.logBackend, err = newLogBackend(cfg); err != nil {
+		return nil, err
+	}
+	cacheCfg := &userdb.CacheConfig{
+		TTL:         f.ttl,
+		NegativeTTL: f.negativeTTL,
+		StaleTTL:    f.staleTTL,
+		MaxEntries:  f.maxEntries,
+	}
+	if g.gateway, err = userdb.NewGateway(c, cacheCfg, u.Host, g.logBackend.GetLogger("userdb")); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
@@ -0,0 +1,381 @@
+// kaetzchen_test.go - Katzenpost CBOR plugin Kaetzchen tests.
+// Copyright (C) 2018  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nvClient "github.com/katzenpost/authority/nonvoting/client"
+	nvServer "github.com/katzenpost/authority/nonvoting/server"
+	nvConfig "github.com/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx"
+	sphinxCommands "github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/katzenpost/server"
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// mix is a layer 0 mix that sends packets to the provider over an incoming
+// connection, and receives the packets the provider sends it.
+type mix struct {
+	identityKey *eddsa.PrivateKey
+	linkKey     *ecdh.PrivateKey
+	mixKey      *ecdh.PrivateKey
+
+	l        net.Listener
+	connCh   chan interface{}
+	packetCh chan []byte
+}
+
+func (m *mix) IsPeerValid(creds *wire.PeerCredentials) bool {
+	return true
+}
+
+func (m *mix) sessionConfig() *wire.SessionConfig {
+	return &wire.SessionConfig{
+		Authenticator:     m,
+		AdditionalData:    m.identityKey.PublicKey().Bytes(),
+		AuthenticationKey: m.linkKey,
+		RandomReader:      rand.Reader,
+	}
+}
+
+func (m *mix) acceptWorker() {
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		go m.onConn(conn)
+	}
+}
+
+func (m *mix) onConn(conn net.Conn) {
+	defer conn.Close()
+
+	s, err := wire.NewSession(m.sessionConfig(), false)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	if err = s.Initialize(conn); err != nil {
+		return
+	}
+	select {
+	case m.connCh <- true:
+	default:
+	}
+	for {
+		cmd, err := s.RecvCommand()
+		if err != nil {
+			return
+		}
+		if c, ok := cmd.(*commands.SendPacket); ok {
+			m.packetCh <- c.SphinxPacket
+		}
+	}
+}
+
+func (m *mix) descriptor(addr string, epoch uint64) *pki.MixDescriptor {
+	return &pki.MixDescriptor{
+		Name:        "mix",
+		IdentityKey: m.identityKey.PublicKey(),
+		LinkKey:     m.linkKey.PublicKey(),
+		MixKeys:     map[uint64]*ecdh.PublicKey{epoch: m.mixKey.PublicKey()},
+		Addresses:   map[pki.Transport][]string{pki.TransportTCPv4: []string{addr}},
+		Layer:       0,
+	}
+}
+
+func newMix(t *testing.T) *mix {
+	m := &mix{
+		connCh:   make(chan interface{}, 1),
+		packetCh: make(chan []byte, 1),
+	}
+	var err error
+	if m.identityKey, err = eddsa.NewKeypair(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if m.linkKey, err = ecdh.NewKeypair(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if m.mixKey, err = ecdh.NewKeypair(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if m.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go m.acceptWorker()
+	return m
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestCBORPluginKaetzchen runs the echo plugin under a provider, and round
+// trips a request from a mix through it.  The provider only fetches the
+// document after its recheck interval, so this takes over a minute.
+func TestCBORPluginKaetzchen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the provider test in short mode")
+	}
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kaetzchen_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"authority", "provider"} {
+		if err = os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	echoCmd := filepath.Join(dir, "echo")
+	if out, err := exec.Command("go", "build", "-o", echoCmd, "github.com/katzenpost/daemons/plugin/echo").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build the echo plugin: %v\n%s", err, out)
+	}
+
+	authKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMix(t)
+	defer m.l.Close()
+
+	// The authority generates the document for the current epoch as soon
+	// as both the mix and the provider have posted their descriptors.
+	authAddr := freeAddr(t)
+	authCfg := &nvConfig.Config{
+		Authority: &nvConfig.Authority{
+			Addresses: []string{authAddr},
+			DataDir:   filepath.Join(dir, "authority"),
+		},
+		Logging: &nvConfig.Logging{
+			File:  filepath.Join(dir, "authority.log"),
+			Level: "DEBUG",
+		},
+		Debug: &nvConfig.Debug{
+			IdentityKey:      authKey,
+			Layers:           1,
+			MinNodesPerLayer: 1,
+		},
+		Mixes:     []*nvConfig.Node{{IdentityKey: m.identityKey.PublicKey()}},
+		Providers: []*nvConfig.Node{{Identifier: "provider", IdentityKey: providerKey.PublicKey()}},
+	}
+	if err = authCfg.FixupAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := nvServer.New(authCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Shutdown()
+
+	logBackend, err := log.New(filepath.Join(dir, "client.log"), "DEBUG", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkiClient, err := nvClient.New(&nvClient.Config{
+		LogBackend: logBackend,
+		Address:    authAddr,
+		PublicKey:  authKey.PublicKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch, _, _ := epochtime.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+	if err = pkiClient.Post(ctx, epoch, m.identityKey, m.descriptor(m.l.Addr().String(), epoch)); err != nil {
+		t.Fatal(err)
+	}
+
+	providerAddr := freeAddr(t)
+	echoLog := filepath.Join(dir, "echo.log")
+	cfg := &config.Config{
+		Server: &config.Server{
+			Identifier: "provider",
+			Addresses:  []string{providerAddr},
+			DataDir:    filepath.Join(dir, "provider"),
+			IsProvider: true,
+		},
+		Logging: &config.Logging{
+			File:  filepath.Join(dir, "provider.log"),
+			Level: "DEBUG",
+		},
+		Provider: &config.Provider{
+			CBORPluginKaetzchen: []*config.CBORPluginKaetzchen{
+				&config.CBORPluginKaetzchen{
+					Capability:     "echo",
+					Endpoint:       "+echo",
+					Command:        echoCmd,
+					MaxConcurrency: 1,
+					Config: map[string]interface{}{
+						"log-file":  echoLog,
+						"log-level": "NOTICE",
+					},
+				},
+			},
+		},
+		PKI: &config.PKI{
+			Nonvoting: &config.Nonvoting{
+				Address:   authAddr,
+				PublicKey: authKey.PublicKey().String(),
+			},
+		},
+		Debug: &config.Debug{
+			IdentityKey:      providerKey,
+			KaetzchenDelay:   750,
+			DisableRateLimit: true,
+		},
+	}
+	if err = cfg.FixupAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	halted := false
+	defer func() {
+		if !halted {
+			s.Shutdown()
+		}
+	}()
+
+	// The provider connects to the mix once it has the document.
+	select {
+	case <-m.connCh:
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for the provider to connect")
+	}
+
+	// The published descriptor carries the plugin's parameters.
+	doc, _, err := pkiClient.Get(ctx, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(doc.Providers, 1) {
+		return
+	}
+	desc := doc.Providers[0]
+	assert.Equal("+echo", desc.Kaetzchen["echo"]["endpoint"], "descriptor: echo endpoint")
+
+	// Send a request with a SURB that returns to the mix.
+	var recipient sphinxCommands.Recipient
+	copy(recipient.ID[:], "+echo")
+	fwdPath := []*sphinx.PathHop{
+		&sphinx.PathHop{
+			ID:        desc.IdentityKey.ByteArray(),
+			PublicKey: desc.MixKeys[epoch],
+			Commands:  []sphinxCommands.RoutingCommand{&recipient, &sphinxCommands.NodeDelay{}},
+		},
+	}
+	surbPath := []*sphinx.PathHop{
+		&sphinx.PathHop{
+			ID:        m.identityKey.PublicKey().ByteArray(),
+			PublicKey: m.mixKey.PublicKey(),
+			Commands:  []sphinxCommands.RoutingCommand{&sphinxCommands.Recipient{}, &sphinxCommands.SURBReply{}},
+		},
+	}
+	surb, surbKeys, err := sphinx.NewSURB(rand.Reader, surbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := []byte("hello, echo")
+	payload := make([]byte, constants.ForwardPayloadLength)
+	payload[0] = 1
+	copy(payload[constants.SphinxPlaintextHeaderLength:], surb)
+	copy(payload[constants.SphinxPlaintextHeaderLength+sphinx.SURBLength:], request)
+	pkt, err := sphinx.NewPacket(rand.Reader, fwdPath, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", providerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session, err := wire.NewSession(m.sessionConfig(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err = session.Initialize(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SendCommand(&commands.SendPacket{SphinxPacket: pkt}); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply []byte
+	select {
+	case reply = <-m.packetCh:
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for the reply")
+	}
+	b, _, _, err := sphinx.Unwrap(m.mixKey, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = sphinx.DecryptSURBPayload(b, surbKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]byte{0x01, 0x00}, b[:2], "reply: header")
+	assert.Equal(request, b[2:2+len(request)], "reply: payload")
+
+	// The provider halts the plugin with SIGHUP when it shuts down.
+	s.Shutdown()
+	halted = true
+	var hungUp bool
+	for i := 0; i < 50 && !hungUp; i++ {
+		b, _ := ioutil.ReadFile(echoLog)
+		hungUp = bytes.Contains(b, []byte("Received hangup"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(hungUp, "plugin: not halted by SIGHUP")
+}